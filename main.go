@@ -1,10 +1,19 @@
 package main
 
 import (
-	"code/internal/gosession"
+	"log"
+
+	"code/pkg/gosession"
 )
 
 func main() {
-	gosession.Start()
+	server, err := gosession.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := server.Run(); err != nil {
+		log.Fatal(err)
+	}
 
 }
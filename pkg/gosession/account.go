@@ -0,0 +1,220 @@
+package gosession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	ACCOUNT STATUS SYSTEM
+
+	The session only holds a snapshot of the role from when the user signed in, so the role and
+	the status of the account are read from the database on every request instead. This way a
+	role change, a suspension or a deleted account take effect on the sessions that already exist.
+
+	The lookups are cached for ACCOUNT_CACHE_TTL seconds to save a database call on every request,
+	changes made through this server clear the cache of the user straight away while other
+	instances pick them up once their cache expires.
+
+*/
+
+const (
+	// UserStatusActive is the status of an account that can be used, users without a status are active
+	UserStatusActive = "ACTIVE"
+	// UserStatusSuspended is the status of an account that can not sign in or use its sessions
+	UserStatusSuspended = "SUSPENDED"
+
+	// accountCacheMaxEntries is the size at which the expired entries are swept
+	accountCacheMaxEntries = 10000
+)
+
+var errAccountSuspended = errors.New("This account is suspended")
+var errSessionNotSignedIn = errors.New("No user is signed in with this session")
+
+// account is the role and the status of a user as they are in the database
+type account struct {
+	Role   string
+	Status string
+}
+
+// active checks if the account can be used
+func (a account) active() bool {
+	return a.Status == "" || a.Status == UserStatusActive
+}
+
+type accountCacheEntry struct {
+	account   account
+	expiresAt time.Time
+}
+
+// accountCache keeps the accounts that were looked up for a short time
+type accountCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]accountCacheEntry
+}
+
+func newAccountCache(ttl time.Duration) *accountCache {
+	return &accountCache{
+		ttl:     ttl,
+		entries: map[string]accountCacheEntry{},
+	}
+}
+
+func (a *accountCache) get(userID string) (account, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.entries[userID]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return account{}, false
+	}
+	return entry.account, true
+}
+
+func (a *accountCache) set(userID string, acc account) {
+	if a.ttl <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if len(a.entries) >= accountCacheMaxEntries {
+		for id, entry := range a.entries {
+			if now.After(entry.expiresAt) {
+				delete(a.entries, id)
+			}
+		}
+	}
+	a.entries[userID] = accountCacheEntry{account: acc, expiresAt: now.Add(a.ttl)}
+}
+
+func (a *accountCache) forget(userID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.entries, userID)
+}
+
+// UserStatus is used by an admin to suspend or reactivate a user
+type UserStatus struct {
+	Status string `json:"status" bson:"status" validate:"required,oneof=ACTIVE SUSPENDED"`
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureAccountRoutes - Configure all the routes for the account status here
+func (s *Server) configureAccountRoutes() {
+
+	// suspending a user also signs out every session of the user
+	s.echo.PUT("/users/:id/status", s.putUserStatus, s.SessionMiddleware("user"), s.PermissionMiddleware("users:suspend"))
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// putUserStatus suspends or reactivates a user
+func (s *Server) putUserStatus(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id := c.Param("id")
+	userID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return c.String(http.StatusNotFound, "This user id is invalid")
+	}
+
+	var userStatus UserStatus
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&userStatus); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	userStatus.Status = strings.ToUpper(userStatus.Status)
+	if err := c.Validate(userStatus); err != nil {
+		log.Printf("Unable to validate the userStatus %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	err = s.users.UpdateUser(ctx, userID, bson.D{
+		{Key: "status", Value: userStatus.Status},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err == errNotFound {
+		return c.String(http.StatusNotFound, "No user found")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The status could not be changed")
+	}
+	s.accounts.forget(id)
+
+	if userStatus.Status == UserStatusSuspended {
+		count, err := s.deleteAllUserSessions(ctx, id, "")
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Printf("%d sessions were signed out after the account was suspended\n", count)
+	}
+
+	return c.JSON(http.StatusOK, "User status has been changed")
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// lookupAccount returns the role and status of the user from the cache or the database,
+// errNotFound is returned if the user was deleted
+func (s *Server) lookupAccount(ctx context.Context, userID string) (account, error) {
+	if acc, ok := s.accounts.get(userID); ok {
+		return acc, nil
+	}
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return account{}, errNotFound
+	}
+
+	user, err := s.users.FindUserByID(ctx, id)
+	if err != nil {
+		return account{}, err
+	}
+
+	acc := account{Role: user.Role, Status: user.Status}
+	s.accounts.set(userID, acc)
+	return acc, nil
+}
+
+// sessionAccount returns the user id of the session and the account of that user,
+// errSessionNotSignedIn is returned when there is no signed in user
+func (s *Server) sessionAccount(c echo.Context) (string, account, error) {
+	session, err := s.getSession(c)
+	if err != nil {
+		return "", account{}, errSessionNotSignedIn
+	}
+
+	userID, _ := session.Values["userID"].(string)
+	if userID == "" {
+		return "", account{}, errSessionNotSignedIn
+	}
+
+	acc, err := s.lookupAccount(c.Request().Context(), userID)
+	if err != nil {
+		return userID, account{}, err
+	}
+	return userID, acc, nil
+}
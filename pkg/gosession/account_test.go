@@ -0,0 +1,90 @@
+package gosession
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSuspendedUserIsSignedOut(t *testing.T) {
+	password := "password1234"
+	adminEmail := uniqueEmail("status-admin")
+	email := uniqueEmail("status")
+
+	insertUser(t, testServer, adminEmail, password, "admin")
+	registerAndConfirm(t, email, password)
+	cookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, cookie)
+	adminCookies := []*http.Cookie{signInAs(t, adminEmail, password)}
+	path := "/users/" + user.ID.Hex() + "/status"
+
+	rec := testRequest{method: http.MethodPut, path: path, body: UserStatus{Status: "GONE"}, cookies: adminCookies}.do(t)
+	expectStatus(t, rec, http.StatusPartialContent)
+
+	rec = testRequest{method: http.MethodPut, path: path, body: UserStatus{Status: UserStatusSuspended}, cookies: adminCookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodGet, path: "/", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	rec = testRequest{method: http.MethodPut, path: path, body: UserStatus{Status: UserStatusActive}, cookies: adminCookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	signInAs(t, email, password)
+}
+
+func TestSessionMiddlewareReadsTheAccountFromTheDatabase(t *testing.T) {
+	server := newTestServer(t, func(config *ConfigApplication) {
+		config.AccountCacheTTL = 60
+	})
+
+	email := uniqueEmail("lookup")
+	password := "password1234"
+	id := insertUser(t, server, email, password, "user")
+	cookies := []*http.Cookie{signInOn(t, server, email, password)}
+
+	rec := testRequest{method: http.MethodGet, path: "/rbac/roles", cookies: cookies, server: server}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	// a change made straight in the database is only seen once the cache expires
+	if err := server.users.UpdateUser(context.Background(), id, bson.D{{Key: "role", Value: "admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	rec = testRequest{method: http.MethodGet, path: "/rbac/roles", cookies: cookies, server: server}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	server.accounts.forget(id.Hex())
+	rec = testRequest{method: http.MethodGet, path: "/rbac/roles", cookies: cookies, server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// the session of a deleted user can not be used
+	if err := server.users.DeleteUser(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	server.accounts.forget(id.Hex())
+	rec = testRequest{method: http.MethodGet, path: "/", cookies: cookies, server: server}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+}
+
+func TestUpdateUserByEmailInsertsUnknownEmails(t *testing.T) {
+	ctx := context.Background()
+	email := uniqueEmail("upsert")
+
+	// like the original queries the update is an upsert, which has no user from before the update
+	before, err := testServer.users.UpdateUserByEmail(ctx, email, bson.D{{Key: "verified", Value: true}})
+	if err != errNotFound || before != nil {
+		t.Fatalf("expected no user before the update but got %v %v", before, err)
+	}
+	user, err := testServer.users.FindUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Verified {
+		t.Fatalf("expected the inserted user to have the fields but got %+v", user)
+	}
+}
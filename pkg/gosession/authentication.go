@@ -1,27 +1,32 @@
 package gosession
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	// emailAuthTokenModeConfirmAccount is the mode of the token sent when an account is registered
+	emailAuthTokenModeConfirmAccount = "CONFIRM_ACCOUNT"
+	// emailAuthTokenModeResetPassword is the mode of the token sent when a password reset is asked for
+	emailAuthTokenModeResetPassword = "RESET_PASSWORD"
+)
+
+var errEmailAuthTokenInvalid = errors.New("This email auth token is invalid")
+
 // MODELS -------------------------------------------------------------------------------
 
 // SignInUser is a struct for when a user tries to sign in
@@ -49,6 +54,8 @@ type SubmitNewUser struct {
 	CreatedAt      time.Time          `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
 	UpdatedAt      time.Time          `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
 	Role           string             `json:"role,omitempty" bson:"role,omitempty"`
+	Verified       bool               `json:"verified" bson:"verified"`
+	Identities     []Identity         `json:"-" bson:"identities,omitempty"`
 }
 
 // SendEmail is used to send to the email service to reset the password
@@ -71,6 +78,9 @@ type EmailAuthToken struct {
 	CreatedAt time.Time `json:"createdAt,omitempty" bson:"createdAt,omitempty" validate:"required"`
 	ExpiresAt time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty" validate:"required"`
 	Mode      string    `json:"mode" bson:"mode" validate:"required"`
+	// UserID and NewEmail are only set on the tokens of the change email system
+	UserID   string `json:"userID,omitempty" bson:"userID,omitempty"`
+	NewEmail string `json:"newEmail,omitempty" bson:"newEmail,omitempty"`
 }
 
 // NewPassword this is the new password for when a user changes his password
@@ -78,40 +88,47 @@ type NewPassword struct {
 	Password string `json:"password" bson:"password" validate:"required,min=10,max=128"`
 }
 
+// UpdatePassword is used when a signed in user changes their password
+type UpdatePassword struct {
+	CurrentPassword string `json:"currentPassword" bson:"currentPassword" validate:"required,min=10,max=128"`
+	Password        string `json:"password" bson:"password" validate:"required,min=10,max=128"`
+}
+
 // ROUTES --------------------------------------------------------------------------
 
 // ConfigureAuthenticationRoutes - Configure all the routes for authentication here
-func configureAuthenticationRoutes() {
-
-	e.POST("/users/:id/change-email", changeEmail, SessionMiddleware("user"))
+func (s *Server) configureAuthenticationRoutes() {
 
-	// Check if an email already exists on the system
-	// TODO rate limit
-	e.GET("/auth/emails/:email", getAccountExistViaEmailParam)
+	// Check if an email already exists on the system, limited so the emails can not be listed
+	s.echo.GET("/auth/emails/:email", s.getAccountExistViaEmailParam, s.RateLimit("email_exists", RateLimitByIP))
 
-	// TODO rate limit
-	e.POST("/auth/sign-in", signIn, middleware.BodyLimit("1K"))
+	// failed sign ins are limited per email and per ip, see lockout.go
+	s.echo.POST("/auth/sign-in", s.signIn, middleware.BodyLimit("1K"))
 
 	// signs the user out
-	e.POST("/auth/sign-out", signOut)
+	s.echo.POST("/auth/sign-out", s.signOut)
 
 	// registers a user account
-	e.POST("/auth/register", register, middleware.BodyLimit("1M"))
+	s.echo.POST("/auth/register", s.register, middleware.BodyLimit("1M"))
 
 	// confirms a user account
-	e.POST("/auth/confirm-account/:email/:code", confirmAccount)
+	s.echo.POST("/auth/confirm-account/:email/:code", s.confirmAccount)
 
 	// creates reset password auth token and sends a reset password email
-	e.POST("/auth/reset-password/:email", resetPassword)
+	s.echo.POST("/auth/reset-password/:email", s.resetPassword)
 
 	// confirms reset password auth token
 	// sets a fresh new password for user without needing old password
 	// this should be called from frontend after /auth/reset-password/:email
 	// this route needs a code from email to confirm if it exists in database
-	e.POST("/auth/change-password/:email/:code", changePassword)
+	s.echo.POST("/auth/change-password/:email/:code", s.changePassword)
+
+	// sets a new password for the signed in user using their current password
+	// every other session of the user is signed out
+	s.echo.POST("/auth/update-password", s.updatePassword, s.SessionMiddleware("user"), middleware.BodyLimit("1K"))
 
 	// checks if the user exists in the redis session store
-	e.GET("/auth/get-user-via-session", getUserViaSession)
+	s.echo.GET("/auth/get-user-via-session", s.getUserViaSession)
 
 }
 
@@ -121,9 +138,7 @@ func configureAuthenticationRoutes() {
 // email to confirm the accounts email.
 // The email will contain a link, this link will have a unique code that can be typed
 // in or a link clicked to run the confirm email route.
-func register(c echo.Context) error {
-
-	collection := mg.Db.Collection("users")
+func (s *Server) register(c echo.Context) error {
 
 	var user NewUser
 
@@ -141,8 +156,8 @@ func register(c echo.Context) error {
 
 	err := isEmailValid(user.Email)
 	if err != nil {
-		s := fmt.Sprintf("Your email is not valid: %v", user.Email)
-		return c.String(http.StatusNotAcceptable, s)
+		message := fmt.Sprintf("Your email is not valid: %v", user.Email)
+		return c.String(http.StatusNotAcceptable, message)
 	}
 
 	hashedPassword := hashAndSalt([]byte(user.Password))
@@ -170,7 +185,7 @@ func register(c echo.Context) error {
 		return c.JSON(http.StatusPartialContent, err.Error())
 	}
 
-	_, err = collection.InsertOne(c.Request().Context(), submitNewUser)
+	_, err = s.users.InsertUser(c.Request().Context(), submitNewUser)
 	if err != nil {
 		log.Printf("Unable to insert new user :%v", err)
 		fmt.Println(err)
@@ -183,13 +198,13 @@ func register(c echo.Context) error {
 	// start of the confirm account email process
 
 	// generate password reset token with no expiry
-	authToken, err := generateEmailAuthToken(submitNewUser.Email, 0, 0, 0, false, "CONFIRM_ACCOUNT")
+	authToken, err := generateEmailAuthToken(submitNewUser.Email, 0, 0, 0, false, emailAuthTokenModeConfirmAccount)
 	if err != nil {
 		fmt.Println(err)
 		return c.JSON(http.StatusPartialContent, "To confirm account please contact support")
 	}
 	// send reset token to the database
-	err = addEmailAuthTokenToDatabase(authToken)
+	err = s.addEmailAuthTokenToDatabase(authToken)
 	if err != nil {
 		return c.String(http.StatusNotFound, err.Error())
 	}
@@ -207,7 +222,7 @@ func register(c echo.Context) error {
 	}
 
 	// send email
-	err = sendEmail(data)
+	err = s.sendEmail(data)
 	if err != nil {
 		fmt.Println("error at send email")
 		fmt.Println(err)
@@ -220,12 +235,12 @@ func register(c echo.Context) error {
 }
 
 // This route will confirm the account
-func confirmAccount(c echo.Context) error {
+func (s *Server) confirmAccount(c echo.Context) error {
 
 	email := c.Param("email")
 	code := c.Param("code")
 
-	err := doesAccountExistViaEmailString(email)
+	err := s.doesAccountExistViaEmailString(email)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This email does not exist.")
 	}
@@ -235,19 +250,20 @@ func confirmAccount(c echo.Context) error {
 
 	// TODO check if user is already verified
 
-	err = doesEmailAuthTokenExistAndNotExpired(code, email)
+	// the code has to be a confirmation sent to this email, codes of the other modes are refused
+	_, err = s.findEmailAuthTokenForMode(c.Request().Context(), code, email, emailAuthTokenModeConfirmAccount)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This email auth token is invalid")
 	}
 
 	// change the verified to true
-	err = verifyUserAccount(email)
+	err = s.verifyUserAccount(email)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This account could not be verified")
 	}
 
 	// delete the token now that it was found
-	err = deleteEmailAuthTokensBasedOnMode(code, email, "CONFIRM_ACCOUNT")
+	err = s.deleteEmailAuthTokensBasedOnMode(code, email, emailAuthTokenModeConfirmAccount)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This auth token could not be deleted")
 	}
@@ -258,7 +274,9 @@ func confirmAccount(c echo.Context) error {
 // after the user has clicked the reset password button in the email it will bring them to
 // the application with a query param code and let them change their password.
 // The application should send the new password with the code to the backend here.
-func changePassword(c echo.Context) error {
+func (s *Server) changePassword(c echo.Context) error {
+
+	ctx := c.Request().Context()
 
 	// check if the code exists for this email in the emailAuth collection.
 	// if it does  and is not expired then update the password for this user and delete the auth from the collection.
@@ -266,7 +284,7 @@ func changePassword(c echo.Context) error {
 	email := c.Param("email")
 	code := c.Param("code")
 
-	err := doesAccountExistViaEmailString(email)
+	err := s.doesAccountExistViaEmailString(email)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This email does not exist.")
 	}
@@ -274,7 +292,8 @@ func changePassword(c echo.Context) error {
 		return c.String(http.StatusNotFound, "You have not supplied a valid confirmation code")
 	}
 
-	err = doesEmailAuthTokenExistAndNotExpired(code, email)
+	// the code has to be a reset sent to this email, codes of the other modes are refused
+	_, err = s.findEmailAuthTokenForMode(ctx, code, email, emailAuthTokenModeResetPassword)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This email auth token is invalid")
 	}
@@ -293,22 +312,87 @@ func changePassword(c echo.Context) error {
 		return c.JSON(http.StatusPartialContent, err.Error())
 	}
 
+	// the code is used up before the password is changed, when two requests send the same code
+	// only the one that deleted it changes the password
+	err = s.emailAuthTokens.DeleteEmailAuthToken(ctx, email, code)
+	if err == errNotFound {
+		return c.String(http.StatusNotFound, "This email auth token is invalid")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "This auth token could not be deleted")
+	}
+
 	hashedPassword := hashAndSalt([]byte(newPassword.Password))
 
 	// change the users password to the new hashed and salted one
-	err = changeUserPassword(email, hashedPassword)
+	err = s.changeUserPassword(email, hashedPassword, "")
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println("This account could not be verified")
 		return c.String(http.StatusNotFound, "This account could not be verified")
 	}
 
-	// delete the token now that it was found
-	err = deleteEmailAuthTokensBasedOnMode(code, email, "RESET_PASSWORD")
+	// the other reset emails can not be used once the password was changed
+	_, err = s.emailAuthTokens.DeleteEmailAuthTokensByMode(ctx, email, emailAuthTokenModeResetPassword)
 	if err != nil {
 		fmt.Println(err)
-		fmt.Println("This auth token could not be deleted")
-		return c.String(http.StatusNotFound, "This auth token could not be deleted")
+	}
+
+	return c.JSON(http.StatusOK, "User password has been changed")
+}
+
+// a signed in user can change their password by supplying their current password.
+// The session that made the change stays signed in, all the others are signed out.
+func (s *Server) updatePassword(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	var updatedPassword UpdatePassword
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&updatedPassword); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(updatedPassword); err != nil {
+		log.Printf("Unable to validate the updatedPassword %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	sessionUserID, ok := session.Values["userID"].(string)
+	if !ok || sessionUserID == "" {
+		return c.String(http.StatusUnauthorized, "authentication required")
+	}
+
+	userID, err := primitive.ObjectIDFromHex(sessionUserID)
+	if err != nil {
+		return c.String(http.StatusNotFound, "This user id is invalid")
+	}
+
+	databaseUser, err := s.users.FindUserByID(ctx, userID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "This user account does not exist")
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(databaseUser.HashedPassword), []byte(updatedPassword.CurrentPassword))
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "Incorrect password")
+	}
+
+	hashedPassword := hashAndSalt([]byte(updatedPassword.Password))
+
+	err = s.changeUserPassword(databaseUser.Email, hashedPassword, session.ID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The password could not be changed")
 	}
 
 	return c.JSON(http.StatusOK, "User password has been changed")
@@ -317,7 +401,7 @@ func changePassword(c echo.Context) error {
 // when a user cannot log in and needs to reset their password they click the reset password
 // button from the application which will call this route. This will generate an email auth token
 // and store it in the email auth collection. It will then send the password reset email to the user
-func resetPassword(c echo.Context) error {
+func (s *Server) resetPassword(c echo.Context) error {
 
 	// QueryParams - example[?oldPassword=oldPassword&newPassword=newPassword]
 	// TODO - Implement this route, do it via a form post not a url query parameter
@@ -330,13 +414,13 @@ func resetPassword(c echo.Context) error {
 		return c.String(http.StatusNotFound, "You have not supplied a valid email")
 	}
 
-	err := doesAccountExistViaEmailString(email)
+	err := s.doesAccountExistViaEmailString(email)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This account does not exist")
 	}
 
 	// reset password auth token expires after 1 day
-	authToken, err := generateEmailAuthToken(email, 0, 0, 1, true, "RESET_PASSWORD")
+	authToken, err := generateEmailAuthToken(email, 0, 0, 1, true, emailAuthTokenModeResetPassword)
 	if err != nil {
 		// custom error code TODO and say contact support
 		// TODO
@@ -344,7 +428,7 @@ func resetPassword(c echo.Context) error {
 		return c.JSON(http.StatusPartialContent, "To confirm account please contact support")
 	}
 	// send reset token to the database
-	err = addEmailAuthTokenToDatabase(authToken)
+	err = s.addEmailAuthTokenToDatabase(authToken)
 	if err != nil {
 		return c.String(http.StatusNotFound, err.Error())
 	}
@@ -367,7 +451,7 @@ func resetPassword(c echo.Context) error {
 	}
 
 	// send email
-	err = sendEmail(data)
+	err = s.sendEmail(data)
 	if err != nil {
 		fmt.Println("error at send reset passwordemail")
 		fmt.Println(err)
@@ -378,18 +462,14 @@ func resetPassword(c echo.Context) error {
 }
 
 // getAccountExists - This will check if an account exists on the system via email address
-func getAccountExistViaEmailParam(c echo.Context) error {
-
-	collection := mg.Db.Collection("users")
+func (s *Server) getAccountExistViaEmailParam(c echo.Context) error {
 
 	email := c.Param("email")
 	if email == "" {
 		return c.String(http.StatusNotFound, "You have not supplied a valid email")
 	}
 
-	var user ExistingUser
-	query := bson.M{"email": email}
-	err := collection.FindOne(c.Request().Context(), &query).Decode(&user)
+	_, err := s.users.FindUserByEmail(c.Request().Context(), email)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This account does not exist on our system")
 	}
@@ -397,7 +477,7 @@ func getAccountExistViaEmailParam(c echo.Context) error {
 	return c.String(http.StatusAccepted, "This account already exists")
 }
 
-func signOut(c echo.Context) error {
+func (s *Server) signOut(c echo.Context) error {
 	/*
 		sess, err := session.Get("session", c)
 		if err != nil {
@@ -412,24 +492,33 @@ func signOut(c echo.Context) error {
 		sess.Options.MaxAge = -1
 		sess.Save(c.Request(), c.Response())
 	*/
-	store := redisSessionInstance.Store
-	session, err := store.Get(c.Request(), "session_")
+	session, err := s.getSession(c)
 	if err != nil {
 		log.Fatal("failed getting session: ", err)
 	}
+	// the id has to be read before the session is deleted
+	sessionID := session.ID
+	userID, _ := session.Values["userID"].(string)
+
 	// Delete session (MaxAge <= 0)
 	session.Options.MaxAge = -1
 	if err = session.Save(c.Request(), c.Response()); err != nil {
 		log.Fatal("failed deleting session: ", err)
 	}
 
+	if userID != "" {
+		err = s.deleteUserSession(c.Request().Context(), userID, sessionID)
+		if err != nil {
+			fmt.Println("failed removing session from index: ", err)
+		}
+	}
+
 	return c.JSON(http.StatusOK, "signed out")
 }
 
 // sign in
-func signIn(c echo.Context) error {
+func (s *Server) signIn(c echo.Context) error {
 	ctx := c.Request().Context()
-	collection := mg.Db.Collection("users")
 
 	var signInUser SignInUser
 
@@ -446,46 +535,70 @@ func signIn(c echo.Context) error {
 		return c.JSON(http.StatusPartialContent, err.Error())
 	}
 
-	var databaseUser DatabaseUser
+	ip := c.RealIP()
 
-	filter := bson.M{"email": signInUser.Email}
-	err := collection.FindOne(ctx, filter).Decode(&databaseUser)
+	// refuse the sign in before the password is checked when this email or ip failed too often
+	if err := s.checkSignInAllowed(ctx, signInUser.Email, ip); err != nil {
+		return s.signInFailed(c, err)
+	}
+
+	databaseUser, err := s.users.FindUserByEmail(ctx, signInUser.Email)
 	if err != nil {
 		fmt.Println(err)
+		if err := s.recordSignInFailure(ctx, signInUser.Email, ip, nil); err != nil {
+			return s.signInFailed(c, err)
+		}
 		return c.String(http.StatusNotAcceptable, "This user account does not exist")
 	}
 
+	if err := checkAccountLocked(databaseUser); err != nil {
+		return s.signInFailed(c, err)
+	}
+
 	// here we compare the password for this users hashedpassword in the collection for the matching email for this passed in password
 	err = bcrypt.CompareHashAndPassword([]byte(databaseUser.HashedPassword), []byte(signInUser.Password))
 	if err != nil {
 		fmt.Println(err)
+		if err := s.recordSignInFailure(ctx, signInUser.Email, ip, databaseUser); err != nil {
+			return s.signInFailed(c, err)
+		}
 		return c.String(http.StatusNotAcceptable, "Incorrect password")
 	}
 
-	store := redisSessionInstance.Store
+	s.resetSignInFailures(ctx, signInUser.Email)
 
-	session, err := store.Get(c.Request(), "session_")
+	if !(account{Status: databaseUser.Status}).active() {
+		return c.String(http.StatusForbidden, errAccountSuspended.Error())
+	}
+
+	session, err := s.getSession(c)
 	if err != nil {
 		return c.String(http.StatusNotAcceptable, "failed getting session")
 	}
 
-	// checks if session exists or is new one
-	// only need to set data to its values if it's new
-	if session.IsNew {
-		// check here if too many sessions exist TODO - set a max limit of sessions per user
-		//session.Values["id"] = existingUser.ID.String()
-
-		session.Values["role"] = databaseUser.Role
-		session.Values["userID"] = databaseUser.ID.Hex()
-
-		// TODO when checking if too many sessions for this user check the usersessionid exists more than certain times in Redis
-		// session.Values["userSessionID"] = existingUser.userSessionID
-		session.IsNew = false
-		// Save session
-		if err = session.Save(c.Request(), c.Response()); err != nil {
+	// the password is not enough when two factor is turned on, the session waits for the code
+	if databaseUser.TOTPEnabled {
+		if err = s.startPendingSignIn(c, session, databaseUser); err != nil {
 			fmt.Println("failed saving session: ", err)
 			return c.String(http.StatusNotAcceptable, "failed saving session")
 		}
+		return c.JSON(http.StatusAccepted, echo.Map{
+			"totpRequired": true,
+			"message":      errTOTPRequired.Error(),
+		})
+	}
+
+	err = s.startUserSession(c, session, databaseUser)
+	if err == errMaxSessionsReached {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		fmt.Println("failed starting the session: ", err)
+		return c.String(http.StatusNotAcceptable, "failed saving session")
+	}
+
+	if sessionMode(c) == sessionModeJWT {
+		return s.respondWithAccessTokens(c, session, databaseUser)
 	}
 
 	/*
@@ -494,14 +607,13 @@ func signIn(c echo.Context) error {
 	*/
 
 	// TODO (for subdomains) Domain: "domain.com"
-	// TODO ensure  no more than 3 sessions for this user id
 
 	// set the id value to the request to pass into the getUser route
 	//c.SetParamNames("id")
 	//c.SetParamValues(existingUser.ID.Hex())
 
 	//return getUser(c)
-	user, err := getUserByID(databaseUser.ID.Hex())
+	user, err := s.getUserByID(databaseUser.ID.Hex())
 	if err != nil {
 		return c.String(http.StatusNotAcceptable, "failed getting new user")
 	}
@@ -512,15 +624,11 @@ func signIn(c echo.Context) error {
 
 // This will return the user by the sessions stored id,
 // if the session is valid and the user exists in the collection
-func getUserViaSession(c echo.Context) error {
+func (s *Server) getUserViaSession(c echo.Context) error {
 
 	fmt.Println("starting get user by session")
 
-	collection := mg.Db.Collection("users")
-
-	store := redisSessionInstance.Store
-
-	session, err := store.Get(c.Request(), "session_")
+	session, err := s.getSession(c)
 	if err != nil {
 		return c.String(http.StatusNotAcceptable, "failed getting session")
 	}
@@ -528,28 +636,24 @@ func getUserViaSession(c echo.Context) error {
 	// in collection:
 	// _id = ObjectId("5fb15136c36043c315aec107")
 
-	id := session.Values["userID"]
-	if id == nil {
+	id, ok := session.Values["userID"].(string)
+	if !ok {
 		return c.String(http.StatusNotFound, "This user id is invalid")
 	}
 
-	converted, err := primitive.ObjectIDFromHex(id.(string))
+	converted, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This user id is invalid")
 	}
-	query := bson.M{"_id": converted}
-
-	var user ExistingUser
-
-	err = collection.FindOne(c.Request().Context(), &query).Decode(&user)
 
+	user, err := s.users.FindUserByID(c.Request().Context(), converted)
 	if err != nil {
 		fmt.Println(err.Error())
 		return c.String(http.StatusNotFound, err.Error())
 	}
 
 	// return user in JSON format
-	return c.JSON(http.StatusOK, user)
+	return c.JSON(http.StatusOK, user.existingUser())
 }
 
 // END ROUTE FUNCTIONS --------------------------------------------------------------------------
@@ -557,56 +661,14 @@ func getUserViaSession(c echo.Context) error {
 // INTERNAL FUNCTIONS --------------------------------------------------------------------------
 
 // this will send an email request to the email service
-func sendEmail(email SendEmail) error {
-
-	var endpoint = ""
-	if email.Template == "CONFIRM_ACCOUNT" {
-		// TODO change in production
-		endpoint = "http://127.0.0.1:8081/auth/confirm-account"
-	} else if email.Template == "RESET_PASSWORD" {
-		// TODO change in production
-		endpoint = "http://127.0.0.1:8081/auth/reset-password"
-	} else {
-		return errors.New("No valid template option supplied")
-	}
-
-	byteInfo, err := json.Marshal(email)
-	if err != nil {
-		fmt.Println(err)
-		return errors.New(err.Error())
-	}
-
-	resp, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(byteInfo))
-	if err != nil {
-		fmt.Println(err)
-		return errors.New(err.Error())
-	}
-
-	client := &http.Client{}
-	newResp, err := client.Do(resp)
-	if err != nil {
-		fmt.Println(err)
-		return errors.New(err.Error())
-	}
-
-	defer newResp.Body.Close()
-	body, err := ioutil.ReadAll(newResp.Body)
-	if err != nil {
-		fmt.Println(string(body))
-		fmt.Println(err)
-		return errors.New(err.Error())
-	}
-	return nil
-
+func (s *Server) sendEmail(email SendEmail) error {
+	return s.mailer.SendEmail(email)
 }
 
 // this will add the supplied email auth token to the email auth collection
-func addEmailAuthTokenToDatabase(emailAuthToken EmailAuthToken) error {
-	// TODO create this collection in the mongo db
-	collection := mg.Db.Collection("emailAuthTokens")
-
+func (s *Server) addEmailAuthTokenToDatabase(emailAuthToken EmailAuthToken) error {
 	// TODO verify emailAuthToken is validated here or above
-	result, err := collection.InsertOne(context.Background(), emailAuthToken)
+	err := s.emailAuthTokens.InsertEmailAuthToken(context.Background(), emailAuthToken)
 	if err != nil {
 		log.Printf("Unable to insert new email auth token :%v", err)
 		fmt.Println("Unable to insert new email auth token: ")
@@ -616,22 +678,16 @@ func addEmailAuthTokenToDatabase(emailAuthToken EmailAuthToken) error {
 
 	fmt.Println("addEmailAuthTokenToDatabase")
 	fmt.Println(emailAuthToken)
-	fmt.Println("result: ")
-	fmt.Println(result)
 	return nil
 }
 
 // this is used to determine if a email address exists on the system
-func doesAccountExistViaEmailString(email string) error {
-	collection := mg.Db.Collection("users")
-
+func (s *Server) doesAccountExistViaEmailString(email string) error {
 	if email == "" {
 		return errors.New("You have not supplied a valid email")
 	}
 
-	var user ExistingUser
-	query := bson.M{"email": email}
-	err := collection.FindOne(context.Background(), &query).Decode(&user)
+	_, err := s.users.FindUserByEmail(context.Background(), email)
 	if err != nil {
 		return errors.New("This email account does not exist on the system")
 	}
@@ -641,38 +697,29 @@ func doesAccountExistViaEmailString(email string) error {
 
 // email auth token functions
 
-// this is used to determine if an email auth token exists and is not invalid
-func doesEmailAuthTokenExistAndNotExpired(code string, email string) error {
-	collection := mg.Db.Collection("emailAuthTokens")
-
-	// we assume the account exists at this stage to save on database operations
-	// TODO check if the email is a valid one here
-	if code == "" {
-		return errors.New("You have not supplied a valid code")
-	}
-	if email == "" {
-		return errors.New("You have not supplied a valid email")
+// findEmailAuthTokenForMode returns the token if it was sent to this email for this mode and has not expired
+func (s *Server) findEmailAuthTokenForMode(ctx context.Context, code string, email string, mode string) (*EmailAuthToken, error) {
+	if code == "" || email == "" {
+		return nil, errEmailAuthTokenInvalid
 	}
 
-	var token EmailAuthToken
-	query := bson.M{"code": code}
-	err := collection.FindOne(context.Background(), &query).Decode(&token)
+	token, err := s.emailAuthTokens.FindEmailAuthToken(ctx, code)
 	if err != nil {
-		return errors.New("This email auth token does not exist on the system")
+		return nil, errEmailAuthTokenInvalid
 	}
 
-	if token.ExpiresAt.IsZero() {
-		return nil
+	if token.Email != email || token.Mode != mode {
+		return nil, errEmailAuthTokenInvalid
 	}
 
-	if time.Now().After(token.ExpiresAt) {
-		return errors.New("This code is expired")
+	if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+		return nil, errors.New("This code is expired")
 	}
 
-	return nil
+	return token, nil
 }
 
-func deleteEmailAuthToken(code string, email string) error {
+func (s *Server) deleteEmailAuthToken(code string, email string) error {
 
 	// we assume this account exists at this point to save on database operations
 	if code == "" {
@@ -683,26 +730,20 @@ func deleteEmailAuthToken(code string, email string) error {
 	}
 
 	// find and delete the signal with the given ID
-	query := bson.D{
-		{Key: "email", Value: email},
-		{Key: "code", Value: code},
+	err := s.emailAuthTokens.DeleteEmailAuthToken(context.Background(), email, code)
+	if err == errNotFound {
+		return errors.New("No email auth token found")
 	}
-	result, err := mg.Db.Collection("emailAuthTokens").DeleteOne(context.Background(), &query)
-
 	if err != nil {
 		return errors.New(err.Error())
 	}
 
-	if result.DeletedCount < 1 {
-		return errors.New("No email auth token found")
-	}
-
 	// the record was deleted
 	fmt.Println("The auth token was deleted")
 	return nil
 }
 
-func deleteEmailAuthTokensBasedOnMode(code string, email string, mode string) error {
+func (s *Server) deleteEmailAuthTokensBasedOnMode(code string, email string, mode string) error {
 
 	// we assume this account exists at this point to save on database operations
 	if code == "" {
@@ -719,17 +760,12 @@ func deleteEmailAuthTokensBasedOnMode(code string, email string, mode string) er
 	// if mode == "RESET_PASSWORD" - delete all for email with RESET_PASSWORD
 
 	// find and delete the signal with the given ID
-	query := bson.D{
-		{Key: "email", Value: email},
-		{Key: "mode", Value: mode},
-	}
-	result, err := mg.Db.Collection("emailAuthTokens").DeleteMany(context.Background(), &query)
-
+	deletedCount, err := s.emailAuthTokens.DeleteEmailAuthTokensByMode(context.Background(), email, mode)
 	if err != nil {
 		return errors.New(err.Error())
 	}
 
-	if result.DeletedCount < 1 {
+	if deletedCount < 1 {
 		return errors.New("No email auth tokens found")
 	}
 
@@ -739,26 +775,14 @@ func deleteEmailAuthTokensBasedOnMode(code string, email string, mode string) er
 
 }
 
-func verifyUserAccount(email string) error {
+func (s *Server) verifyUserAccount(email string) error {
 
 	// we assume the email is valid at this point to save on database operations
-	upsert := true
-	opts := options.FindOneAndUpdateOptions{
-		Upsert: &upsert,
-	}
-
-	filter := bson.D{{Key: "email", Value: email}}
-	query := bson.D{
-		{Key: "$set",
-			Value: bson.D{
-				{Key: "verified", Value: true},
-			},
-		},
-	}
-
-	err := mg.Db.Collection("users").FindOneAndUpdate(context.Background(), &filter, &query, &opts).Err()
+	_, err := s.users.UpdateUserByEmail(context.Background(), email, bson.D{
+		{Key: "verified", Value: true},
+	})
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == errNotFound {
 			return errors.New("No account found")
 		}
 		return errors.New(err.Error())
@@ -768,33 +792,32 @@ func verifyUserAccount(email string) error {
 	return nil
 }
 
-func changeUserPassword(email string, hashedPassword string) error {
+// changeUserPassword sets the new password for this user and signs out all their sessions,
+// except the session with keepSessionID which can be empty to sign out every session
+func (s *Server) changeUserPassword(email string, hashedPassword string, keepSessionID string) error {
 
 	// we assume the email is valid at this point to save on database operations
-
-	upsert := true
-	opts := options.FindOneAndUpdateOptions{
-		Upsert: &upsert,
-	}
-
-	filter := bson.D{{Key: "email", Value: email}}
-	query := bson.D{
-		{Key: "$set",
-			Value: bson.D{
-				{Key: "hashedPassword", Value: hashedPassword},
-			},
-		},
-	}
-
-	err := mg.Db.Collection("users").FindOneAndUpdate(context.Background(), &filter, &query, &opts).Err()
+	// a new password also lifts a lockout from failed sign ins
+	user, err := s.users.UpdateUserByEmail(context.Background(), email, bson.D{
+		{Key: "hashedPassword", Value: hashedPassword},
+		{Key: "lockedUntil", Value: time.Time{}},
+	})
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == errNotFound {
 			return errors.New("No account found")
 		}
 		return errors.New(err.Error())
 	}
 
 	fmt.Println("The accounts password should be changed now")
+
+	// anyone holding an old session should have to sign in with the new password
+	count, err := s.deleteAllUserSessions(context.Background(), user.ID.Hex(), keepSessionID)
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	fmt.Printf("%d sessions were signed out after the password change\n", count)
+
 	return nil
 }
 
@@ -827,22 +850,88 @@ func generateRandomAuthString() (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
-func getUserRole(c echo.Context) string {
+// startUserSession signs the user in with the session, saves it and adds it to the sessions of the user
+func (s *Server) startUserSession(c echo.Context, session *sessions.Session, databaseUser *DatabaseUser) (err error) {
+	ctx := c.Request().Context()
+	userID := databaseUser.ID.Hex()
 
-	store := redisSessionInstance.Store
+	// the session lives until the idle timeout or the lifetime of the role is over
+	_, lifetime := s.sessionTimeouts(databaseUser.Role)
+	maxAge := int(lifetime.Seconds())
 
-	session, err := store.Get(c.Request(), "session_")
+	// the session gets a new id so an id that was known before the sign in is of no use after it
+	sessionID, err := generateSessionID()
 	if err != nil {
-		return "anonymous"
+		return err
+	}
+
+	// make room for this session or refuse it based on the max sessions policy,
+	// the current session is kept when it is refused
+	err = s.reserveUserSession(ctx, userID, sessionID, session.ID, maxAge)
+	if err != nil {
+		return err
 	}
 
-	if session.Values["userID"] == nil || session.Values["userID"] == "" {
+	// a session that could not be started gives its room back
+	defer func() {
+		if err != nil {
+			if deleteErr := s.deleteUserSession(ctx, userID, sessionID); deleteErr != nil {
+				fmt.Println("failed deleting the session that was not started: ", deleteErr)
+			}
+		}
+	}()
+
+	// whoever was signed in with the old id is signed out
+	err = s.resetSession(ctx, session)
+	if err != nil {
+		return err
+	}
+	session.ID = sessionID
+
+	// the role is only a snapshot, the middlewares read the current role from the database
+	session.Values["role"] = databaseUser.Role
+	session.Values["userID"] = userID
+
+	// a signed in session never uses the csrf token it had before
+	if _, err = setCSRFToken(c, session); err != nil {
+		return err
+	}
+
+	startSessionTimeouts(session, time.Now())
+	setSessionExpiry(session, s.sessionExpiresAt(session, databaseUser.Role))
+
+	session.IsNew = false
+	// Save session
+	if err = session.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+
+	if infoErr := s.setSessionInfo(ctx, session.ID, c.RealIP(), c.Request().UserAgent(), maxAge); infoErr != nil {
+		fmt.Println("failed saving session info: ", infoErr)
+	}
+	return nil
+}
+
+// signInFailed answers with 429 when the sign in was refused and 500 when the failures could not be counted
+func (s *Server) signInFailed(c echo.Context, err error) error {
+	if refused, ok := err.(*signInRefused); ok {
+		log.Printf("Sign in refused from %s: %v", c.RealIP(), refused)
+		return tooManyRequests(c, refused.retryAfter, refused.Error())
+	}
+
+	fmt.Println("failed counting the sign in failures: ", err)
+	return c.String(http.StatusInternalServerError, "failed checking the sign in")
+}
+
+func (s *Server) getUserRole(c echo.Context) string {
+
+	// deleted and suspended users have no more rights than someone who is not signed in
+	_, acc, err := s.sessionAccount(c)
+	if err != nil || !acc.active() {
 		return "anonymous"
 	}
 
-	// pass in min role to use this route here.
-	userRole := session.Values["role"].(string)
-	return userRole
+	return acc.Role
 
 }
 
@@ -871,9 +960,4 @@ func hashAndSalt(pass []byte) string {
 // func deleteAllEmailAuthTokensForEmail(email string) error
 // func deleteAllEmailAuthTokensForEmailAndTemplate(email string, template string) error
 
-// This route will update a users email, but they must be logged in first and confirm new email link before it takes affect
-func changeEmail(c echo.Context) error {
-	return c.String(http.StatusNotAcceptable, "This route is not configured yet!")
-}
-
 // END ROUTES TO BE IMPLEMENTED ------------------------------------------------------------------------
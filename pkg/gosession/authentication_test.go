@@ -0,0 +1,433 @@
+package gosession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// registerAndConfirm registers a new account and confirms it with the code from the confirmation email
+func registerAndConfirm(t *testing.T, email string, password string) {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/register", body: NewUser{
+		Email:     email,
+		FirstName: "Test",
+		LastName:  "User",
+		Password:  password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	confirmation := emailService.lastEmailTo(t, email)
+	if confirmation.Template != "CONFIRM_ACCOUNT" || confirmation.Code == "" {
+		t.Fatalf("expected a confirm account email with a code but got %+v", confirmation)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/confirm-account/" + email + "/" + confirmation.Code}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+// getUserViaSessionCookie returns the status and user of the get user via session route
+func getUserViaSessionCookie(t *testing.T, cookie *http.Cookie) (int, ExistingUser) {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodGet, path: "/auth/get-user-via-session", cookies: []*http.Cookie{cookie}}.do(t)
+
+	var user ExistingUser
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, user
+}
+
+func TestRegisterConfirmSignInAndSignOut(t *testing.T) {
+	email := uniqueEmail("flow")
+	password := "password1234"
+
+	registerAndConfirm(t, email, password)
+
+	user, err := testServer.users.FindUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Verified {
+		t.Fatal("expected the account to be verified")
+	}
+	if user.HashedPassword == password {
+		t.Fatal("expected the password to be hashed")
+	}
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{
+		Email:    email,
+		Password: "wrongpassword",
+	}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	cookie := signInAs(t, email, password)
+
+	status, sessionUser := getUserViaSessionCookie(t, cookie)
+	if status != http.StatusOK {
+		t.Fatalf("expected the session to be valid but got %d", status)
+	}
+	if sessionUser.Email != email || sessionUser.Role != "user" {
+		t.Fatalf("expected the signed in user but got %+v", sessionUser)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-out", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	status, _ = getUserViaSessionCookie(t, cookie)
+	if status == http.StatusOK {
+		t.Fatal("expected the session to be signed out")
+	}
+}
+
+func TestConfirmAccountWithInvalidCode(t *testing.T) {
+	email := uniqueEmail("invalid-code")
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/register", body: NewUser{
+		Email:     email,
+		FirstName: "Test",
+		Password:  "password1234",
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/confirm-account/" + email + "/not-a-code"}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	user, err := testServer.users.FindUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Verified {
+		t.Fatal("expected the account to not be verified")
+	}
+}
+
+func TestResetPasswordSignsOutEverySession(t *testing.T) {
+	email := uniqueEmail("reset")
+	oldPassword := "password1234"
+	newPassword := "newpassword1234"
+
+	registerAndConfirm(t, email, oldPassword)
+	cookie := signInAs(t, email, oldPassword)
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/reset-password/" + email}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	reset := emailService.lastEmailTo(t, email)
+	if reset.Template != "RESET_PASSWORD" || reset.Code == "" {
+		t.Fatalf("expected a reset password email with a code but got %+v", reset)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/change-password/" + email + "/" + reset.Code, body: NewPassword{
+		Password: newPassword,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	status, _ := getUserViaSessionCookie(t, cookie)
+	if status == http.StatusOK {
+		t.Fatal("expected the old session to be signed out after the password reset")
+	}
+
+	// the code can only be used once
+	rec = testRequest{method: http.MethodPost, path: "/auth/change-password/" + email + "/" + reset.Code, body: NewPassword{
+		Password: "anotherpassword1234",
+	}}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{
+		Email:    email,
+		Password: oldPassword,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	signInAs(t, email, newPassword)
+}
+
+func TestResetCodeChangesThePasswordOnce(t *testing.T) {
+	email := uniqueEmail("reset-race")
+	registerAndConfirm(t, email, "password1234")
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/reset-password/" + email}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	code := emailService.lastEmailTo(t, email).Code
+
+	// every request found the code before any of them changed the password
+	statuses := make([]int, 4)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = testRequest{method: http.MethodPost, path: "/auth/change-password/" + email + "/" + code, body: NewPassword{
+				Password: fmt.Sprintf("newpassword%d", i),
+			}}.do(t).Code
+		}(i)
+	}
+	wg.Wait()
+
+	// only the request that was told the password changed may have changed it
+	changed := -1
+	for i, status := range statuses {
+		if status == http.StatusOK {
+			if changed >= 0 {
+				t.Fatalf("expected the code to change the password once but got %v", statuses)
+			}
+			changed = i
+		}
+	}
+	if changed < 0 {
+		t.Fatalf("expected the code to change the password once but got %v", statuses)
+	}
+	signInAs(t, email, fmt.Sprintf("newpassword%d", changed))
+}
+
+// registerWithoutConfirming registers an account and returns the code of its confirmation email
+func registerWithoutConfirming(t *testing.T, email string, password string) string {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/register", body: NewUser{
+		Email:     email,
+		FirstName: "Test",
+		Password:  password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	return emailService.lastEmailTo(t, email).Code
+}
+
+func TestChangePasswordOnlyTakesAResetCodeForTheEmail(t *testing.T) {
+	email := uniqueEmail("reset-victim")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	// a confirmation code of another account and a reset code of another account are refused
+	otherEmail := uniqueEmail("reset-other")
+	confirmCode := registerWithoutConfirming(t, otherEmail, password)
+	rec := testRequest{method: http.MethodPost, path: "/auth/reset-password/" + otherEmail}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	resetCode := emailService.lastEmailTo(t, otherEmail).Code
+
+	for _, code := range []string{confirmCode, resetCode} {
+		rec = testRequest{method: http.MethodPost, path: "/auth/change-password/" + email + "/" + code, body: NewPassword{
+			Password: "takenover1234",
+		}}.do(t)
+		expectStatus(t, rec, http.StatusNotFound)
+	}
+
+	// a code of another mode sent to the same email is refused as well
+	unconfirmedEmail := uniqueEmail("reset-unconfirmed")
+	confirmCode = registerWithoutConfirming(t, unconfirmedEmail, password)
+	rec = testRequest{method: http.MethodPost, path: "/auth/change-password/" + unconfirmedEmail + "/" + confirmCode, body: NewPassword{
+		Password: "takenover1234",
+	}}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	// the passwords did not change
+	signInAs(t, email, password)
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: "takenover1234"}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+	user, err := testServer.users.FindUserByEmail(context.Background(), unconfirmedEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte(password)) != nil {
+		t.Fatal("expected the password of the unconfirmed account to not change")
+	}
+}
+
+func TestConfirmAccountOnlyTakesAConfirmationCodeForTheEmail(t *testing.T) {
+	email := uniqueEmail("confirm-victim")
+	password := "password1234"
+	registerWithoutConfirming(t, email, password)
+
+	// the confirmation code of another account is refused
+	otherCode := registerWithoutConfirming(t, uniqueEmail("confirm-other"), password)
+	rec := testRequest{method: http.MethodPost, path: "/auth/confirm-account/" + email + "/" + otherCode}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	// a reset code sent to the same email is refused
+	rec = testRequest{method: http.MethodPost, path: "/auth/reset-password/" + email}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	resetCode := emailService.lastEmailTo(t, email).Code
+	rec = testRequest{method: http.MethodPost, path: "/auth/confirm-account/" + email + "/" + resetCode}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	user, err := testServer.users.FindUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Verified {
+		t.Fatal("expected the account to not be verified")
+	}
+}
+
+func TestSignInEvictsTheOldestSession(t *testing.T) {
+	email := uniqueEmail("max-sessions")
+	password := "password1234"
+
+	registerAndConfirm(t, email, password)
+
+	var cookies []*http.Cookie
+	for i := 0; i <= testServer.config.MaxSessionsPerUser; i++ {
+		cookies = append(cookies, signInAs(t, email, password))
+	}
+
+	status, _ := getUserViaSessionCookie(t, cookies[0])
+	if status == http.StatusOK {
+		t.Fatal("expected the oldest session to be evicted")
+	}
+	for _, cookie := range cookies[1:] {
+		if status, _ := getUserViaSessionCookie(t, cookie); status != http.StatusOK {
+			t.Fatalf("expected the newer sessions to be valid but got %d", status)
+		}
+	}
+}
+
+func TestSignInIsRejectedWhenTheSessionsAreUsedUp(t *testing.T) {
+	server := newTestServer(t, func(config *ConfigApplication) {
+		config.MaxSessionsPerUser = 2
+		config.MaxSessionsPolicy = MaxSessionsPolicyReject
+	})
+
+	email := uniqueEmail("reject-sessions")
+	password := "password1234"
+	insertUser(t, server, email, password, "user")
+
+	first := signInOn(t, server, email, password)
+	second := signInOn(t, server, email, password)
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", server: server, body: SignInUser{Email: email, Password: password}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	// the sessions that were there are kept, signing one out makes room again
+	for _, cookie := range []*http.Cookie{first, second} {
+		if status := getSessionsOn(t, server, cookie); status != http.StatusOK {
+			t.Fatalf("expected the existing sessions to be kept but got %d", status)
+		}
+	}
+
+	// a refused sign in leaves the browser signed in to the account it was signed in to
+	otherEmail := uniqueEmail("reject-other")
+	insertUser(t, server, otherEmail, password, "user")
+	other := signInOn(t, server, otherEmail, password)
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", server: server, cookies: []*http.Cookie{other}, body: SignInUser{Email: email, Password: password}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+	if status := getSessionsOn(t, server, other); status != http.StatusOK {
+		t.Fatalf("expected the session of the browser to be kept but got %d", status)
+	}
+
+	// signing in again from a browser that is signed in replaces its session
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", server: server, cookies: []*http.Cookie{second}, body: SignInUser{Email: email, Password: password}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-out", server: server, cookies: []*http.Cookie{first}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	signInOn(t, server, email, password)
+}
+
+func TestConcurrentSignInsStayWithinTheMaxSessions(t *testing.T) {
+	for _, policy := range []string{MaxSessionsPolicyReject, MaxSessionsPolicyEvictOldest} {
+		server := newTestServer(t, func(config *ConfigApplication) {
+			config.MaxSessionsPerUser = 2
+			config.MaxSessionsPolicy = policy
+		})
+
+		email := uniqueEmail("concurrent-sessions")
+		password := "password1234"
+		userID := insertUser(t, server, email, password, "user")
+
+		statuses := make(chan int, 8)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(statuses); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				statuses <- testRequest{method: http.MethodPost, path: "/auth/sign-in", server: server, body: SignInUser{Email: email, Password: password}}.do(t).Code
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		signedIn := 0
+		for status := range statuses {
+			if status == http.StatusOK {
+				signedIn++
+			}
+		}
+		if policy == MaxSessionsPolicyReject && signedIn != 2 {
+			t.Fatalf("expected 2 sign ins to be let in but %d were", signedIn)
+		}
+
+		ids, err := server.getUserSessionIDs(context.Background(), userID.Hex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 2 {
+			t.Fatalf("expected the %s policy to keep 2 sessions but there are %d", policy, len(ids))
+		}
+	}
+}
+
+func TestSignInGivesTheSessionANewID(t *testing.T) {
+	email := uniqueEmail("fixation")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	// an id the browser had before the sign in, which someone else could have planted
+	_, before := beginPasskeySignInWith(t, "")
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", cookies: []*http.Cookie{before}, body: SignInUser{
+		Email:    email,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	after := sessionCookie(t, rec)
+
+	if after.Value == before.Value {
+		t.Fatal("expected the session to get a new id")
+	}
+	if status, _ := getUserViaSessionCookie(t, before); status == http.StatusOK {
+		t.Fatal("expected the old session id to stay signed out")
+	}
+	if status, _ := getUserViaSessionCookie(t, after); status != http.StatusOK {
+		t.Fatalf("expected the new session id to be signed in but got %d", status)
+	}
+}
+
+func TestSignInReplacesTheSessionOfAnotherUser(t *testing.T) {
+	password := "password1234"
+	firstEmail := uniqueEmail("first")
+	secondEmail := uniqueEmail("second")
+	registerAndConfirm(t, firstEmail, password)
+	registerAndConfirm(t, secondEmail, password)
+
+	firstCookie := signInAs(t, firstEmail, password)
+	_, first := getUserViaSessionCookie(t, firstCookie)
+
+	// the second user signs in on the browser the first user is signed in on
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", cookies: []*http.Cookie{firstCookie}, body: SignInUser{
+		Email:    secondEmail,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	status, user := getUserViaSessionCookie(t, sessionCookie(t, rec))
+	if status != http.StatusOK || user.Email != secondEmail {
+		t.Fatalf("expected to be signed in as the second user but got %d %s", status, user.Email)
+	}
+	if status, _ := getUserViaSessionCookie(t, firstCookie); status == http.StatusOK {
+		t.Fatal("expected the session of the first user to be signed out")
+	}
+
+	ids, err := testServer.getUserSessionIDs(context.Background(), first.ID.Hex())
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("expected the first user to have no sessions left but got %v %v", ids, err)
+	}
+}
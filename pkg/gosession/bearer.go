@@ -0,0 +1,86 @@
+package gosession
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+	BEARER SESSION SYSTEM
+
+	Clients that can not keep the session cookie, like the mobile apps and the cli, can use the same
+	sessions with a token instead. A request with the X-Session-Mode: token header is answered with
+	the session id in the X-Session-Token header in place of the cookie, so signing in this way returns
+	the token. The client then sends it in the Authorization: Bearer header of every request.
+
+	The token is the id of the session in the session store, so a token session is counted by the
+	max sessions policy, listed with the other devices, has the same timeouts and is signed out the
+	same way as a cookie session. Whenever the session gets a new id, at a sign in or a change of role,
+	the new token is sent back in the X-Session-Token header and the old one stops working.
+
+	The X-Session-Mode: jwt header works the same way until the sign in is done, then the client
+	gets access and refresh tokens instead of the session, see tokens.go.
+
+*/
+
+const (
+	// sessionModeHeader is the header a client sends to get the session as a token
+	sessionModeHeader = "X-Session-Mode"
+	// sessionModeToken is the value of the session mode header for token clients
+	sessionModeToken = "token"
+	// sessionModeJWT is the value of the session mode header for a sign in with access tokens, see tokens.go
+	sessionModeJWT = "jwt"
+	// sessionTokenHeader is the header the token is sent back in
+	sessionTokenHeader = "X-Session-Token"
+)
+
+// BearerSessionMiddleware lets the bearer token stand in for the session cookie and sends the
+// session back as a token instead of a cookie, it has to run before the router
+func (s *Server) BearerSessionMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			token := bearerToken(c)
+			mode := sessionMode(c)
+			if mode == sessionModeJWT && s.config.AccessTokenIssuer == "" {
+				return c.String(http.StatusBadRequest, "The jwt sign in is turned off")
+			}
+			if token == "" && mode != sessionModeToken && mode != sessionModeJWT {
+				return next(c)
+			}
+
+			// only the token is used, a cookie sent along with it is ignored
+			req := c.Request()
+			req.Header.Del(echo.HeaderCookie)
+			if token != "" {
+				req.AddCookie(&http.Cookie{Name: sessionName, Value: token})
+			}
+
+			c.Response().Before(func() {
+				header := c.Response().Header()
+				response := http.Response{Header: header}
+				cookies := response.Cookies()
+				header.Del(echo.HeaderSetCookie)
+
+				// the session can be saved more than once, the last cookie is the one a browser would keep
+				newToken := ""
+				for _, cookie := range cookies {
+					if cookie.Name == sessionName {
+						newToken = cookie.Value
+					}
+				}
+				if newToken != "" && newToken != token {
+					header.Set(sessionTokenHeader, newToken)
+				}
+			})
+
+			return next(c)
+		}
+	}
+}
+
+// sessionMode returns the session mode the client asked for, it is empty for cookie clients
+func sessionMode(c echo.Context) string {
+	return strings.ToLower(strings.TrimSpace(c.Request().Header.Get(sessionModeHeader)))
+}
@@ -0,0 +1,87 @@
+package gosession
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// signInForToken signs in as a token client and returns the session token
+func signInForToken(t *testing.T, email string, password string) string {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", headers: map[string]string{sessionModeHeader: sessionModeToken}, body: SignInUser{
+		Email:    email,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("expected no cookie for a token client but got %v", cookies)
+	}
+	token := rec.Header().Get(sessionTokenHeader)
+	if token == "" {
+		t.Fatal("expected the session token in the response")
+	}
+	return token
+}
+
+// withBearer sends the request with the token in the Authorization header
+func withBearer(method string, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSignInForABearerToken(t *testing.T) {
+	email := uniqueEmail("bearer")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	token := signInForToken(t, email, password)
+
+	rec := withBearer(http.MethodGet, "/auth/get-user-via-session", token)
+	expectStatus(t, rec, http.StatusOK)
+	var user ExistingUser
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != email {
+		t.Fatalf("expected to be signed in as %s but got %s", email, user.Email)
+	}
+
+	// the token is listed with the cookie sessions of the user
+	cookie := signInAs(t, email, password)
+	rec = testRequest{method: http.MethodGet, path: "/auth/sessions", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var infos []SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected the token and the cookie session but got %+v", infos)
+	}
+
+	expectStatus(t, withBearer(http.MethodGet, "/auth/sessions", "not a token"), http.StatusUnauthorized)
+
+	// signing out the other devices signs out the token
+	rec = testRequest{method: http.MethodDelete, path: "/auth/sessions", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	expectStatus(t, withBearer(http.MethodGet, "/auth/sessions", token), http.StatusUnauthorized)
+}
+
+func TestBearerTokenSignOut(t *testing.T) {
+	email := uniqueEmail("bearer-sign-out")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	token := signInForToken(t, email, password)
+	expectStatus(t, withBearer(http.MethodPost, "/auth/sign-out", token), http.StatusOK)
+	expectStatus(t, withBearer(http.MethodGet, "/auth/sessions", token), http.StatusUnauthorized)
+}
@@ -0,0 +1,182 @@
+package gosession
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+/*
+	CBOR DECODER
+
+	The attestation object and the public keys of the passkeys are encoded in CBOR (RFC 8949).
+	Only the subset WebAuthn authenticators use is decoded: integers, byte and text strings,
+	arrays, maps and the simple values. Indefinite lengths and tags are refused as CTAP2
+	authenticators have to use the canonical encoding.
+
+	Integers are returned as int64, byte strings as []byte, text strings as string, arrays as
+	[]interface{} and maps as map[interface{}]interface{} keyed by int64 or string.
+
+*/
+
+const (
+	// cborMaxDepth stops deeply nested input from using up the stack
+	cborMaxDepth = 16
+	// cborMaxItems stops a short input from claiming a huge array or map
+	cborMaxItems = 1024
+)
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+var errCBORUnsupported = errors.New("cbor: unsupported item")
+
+// decodeCBOR decodes the first item of data and returns it with the bytes after it
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	// the simple values and floats carry their value in the additional info
+	if major == 7 {
+		return decodeCBORSimple(data, info)
+	}
+
+	length, rest, err := decodeCBORLength(data[1:], info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if length > math.MaxInt64 {
+			return nil, nil, errCBORUnsupported
+		}
+		return int64(length), rest, nil
+
+	case 1:
+		if length > math.MaxInt64 {
+			return nil, nil, errCBORUnsupported
+		}
+		return -1 - int64(length), rest, nil
+
+	case 2, 3:
+		if uint64(len(rest)) < length {
+			return nil, nil, errCBORTruncated
+		}
+		value := make([]byte, length)
+		copy(value, rest[:length])
+		if major == 3 {
+			return string(value), rest[length:], nil
+		}
+		return value, rest[length:], nil
+
+	case 4:
+		if length > cborMaxItems {
+			return nil, nil, errCBORUnsupported
+		}
+		items := make([]interface{}, 0, length)
+		for i := uint64(0); i < length; i++ {
+			var item interface{}
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+
+	case 5:
+		if length > cborMaxItems {
+			return nil, nil, errCBORUnsupported
+		}
+		items := make(map[interface{}]interface{}, length)
+		for i := uint64(0); i < length; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: map keys must be integers or text")
+			}
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, errors.New("cbor: duplicate map key")
+			}
+			items[key] = value
+		}
+		return items, rest, nil
+	}
+
+	// major type 6 are the tags
+	return nil, nil, errCBORUnsupported
+}
+
+// decodeCBORLength reads the argument of the item from its additional info
+func decodeCBORLength(data []byte, info byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, nil, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+
+	// 31 is an indefinite length and 28 to 30 are reserved
+	return 0, nil, errCBORUnsupported
+}
+
+func decodeCBORSimple(data []byte, info byte) (interface{}, []byte, error) {
+	rest := data[1:]
+	switch info {
+	case 20:
+		return false, rest, nil
+	case 21:
+		return true, rest, nil
+	case 22, 23:
+		// null and undefined
+		return nil, rest, nil
+	case 26:
+		if len(rest) < 4 {
+			return nil, nil, errCBORTruncated
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(rest))), rest[4:], nil
+	case 27:
+		if len(rest) < 8 {
+			return nil, nil, errCBORTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(rest)), rest[8:], nil
+	}
+	return nil, nil, errCBORUnsupported
+}
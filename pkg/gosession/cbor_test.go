@@ -0,0 +1,67 @@
+package gosession
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// examples from RFC 8949 appendix A
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"3903e7", int64(-1000)},
+		{"20", int64(-1)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"6449455446", "IETF"},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.hex)
+		got, rest, err := decodeCBOR(data)
+		if err != nil || len(rest) != 0 || got != test.want {
+			t.Fatalf("expected %s to decode to %v but got %v, %v", test.hex, test.want, got, err)
+		}
+	}
+
+	// {"a": 1, "b": [2, 3]} followed by a byte that is not part of it
+	data, _ := hex.DecodeString("a26161016162820203ff")
+	got, rest, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := got.(map[interface{}]interface{})
+	if m["a"] != int64(1) || len(m["b"].([]interface{})) != 2 || !bytes.Equal(rest, []byte{0xff}) {
+		t.Fatalf("unexpected map %v with the rest %x", m, rest)
+	}
+
+	bytesData, _ := hex.DecodeString("4401020304")
+	got, _, err = decodeCBOR(bytesData)
+	if err != nil || !bytes.Equal(got.([]byte), []byte{1, 2, 3, 4}) {
+		t.Fatalf("expected the byte string but got %v, %v", got, err)
+	}
+}
+
+func TestDecodeCBORRefusesInvalidInput(t *testing.T) {
+	for _, invalid := range []string{
+		"",
+		"19",                 // the length is cut off
+		"450102",             // the byte string is shorter than its length
+		"5f42010243",         // indefinite length
+		"c11a514b67b0",       // tags
+		"a2616101616102",     // duplicate map key
+		"9bffffffffffffffff", // too many items
+	} {
+		data, _ := hex.DecodeString(invalid)
+		if _, _, err := decodeCBOR(data); err == nil {
+			t.Fatalf("expected %q to be refused", invalid)
+		}
+	}
+}
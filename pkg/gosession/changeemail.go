@@ -0,0 +1,320 @@
+package gosession
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+	CHANGE EMAIL SYSTEM
+
+	A signed in user can change their email by supplying their current password and the new email.
+	The email of the account is only changed once the link sent to the new email is clicked,
+	this makes sure the user owns the new email before it can be used to sign in or reset the password.
+
+	The old email is sent a notice with an undo link at the same time. Clicking it before the change
+	was confirmed cancels the change, clicking it after puts the old email back and signs out every
+	session of the user in case the account was taken over.
+
+*/
+
+const (
+	// emailAuthTokenModeChangeEmail is the mode of the token sent to the new email
+	emailAuthTokenModeChangeEmail = "CHANGE_EMAIL"
+	// emailAuthTokenModeUndoChangeEmail is the mode of the token sent to the old email
+	emailAuthTokenModeUndoChangeEmail = "UNDO_CHANGE_EMAIL"
+)
+
+// ChangeEmail is used when a signed in user changes their email
+type ChangeEmail struct {
+	CurrentPassword string `json:"currentPassword" bson:"currentPassword" validate:"required,min=10,max=128"`
+	NewEmail        string `json:"newEmail" bson:"newEmail" validate:"required,email,min=3"`
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureChangeEmailRoutes - Configure all the routes for changing the email here
+func (s *Server) configureChangeEmailRoutes() {
+
+	// sends a confirmation to the new email and a notice with an undo link to the old email
+	s.echo.POST("/users/:id/change-email", s.changeEmail, s.SessionMiddleware("user"), middleware.BodyLimit("1K"))
+
+	// confirms the new email, the email of the account is changed here
+	s.echo.POST("/auth/confirm-email-change/:email/:code", s.confirmEmailChange)
+
+	// cancels the change or puts the old email back if it was already confirmed
+	s.echo.POST("/auth/undo-email-change/:email/:code", s.undoEmailChange)
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// This route will start changing the email of the signed in user, the email is not changed
+// until the new email is confirmed
+func (s *Server) changeEmail(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	// the current password is needed so not even an admin can change the email of another user
+	sessionUserID, _ := session.Values["userID"].(string)
+	if sessionUserID != c.Param("id") {
+		return c.JSON(http.StatusForbidden, "access denied")
+	}
+
+	var changeEmail ChangeEmail
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&changeEmail); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(changeEmail); err != nil {
+		log.Printf("Unable to validate the changeEmail %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	err = isEmailValid(changeEmail.NewEmail)
+	if err != nil {
+		message := fmt.Sprintf("Your email is not valid: %v", changeEmail.NewEmail)
+		return c.String(http.StatusNotAcceptable, message)
+	}
+
+	userID, err := primitive.ObjectIDFromHex(sessionUserID)
+	if err != nil {
+		return c.String(http.StatusNotFound, "This user id is invalid")
+	}
+
+	databaseUser, err := s.users.FindUserByID(ctx, userID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "This user account does not exist")
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(databaseUser.HashedPassword), []byte(changeEmail.CurrentPassword))
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "Incorrect password")
+	}
+
+	if changeEmail.NewEmail == databaseUser.Email {
+		return c.String(http.StatusNotAcceptable, "This is already the email of the account")
+	}
+
+	err = s.doesAccountExistViaEmailString(changeEmail.NewEmail)
+	if err == nil {
+		return c.String(http.StatusConflict, "This email is already in use")
+	}
+
+	// only the latest change can be confirmed
+	_, err = s.emailAuthTokens.DeleteEmailAuthTokensByUser(ctx, sessionUserID, emailAuthTokenModeChangeEmail)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	// the new email has 1 day to confirm the change
+	confirmToken, err := generateEmailAuthToken(changeEmail.NewEmail, 0, 0, 1, true, emailAuthTokenModeChangeEmail)
+	if err != nil {
+		fmt.Println(err)
+		return c.JSON(http.StatusPartialContent, "To change your email please contact support")
+	}
+	confirmToken.UserID = sessionUserID
+	confirmToken.NewEmail = changeEmail.NewEmail
+
+	// the old email can undo the change for 7 days, even after it was confirmed
+	undoToken, err := generateEmailAuthToken(databaseUser.Email, 0, 0, 7, true, emailAuthTokenModeUndoChangeEmail)
+	if err != nil {
+		fmt.Println(err)
+		return c.JSON(http.StatusPartialContent, "To change your email please contact support")
+	}
+	undoToken.UserID = sessionUserID
+	undoToken.NewEmail = changeEmail.NewEmail
+
+	err = s.addEmailAuthTokenToDatabase(confirmToken)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	err = s.addEmailAuthTokenToDatabase(undoToken)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	err = s.sendEmail(SendEmail{
+		RecipientEmail:   changeEmail.NewEmail,
+		RecipientName:    databaseUser.FirstName,
+		SenderEmail:      "contact@domain.com",
+		SenderName:       "Domain",
+		Subject:          "Confirm Email Change",
+		PlainTextContent: "Click this link to make this the email of your account, if you did not request this email then please ignore. ",
+		HTMLContent:      "",
+		Template:         emailAuthTokenModeChangeEmail,
+		Code:             confirmToken.Code,
+	})
+	if err != nil {
+		fmt.Println("error at send change email")
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	err = s.sendEmail(SendEmail{
+		RecipientEmail:   databaseUser.Email,
+		RecipientName:    databaseUser.FirstName,
+		SenderEmail:      "contact@domain.com",
+		SenderName:       "Domain",
+		Subject:          "Your Email Is Being Changed",
+		PlainTextContent: "The email of your account is being changed to " + changeEmail.NewEmail + ", if this was not you click this link to undo it. ",
+		HTMLContent:      "",
+		Template:         emailAuthTokenModeUndoChangeEmail,
+		Code:             undoToken.Code,
+	})
+	if err != nil {
+		fmt.Println("error at send undo change email")
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, "A confirmation email has been sent to the new email")
+}
+
+// This route will change the email of the account once the new email confirms it
+func (s *Server) confirmEmailChange(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	email := c.Param("email")
+	code := c.Param("code")
+
+	token, err := s.findEmailAuthTokenForMode(ctx, code, email, emailAuthTokenModeChangeEmail)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	userID, err := primitive.ObjectIDFromHex(token.UserID)
+	if err != nil {
+		return c.String(http.StatusNotFound, "This user id is invalid")
+	}
+
+	databaseUser, err := s.users.FindUserByID(ctx, userID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "This user account does not exist")
+	}
+
+	// someone could have registered the new email since the change was requested
+	existingUser, err := s.users.FindUserByEmail(ctx, token.NewEmail)
+	if err == nil && existingUser.ID != userID {
+		return c.String(http.StatusConflict, "This email is already in use")
+	}
+
+	err = s.users.UpdateUser(ctx, userID, bson.D{
+		{Key: "email", Value: token.NewEmail},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err == errDuplicate {
+		return c.String(http.StatusConflict, "This email is already in use")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The email could not be changed")
+	}
+
+	_, err = s.emailAuthTokens.DeleteEmailAuthTokensByUser(ctx, token.UserID, emailAuthTokenModeChangeEmail)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	// reset password links sent to the old email should not work anymore
+	_, err = s.emailAuthTokens.DeleteEmailAuthTokensByMode(ctx, databaseUser.Email, emailAuthTokenModeResetPassword)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return c.JSON(http.StatusOK, "User email has been changed")
+}
+
+// This route will cancel the email change, or put the old email back and sign out every session
+// if the change was already confirmed
+func (s *Server) undoEmailChange(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	email := c.Param("email")
+	code := c.Param("code")
+
+	token, err := s.findEmailAuthTokenForMode(ctx, code, email, emailAuthTokenModeUndoChangeEmail)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	userID, err := primitive.ObjectIDFromHex(token.UserID)
+	if err != nil {
+		return c.String(http.StatusNotFound, "This user id is invalid")
+	}
+
+	databaseUser, err := s.users.FindUserByID(ctx, userID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "This user account does not exist")
+	}
+
+	var message string
+	switch databaseUser.Email {
+	case token.Email:
+		// the change was not confirmed yet so the pending change is dropped
+		_, err = s.emailAuthTokens.DeleteEmailAuthTokensByUser(ctx, token.UserID, emailAuthTokenModeChangeEmail)
+		if err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		message = "The email change has been cancelled"
+
+	case token.NewEmail:
+		existingUser, err := s.users.FindUserByEmail(ctx, token.Email)
+		if err == nil && existingUser.ID != userID {
+			return c.String(http.StatusConflict, "The old email is already in use")
+		}
+
+		err = s.users.UpdateUser(ctx, userID, bson.D{
+			{Key: "email", Value: token.Email},
+			{Key: "updatedAt", Value: time.Now().UTC()},
+		})
+		if err == errDuplicate {
+			return c.String(http.StatusConflict, "The old email is already in use")
+		}
+		if err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusNotFound, "The email could not be changed back")
+		}
+
+		// whoever changed the email may still be signed in
+		count, err := s.deleteAllUserSessions(ctx, token.UserID, "")
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Printf("%d sessions were signed out after the email change was undone\n", count)
+		message = "The email change has been undone"
+
+	default:
+		return c.String(http.StatusConflict, "This email change can no longer be undone")
+	}
+
+	err = s.emailAuthTokens.DeleteEmailAuthToken(ctx, token.Email, code)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return c.JSON(http.StatusOK, message)
+}
+
+// END ROUTE FUNCTIONS --------------------------------------------------------------------------
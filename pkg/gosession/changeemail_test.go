@@ -0,0 +1,141 @@
+package gosession
+
+import (
+	"net/http"
+	"testing"
+)
+
+// startEmailChange signs in and requests the change, returning the session cookie and the user
+func startEmailChange(t *testing.T, email string, newEmail string, password string) (*http.Cookie, ExistingUser) {
+	t.Helper()
+
+	registerAndConfirm(t, email, password)
+	cookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, cookie)
+
+	rec := testRequest{method: http.MethodPost, path: "/users/" + user.ID.Hex() + "/change-email", cookies: []*http.Cookie{cookie}, body: ChangeEmail{
+		CurrentPassword: password,
+		NewEmail:        newEmail,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	return cookie, user
+}
+
+func TestChangeEmailRequiresTheCurrentPassword(t *testing.T) {
+	email := uniqueEmail("change")
+	password := "password1234"
+
+	registerAndConfirm(t, email, password)
+	cookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, cookie)
+
+	rec := testRequest{method: http.MethodPost, path: "/users/" + user.ID.Hex() + "/change-email", cookies: []*http.Cookie{cookie}, body: ChangeEmail{
+		CurrentPassword: "wrongpassword1234",
+		NewEmail:        uniqueEmail("changed"),
+	}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	// the email of another user can not be changed
+	otherEmail := uniqueEmail("other")
+	registerAndConfirm(t, otherEmail, password)
+	_, other := getUserViaSessionCookie(t, signInAs(t, otherEmail, password))
+
+	rec = testRequest{method: http.MethodPost, path: "/users/" + other.ID.Hex() + "/change-email", cookies: []*http.Cookie{cookie}, body: ChangeEmail{
+		CurrentPassword: password,
+		NewEmail:        uniqueEmail("changed"),
+	}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	// an email that is already used can not be taken
+	rec = testRequest{method: http.MethodPost, path: "/users/" + user.ID.Hex() + "/change-email", cookies: []*http.Cookie{cookie}, body: ChangeEmail{
+		CurrentPassword: password,
+		NewEmail:        otherEmail,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusConflict)
+}
+
+func TestChangeEmailOnlyAfterConfirmation(t *testing.T) {
+	email := uniqueEmail("change")
+	newEmail := uniqueEmail("changed")
+	password := "password1234"
+
+	startEmailChange(t, email, newEmail, password)
+
+	confirmation := emailService.lastEmailTo(t, newEmail)
+	if confirmation.Template != emailAuthTokenModeChangeEmail || confirmation.Code == "" {
+		t.Fatalf("expected a change email confirmation with a code but got %+v", confirmation)
+	}
+	notice := emailService.lastEmailTo(t, email)
+	if notice.Template != emailAuthTokenModeUndoChangeEmail || notice.Code == "" {
+		t.Fatalf("expected an undo notice with a code but got %+v", notice)
+	}
+
+	// nothing changes until the new email is confirmed
+	signInAs(t, email, password)
+
+	// the code only works together with the email it was sent to
+	rec := testRequest{method: http.MethodPost, path: "/auth/confirm-email-change/" + email + "/" + confirmation.Code}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/confirm-email-change/" + newEmail + "/" + confirmation.Code}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	signInAs(t, newEmail, password)
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{
+		Email:    email,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	// the code can only be used once
+	rec = testRequest{method: http.MethodPost, path: "/auth/confirm-email-change/" + newEmail + "/" + confirmation.Code}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestUndoEmailChangeAfterConfirmation(t *testing.T) {
+	email := uniqueEmail("change")
+	newEmail := uniqueEmail("changed")
+	password := "password1234"
+
+	cookie, _ := startEmailChange(t, email, newEmail, password)
+	confirmation := emailService.lastEmailTo(t, newEmail)
+	notice := emailService.lastEmailTo(t, email)
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/confirm-email-change/" + newEmail + "/" + confirmation.Code}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/undo-email-change/" + email + "/" + notice.Code}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	status, _ := getUserViaSessionCookie(t, cookie)
+	if status == http.StatusOK {
+		t.Fatal("expected every session to be signed out after the email change was undone")
+	}
+
+	signInAs(t, email, password)
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{
+		Email:    newEmail,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+}
+
+func TestUndoEmailChangeBeforeConfirmation(t *testing.T) {
+	email := uniqueEmail("change")
+	newEmail := uniqueEmail("changed")
+	password := "password1234"
+
+	startEmailChange(t, email, newEmail, password)
+	confirmation := emailService.lastEmailTo(t, newEmail)
+	notice := emailService.lastEmailTo(t, email)
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/undo-email-change/" + email + "/" + notice.Code}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// the pending change was cancelled
+	rec = testRequest{method: http.MethodPost, path: "/auth/confirm-email-change/" + newEmail + "/" + confirmation.Code}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	signInAs(t, email, password)
+}
@@ -0,0 +1,507 @@
+package gosession
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/ulule/limiter/v3"
+)
+
+// ConfigApplication - Here is where get the ENV values for the application
+type ConfigApplication struct {
+	AppName    string `mapstructure:"APP_NAME"`
+	AppEnv     string `mapstructure:"APP_ENV"`
+	Port       string `mapstructure:"APP_PORT"`
+	LogLevel   string `mapstructure:"APP_LOG_LEVEL"`
+	DBPort     string `mapstructure:"DATABASE_PORT"`
+	DBHost     string `mapstructure:"DATABASE_HOST"`
+	DBLogLevel string `mapstructure:"DATABASE_LOG_LEVEL"`
+	DBUsername string `mapstructure:"DATABASE_USERNAME"`
+	DBPassword string `mapstructure:"DATABASE_PASSWORD"`
+	DBName     string `mapstructure:"DATABASE_NAME"`
+	DBStore    string `mapstructure:"DATABASE_STORE"`
+
+	SessionStore       string `mapstructure:"SESSION_STORE"`
+	LimiterStore       string `mapstructure:"LIMITER_STORE"`
+	MaxSessionsPerUser int    `mapstructure:"MAX_SESSIONS_PER_USER"`
+	MaxSessionsPolicy  string `mapstructure:"MAX_SESSIONS_POLICY"`
+
+	SessionIdleTimeout  int      `mapstructure:"SESSION_IDLE_TIMEOUT"`
+	SessionIdleTimeouts []string `mapstructure:"SESSION_IDLE_TIMEOUTS"`
+	SessionLifetime     int      `mapstructure:"SESSION_LIFETIME"`
+	SessionLifetimes    []string `mapstructure:"SESSION_LIFETIMES"`
+
+	ShutdownTimeout int `mapstructure:"SHUTDOWN_TIMEOUT"`
+
+	RedisLimiterAddress  string `mapstructure:"REDIS_LIMITER_ADDRESS"`
+	RedisLimiterPassword string `mapstructure:"REDIS_LIMITER_PASSWORD"`
+	RedisLimiterDB       int    `mapstructure:"REDIS_LIMITER_DB"`
+	RedisSessionAddress  string `mapstructure:"REDIS_SESSION_ADDRESS"`
+	RedisSessionPassword string `mapstructure:"REDIS_SESSION_PASSWORD"`
+	RedisSessionDB       int    `mapstructure:"REDIS_SESSION_DB"`
+
+	CookieDomain   string `mapstructure:"COOKIE_DOMAIN"`
+	CookiePath     string `mapstructure:"COOKIE_PATH"`
+	CookieMaxAge   int    `mapstructure:"COOKIE_MAX_AGE"`
+	CookieSecure   bool   `mapstructure:"COOKIE_SECURE"`
+	CookieHTTPOnly bool   `mapstructure:"COOKIE_HTTP_ONLY"`
+	CookieSameSite string `mapstructure:"COOKIE_SAME_SITE"`
+
+	CORSAllowOrigins []string `mapstructure:"CORS_ALLOW_ORIGINS"`
+
+	EmailServiceURL string `mapstructure:"EMAIL_SERVICE_URL"`
+	S3ServiceURL    string `mapstructure:"S3_SERVICE_URL"`
+
+	RBACPolicyStore    string `mapstructure:"RBAC_POLICY_STORE"`
+	RBACPolicyFile     string `mapstructure:"RBAC_POLICY_FILE"`
+	RBACReloadInterval int    `mapstructure:"RBAC_RELOAD_INTERVAL"`
+
+	AccountCacheTTL int `mapstructure:"ACCOUNT_CACHE_TTL"`
+
+	SignInMaxFailures   int `mapstructure:"SIGN_IN_MAX_FAILURES"`
+	SignInMaxIPFailures int `mapstructure:"SIGN_IN_MAX_IP_FAILURES"`
+	SignInFailureWindow int `mapstructure:"SIGN_IN_FAILURE_WINDOW"`
+	SignInLockout       int `mapstructure:"SIGN_IN_LOCKOUT"`
+	SignInBackoffBase   int `mapstructure:"SIGN_IN_BACKOFF_BASE"`
+	SignInBackoffMax    int `mapstructure:"SIGN_IN_BACKOFF_MAX"`
+
+	RateLimitDefault string   `mapstructure:"RATE_LIMIT_DEFAULT"`
+	RateLimits       []string `mapstructure:"RATE_LIMITS"`
+
+	TOTPIssuer     string `mapstructure:"TOTP_ISSUER"`
+	TOTPPendingTTL int    `mapstructure:"TOTP_PENDING_TTL"`
+
+	WebAuthnRPID             string   `mapstructure:"WEBAUTHN_RP_ID"`
+	WebAuthnRPName           string   `mapstructure:"WEBAUTHN_RP_NAME"`
+	WebAuthnOrigins          []string `mapstructure:"WEBAUTHN_ORIGINS"`
+	WebAuthnTimeout          int      `mapstructure:"WEBAUTHN_TIMEOUT"`
+	WebAuthnUserVerification bool     `mapstructure:"WEBAUTHN_USER_VERIFICATION"`
+
+	OIDCIssuer        string   `mapstructure:"OIDC_ISSUER"`
+	OIDCClientID      string   `mapstructure:"OIDC_CLIENT_ID"`
+	OIDCClientSecret  string   `mapstructure:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL   string   `mapstructure:"OIDC_REDIRECT_URL"`
+	OIDCScopes        []string `mapstructure:"OIDC_SCOPES"`
+	OIDCPostSignInURL string   `mapstructure:"OIDC_POST_SIGN_IN_URL"`
+
+	OIDCProviderIssuer    string `mapstructure:"OIDC_PROVIDER_ISSUER"`
+	OIDCProviderSignInURL string `mapstructure:"OIDC_PROVIDER_SIGN_IN_URL"`
+	OIDCProviderCodeTTL   int    `mapstructure:"OIDC_PROVIDER_CODE_TTL"`
+	OIDCProviderTokenTTL  int    `mapstructure:"OIDC_PROVIDER_TOKEN_TTL"`
+
+	AccessTokenIssuer   string   `mapstructure:"ACCESS_TOKEN_ISSUER"`
+	AccessTokenAudience []string `mapstructure:"ACCESS_TOKEN_AUDIENCE"`
+	AccessTokenTTL      int      `mapstructure:"ACCESS_TOKEN_TTL"`
+
+	JWTSigningKeyFile string `mapstructure:"JWT_SIGNING_KEY_FILE"`
+}
+
+// ConfigError lists every value of the config that is missing or invalid
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid application config: " + strings.Join(e.Problems, "; ")
+}
+
+// LoadConfig reads the application config from the defaults, the config.env file
+// and the environment, which overrides the file, and then validates it
+func LoadConfig() (ConfigApplication, error) {
+	vp := viper.New()
+
+	// set defaults
+	setApplicationDefaults(vp)
+
+	// define configurations
+	err := defineApplicationConfiguration(vp)
+	if err != nil {
+		return ConfigApplication{}, err
+	}
+
+	// bind struct values
+	config, err := bindApplicationEnvStruct(vp)
+	if err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+// DefaultConfig returns the config made from the defaults only
+func DefaultConfig() ConfigApplication {
+	vp := viper.New()
+	setApplicationDefaults(vp)
+
+	config, _ := bindApplicationEnvStruct(vp)
+	return config
+}
+
+func setApplicationDefaults(vp *viper.Viper) {
+	vp.SetDefault("APP_NAME", "email-service")
+	vp.SetDefault("APP_ENV", "LOCALHOST")
+	vp.SetDefault("APP_PORT", "8081")
+	vp.SetDefault("APP_LOG_LEVEl", "ERROR")
+	vp.SetDefault("DATABASE_PORT", "27017")
+	vp.SetDefault("DATABASE_HOST", "localhost")
+	vp.SetDefault("DATABASE_LOG_LEVEL", "ERROR")
+	vp.SetDefault("DATABASE_USERNAME", "domain")
+	vp.SetDefault("DATABASE_PASSWORD", "password")
+	vp.SetDefault("DATABASE_NAME", "domain")
+	// MONGO or MEMORY, the memory database is only meant for development and tests
+	vp.SetDefault("DATABASE_STORE", "MONGO")
+	// REDIS or MEMORY, the memory store is only meant for development and tests
+	vp.SetDefault("SESSION_STORE", "REDIS")
+	vp.SetDefault("LIMITER_STORE", "REDIS")
+	// 0 means there is no limit on the amount of sessions a user can have
+	vp.SetDefault("MAX_SESSIONS_PER_USER", 3)
+	// REJECT refuses new sign ins, EVICT_OLDEST signs out the oldest session
+	vp.SetDefault("MAX_SESSIONS_POLICY", "EVICT_OLDEST")
+	// seconds a signed in session can go unused before it is signed out
+	vp.SetDefault("SESSION_IDLE_TIMEOUT", 86400)
+	// comma separated list of role=seconds for the roles with another idle timeout
+	vp.SetDefault("SESSION_IDLE_TIMEOUTS", "")
+	// seconds a signed in session lasts at most however much it is used
+	vp.SetDefault("SESSION_LIFETIME", 86400*7)
+	// comma separated list of role=seconds for the roles with another lifetime
+	vp.SetDefault("SESSION_LIFETIMES", "")
+	// seconds the in flight requests have to finish when the server is stopped
+	vp.SetDefault("SHUTDOWN_TIMEOUT", 30)
+	vp.SetDefault("REDIS_LIMITER_ADDRESS", "localhost:6379")
+	vp.SetDefault("REDIS_LIMITER_PASSWORD", "")
+	vp.SetDefault("REDIS_LIMITER_DB", 0)
+	vp.SetDefault("REDIS_SESSION_ADDRESS", "localhost:6379")
+	vp.SetDefault("REDIS_SESSION_PASSWORD", "")
+	vp.SetDefault("REDIS_SESSION_DB", 0)
+	vp.SetDefault("COOKIE_DOMAIN", "")
+	vp.SetDefault("COOKIE_PATH", "/")
+	// seconds the sessions that are not signed in live for, signed in sessions use the session timeouts
+	vp.SetDefault("COOKIE_MAX_AGE", 86400*7)
+	vp.SetDefault("COOKIE_SECURE", false)
+	vp.SetDefault("COOKIE_HTTP_ONLY", false) // TODO set to true once the frontend does not read it
+	// DEFAULT, LAX, STRICT or NONE
+	vp.SetDefault("COOKIE_SAME_SITE", "DEFAULT")
+	// comma separated list of the origins allowed to call the api with credentials
+	vp.SetDefault("CORS_ALLOW_ORIGINS", "http://localhost:4200,http://127.0.0.1:4200")
+	// TODO change in production
+	vp.SetDefault("EMAIL_SERVICE_URL", "http://127.0.0.1:8081")
+	vp.SetDefault("S3_SERVICE_URL", "http://127.0.0.1:8082")
+	// FILE, MONGO or DEFAULT, the default policy only has the user and admin roles and is never reloaded
+	vp.SetDefault("RBAC_POLICY_STORE", "DEFAULT")
+	vp.SetDefault("RBAC_POLICY_FILE", "rbac_policy.json")
+	// seconds between each reload of the policy, 0 turns the reload off
+	vp.SetDefault("RBAC_RELOAD_INTERVAL", 30)
+	// seconds the role and status of a user are cached for, 0 reads them from the database on every request
+	vp.SetDefault("ACCOUNT_CACHE_TTL", 5)
+	// failed sign ins of an email before the account is locked and an unlock email is sent
+	vp.SetDefault("SIGN_IN_MAX_FAILURES", 5)
+	// failed sign ins from an ip before it can not sign in until the window is over
+	vp.SetDefault("SIGN_IN_MAX_IP_FAILURES", 50)
+	// seconds the failed sign ins are counted for
+	vp.SetDefault("SIGN_IN_FAILURE_WINDOW", 900)
+	// seconds a locked account stays locked unless it is unlocked from the email
+	vp.SetDefault("SIGN_IN_LOCKOUT", 900)
+	// seconds to wait after the first failed sign in, doubled on every failure after, 0 turns the backoff off
+	vp.SetDefault("SIGN_IN_BACKOFF_BASE", 1)
+	vp.SetDefault("SIGN_IN_BACKOFF_MAX", 60)
+	// the rate of the rate limited routes that are not in RATE_LIMITS, 30-M is 30 calls a minute
+	vp.SetDefault("RATE_LIMIT_DEFAULT", "30-M")
+	// comma separated list of name=rate, the names are the ones the routes pass to RateLimit
+	vp.SetDefault("RATE_LIMITS", "")
+	// the name the authenticator apps show next to the codes
+	vp.SetDefault("TOTP_ISSUER", "GoSession")
+	// seconds the user has to send the code after the password was correct
+	vp.SetDefault("TOTP_PENDING_TTL", 300)
+	// the domain the passkeys are bound to, the origins have to be on it or a subdomain of it
+	vp.SetDefault("WEBAUTHN_RP_ID", "localhost")
+	vp.SetDefault("WEBAUTHN_RP_NAME", "GoSession")
+	// comma separated list of the origins the passkey ceremonies can come from
+	vp.SetDefault("WEBAUTHN_ORIGINS", "http://localhost:4200")
+	// seconds the user has to answer the passkey prompt
+	vp.SetDefault("WEBAUTHN_TIMEOUT", 300)
+	// true refuses authenticators that did not verify the user with a pin or biometrics
+	vp.SetDefault("WEBAUTHN_USER_VERIFICATION", false)
+	// the issuer of the OpenID Connect provider users can sign in with, empty turns the sign in off
+	vp.SetDefault("OIDC_ISSUER", "")
+	vp.SetDefault("OIDC_CLIENT_ID", "")
+	vp.SetDefault("OIDC_CLIENT_SECRET", "")
+	// the url of the callback route as it was registered with the provider
+	vp.SetDefault("OIDC_REDIRECT_URL", "http://localhost:8080/auth/oidc/callback")
+	// comma separated list of the scopes asked for, openid is required
+	vp.SetDefault("OIDC_SCOPES", "openid,email,profile")
+	// where the browser is sent once the user is signed in
+	vp.SetDefault("OIDC_POST_SIGN_IN_URL", "http://localhost:4200")
+	// the url of this service when other services sign in with it, empty turns the provider off
+	vp.SetDefault("OIDC_PROVIDER_ISSUER", "")
+	// the page of the app users are sent to when they are not signed in, it gets the url to return to in redirect
+	vp.SetDefault("OIDC_PROVIDER_SIGN_IN_URL", "http://localhost:4200/sign-in")
+	// seconds a client has to use the code it was given
+	vp.SetDefault("OIDC_PROVIDER_CODE_TTL", 60)
+	// seconds the access and id tokens given to the clients are valid for
+	vp.SetDefault("OIDC_PROVIDER_TOKEN_TTL", 3600)
+	// the iss of the access tokens given at a jwt sign in, empty turns the jwt sign in off
+	vp.SetDefault("ACCESS_TOKEN_ISSUER", "")
+	// comma separated list of the services the access tokens are meant for
+	vp.SetDefault("ACCESS_TOKEN_AUDIENCE", "")
+	// seconds the access tokens are valid for, the refresh token gets new ones
+	vp.SetDefault("ACCESS_TOKEN_TTL", 300)
+	// pem file of the rsa key the tokens are signed with, empty generates a new key on every start
+	vp.SetDefault("JWT_SIGNING_KEY_FILE", "")
+}
+
+func defineApplicationConfiguration(vp *viper.Viper) error {
+	vp.SetConfigName("config") // name of config file (without extension)
+	vp.SetConfigType("env")    // REQUIRED if the config file does not have the extension in the name
+	vp.AddConfigPath("./")     // path to look for the config file in. can have multiple lines here to search
+	// every value can be overridden with an environment variable of the same name
+	vp.AutomaticEnv()
+	if err := vp.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			// Config file not found, the values have to come from the environment
+			fmt.Println("No config file found, using the defaults and the environment")
+		} else {
+			// Config file was found but another error was produced
+			return fmt.Errorf("Fatal error application config file: %s", err)
+		}
+	}
+	return nil
+}
+
+func bindApplicationEnvStruct(vp *viper.Viper) (ConfigApplication, error) {
+	var config ConfigApplication
+
+	err := vp.Unmarshal(&config)
+	if err != nil {
+		fmt.Println("unable to decode into struct")
+		fmt.Println(err)
+		return config, err
+	}
+
+	return config, nil
+}
+
+// Validate checks every value of the config and returns a ConfigError listing all the
+// values that are missing or invalid
+func (config ConfigApplication) Validate() error {
+	var problems []string
+	missing := func(key string, value string) {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, key+" is missing")
+		}
+	}
+	oneOf := func(key string, value string, options ...string) {
+		for _, option := range options {
+			if strings.ToUpper(value) == option {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s must be one of %s but is %q", key, strings.Join(options, ", "), value))
+	}
+	isURL := func(key string, value string) {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, key+" is missing")
+			return
+		}
+		if !isValidURL(value) {
+			problems = append(problems, fmt.Sprintf("%s must be an absolute http url but is %q", key, value))
+		}
+	}
+
+	missing("APP_PORT", config.Port)
+
+	oneOf("DATABASE_STORE", config.DBStore, DatabaseStoreMongo, DatabaseStoreMemory)
+	if strings.ToUpper(config.DBStore) == DatabaseStoreMongo {
+		missing("DATABASE_HOST", config.DBHost)
+		missing("DATABASE_PORT", config.DBPort)
+		missing("DATABASE_NAME", config.DBName)
+		missing("DATABASE_USERNAME", config.DBUsername)
+		missing("DATABASE_PASSWORD", config.DBPassword)
+	}
+
+	oneOf("SESSION_STORE", config.SessionStore, SessionStoreRedis, SessionStoreMemory)
+	if strings.ToUpper(config.SessionStore) == SessionStoreRedis {
+		missing("REDIS_SESSION_ADDRESS", config.RedisSessionAddress)
+	}
+	oneOf("LIMITER_STORE", config.LimiterStore, SessionStoreRedis, SessionStoreMemory)
+	if strings.ToUpper(config.LimiterStore) == SessionStoreRedis {
+		missing("REDIS_LIMITER_ADDRESS", config.RedisLimiterAddress)
+	}
+	if config.RedisSessionDB < 0 {
+		problems = append(problems, "REDIS_SESSION_DB can not be negative")
+	}
+	if config.RedisLimiterDB < 0 {
+		problems = append(problems, "REDIS_LIMITER_DB can not be negative")
+	}
+
+	if config.MaxSessionsPerUser < 0 {
+		problems = append(problems, "MAX_SESSIONS_PER_USER can not be negative")
+	}
+	oneOf("MAX_SESSIONS_POLICY", config.MaxSessionsPolicy, MaxSessionsPolicyReject, MaxSessionsPolicyEvictOldest)
+	if config.SessionIdleTimeout <= 0 {
+		problems = append(problems, "SESSION_IDLE_TIMEOUT must be more than 0")
+	}
+	if _, err := parseRoleSeconds(config.SessionIdleTimeouts); err != nil {
+		problems = append(problems, "SESSION_IDLE_TIMEOUTS is invalid, "+err.Error())
+	}
+	if config.SessionLifetime <= 0 {
+		problems = append(problems, "SESSION_LIFETIME must be more than 0")
+	}
+	if _, err := parseRoleSeconds(config.SessionLifetimes); err != nil {
+		problems = append(problems, "SESSION_LIFETIMES is invalid, "+err.Error())
+	}
+
+	if config.ShutdownTimeout < 0 {
+		problems = append(problems, "SHUTDOWN_TIMEOUT can not be negative")
+	}
+
+	missing("COOKIE_PATH", config.CookiePath)
+	if config.CookieMaxAge <= 0 {
+		problems = append(problems, "COOKIE_MAX_AGE must be more than 0")
+	}
+	if _, ok := sameSiteMode(config.CookieSameSite); !ok {
+		problems = append(problems, fmt.Sprintf("COOKIE_SAME_SITE must be one of DEFAULT, LAX, STRICT, NONE but is %q", config.CookieSameSite))
+	}
+	if strings.ToUpper(config.CookieSameSite) == "NONE" && !config.CookieSecure {
+		problems = append(problems, "COOKIE_SECURE must be true when COOKIE_SAME_SITE is NONE")
+	}
+
+	if len(config.CORSAllowOrigins) == 0 {
+		problems = append(problems, "CORS_ALLOW_ORIGINS is missing")
+	}
+	for _, origin := range config.CORSAllowOrigins {
+		if origin != "*" && !isValidURL(origin) {
+			problems = append(problems, fmt.Sprintf("CORS_ALLOW_ORIGINS must only contain absolute http urls but contains %q", origin))
+		}
+	}
+
+	isURL("EMAIL_SERVICE_URL", config.EmailServiceURL)
+	isURL("S3_SERVICE_URL", config.S3ServiceURL)
+
+	oneOf("RBAC_POLICY_STORE", config.RBACPolicyStore, PolicyStoreFile, PolicyStoreMongo, PolicyStoreDefault)
+	if strings.ToUpper(config.RBACPolicyStore) == PolicyStoreFile {
+		missing("RBAC_POLICY_FILE", config.RBACPolicyFile)
+	}
+	if strings.ToUpper(config.RBACPolicyStore) == PolicyStoreMongo && strings.ToUpper(config.DBStore) != DatabaseStoreMongo {
+		problems = append(problems, "RBAC_POLICY_STORE can only be MONGO when DATABASE_STORE is MONGO")
+	}
+	if config.RBACReloadInterval < 0 {
+		problems = append(problems, "RBAC_RELOAD_INTERVAL can not be negative")
+	}
+
+	if config.AccountCacheTTL < 0 {
+		problems = append(problems, "ACCOUNT_CACHE_TTL can not be negative")
+	}
+
+	if config.SignInMaxFailures <= 0 {
+		problems = append(problems, "SIGN_IN_MAX_FAILURES must be more than 0")
+	}
+	if config.SignInMaxIPFailures <= 0 {
+		problems = append(problems, "SIGN_IN_MAX_IP_FAILURES must be more than 0")
+	}
+	if config.SignInFailureWindow <= 0 {
+		problems = append(problems, "SIGN_IN_FAILURE_WINDOW must be more than 0")
+	}
+	if config.SignInLockout <= 0 {
+		problems = append(problems, "SIGN_IN_LOCKOUT must be more than 0")
+	}
+	if config.SignInBackoffBase < 0 {
+		problems = append(problems, "SIGN_IN_BACKOFF_BASE can not be negative")
+	}
+	if config.SignInBackoffMax < config.SignInBackoffBase {
+		problems = append(problems, "SIGN_IN_BACKOFF_MAX can not be less than SIGN_IN_BACKOFF_BASE")
+	}
+
+	if _, err := limiter.NewRateFromFormatted(config.RateLimitDefault); err != nil {
+		problems = append(problems, fmt.Sprintf("RATE_LIMIT_DEFAULT must be a rate like 30-M but is %q", config.RateLimitDefault))
+	}
+	if _, err := parseRateLimits(config.RateLimits); err != nil {
+		problems = append(problems, "RATE_LIMITS is invalid, "+err.Error())
+	}
+
+	missing("TOTP_ISSUER", config.TOTPIssuer)
+	if config.TOTPPendingTTL <= 0 {
+		problems = append(problems, "TOTP_PENDING_TTL must be more than 0")
+	}
+
+	missing("WEBAUTHN_RP_ID", config.WebAuthnRPID)
+	missing("WEBAUTHN_RP_NAME", config.WebAuthnRPName)
+	if len(config.WebAuthnOrigins) == 0 {
+		problems = append(problems, "WEBAUTHN_ORIGINS is missing")
+	}
+	for _, origin := range config.WebAuthnOrigins {
+		if !isValidURL(origin) {
+			problems = append(problems, fmt.Sprintf("WEBAUTHN_ORIGINS must only contain absolute http urls but contains %q", origin))
+		}
+	}
+	if config.WebAuthnTimeout <= 0 {
+		problems = append(problems, "WEBAUTHN_TIMEOUT must be more than 0")
+	}
+
+	if config.OIDCIssuer != "" {
+		isURL("OIDC_ISSUER", config.OIDCIssuer)
+		missing("OIDC_CLIENT_ID", config.OIDCClientID)
+		isURL("OIDC_REDIRECT_URL", config.OIDCRedirectURL)
+		isURL("OIDC_POST_SIGN_IN_URL", config.OIDCPostSignInURL)
+		hasOpenID := false
+		for _, scope := range config.OIDCScopes {
+			if strings.TrimSpace(scope) == "openid" {
+				hasOpenID = true
+			}
+		}
+		if !hasOpenID {
+			problems = append(problems, "OIDC_SCOPES must contain openid")
+		}
+	}
+
+	if config.OIDCProviderIssuer != "" {
+		isURL("OIDC_PROVIDER_ISSUER", config.OIDCProviderIssuer)
+		isURL("OIDC_PROVIDER_SIGN_IN_URL", config.OIDCProviderSignInURL)
+		if config.OIDCProviderCodeTTL <= 0 {
+			problems = append(problems, "OIDC_PROVIDER_CODE_TTL must be more than 0")
+		}
+		if config.OIDCProviderTokenTTL <= 0 {
+			problems = append(problems, "OIDC_PROVIDER_TOKEN_TTL must be more than 0")
+		}
+	}
+
+	if config.AccessTokenIssuer != "" {
+		if len(config.AccessTokenAudience) == 0 {
+			problems = append(problems, "ACCESS_TOKEN_AUDIENCE is missing")
+		}
+		if config.AccessTokenTTL <= 0 {
+			problems = append(problems, "ACCESS_TOKEN_TTL must be more than 0")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// isValidURL checks the value is an absolute http or https url
+func isValidURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// sameSiteMode converts the COOKIE_SAME_SITE value to the cookie attribute
+func sameSiteMode(value string) (http.SameSite, bool) {
+	switch strings.ToUpper(value) {
+	case "", "DEFAULT":
+		return http.SameSiteDefaultMode, true
+	case "LAX":
+		return http.SameSiteLaxMode, true
+	case "STRICT":
+		return http.SameSiteStrictMode, true
+	case "NONE":
+		return http.SameSiteNoneMode, true
+	}
+	return http.SameSiteDefaultMode, false
+}
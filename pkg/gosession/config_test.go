@@ -0,0 +1,71 @@
+package gosession
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+	config := DefaultConfig()
+	config.RedisSessionAddress = ""
+	config.MaxSessionsPolicy = "SOMETIMES"
+	config.CookieSameSite = "NONE"
+	config.CORSAllowOrigins = []string{"localhost:4200"}
+	config.EmailServiceURL = ""
+
+	err := config.Validate()
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected a ConfigError but got %v", err)
+	}
+
+	for _, key := range []string{"REDIS_SESSION_ADDRESS", "MAX_SESSIONS_POLICY", "COOKIE_SECURE", "CORS_ALLOW_ORIGINS", "EMAIL_SERVICE_URL"} {
+		if !strings.Contains(configErr.Error(), key) {
+			t.Errorf("expected %s in the problems: %v", key, configErr.Problems)
+		}
+	}
+	if len(configErr.Problems) != 5 {
+		t.Errorf("expected 5 problems but got %d: %v", len(configErr.Problems), configErr.Problems)
+	}
+}
+
+func TestLoadConfigUsesTheEnvironment(t *testing.T) {
+	os.Setenv("REDIS_SESSION_ADDRESS", "redis-sessions:6380")
+	os.Setenv("MAX_SESSIONS_PER_USER", "5")
+	os.Setenv("CORS_ALLOW_ORIGINS", "https://a.example.com,https://b.example.com")
+	defer os.Unsetenv("REDIS_SESSION_ADDRESS")
+	defer os.Unsetenv("MAX_SESSIONS_PER_USER")
+	defer os.Unsetenv("CORS_ALLOW_ORIGINS")
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.RedisSessionAddress != "redis-sessions:6380" {
+		t.Errorf("expected the redis session address from the environment but got %q", config.RedisSessionAddress)
+	}
+	if config.MaxSessionsPerUser != 5 {
+		t.Errorf("expected 5 max sessions from the environment but got %d", config.MaxSessionsPerUser)
+	}
+	if len(config.CORSAllowOrigins) != 2 || config.CORSAllowOrigins[1] != "https://b.example.com" {
+		t.Errorf("expected 2 cors origins from the environment but got %v", config.CORSAllowOrigins)
+	}
+}
+
+func TestLoadConfigFailsFastOnInvalidEnvironment(t *testing.T) {
+	os.Setenv("SESSION_STORE", "FILE")
+	defer os.Unsetenv("SESSION_STORE")
+
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "SESSION_STORE") {
+		t.Fatalf("expected the invalid SESSION_STORE to be reported but got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package gosession
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+	CSRF PROTECTION SYSTEM
+
+	The session cookie is sent by the browser with every request to the api, including the ones
+	another site makes it send, so the cookie alone can not prove the user meant to make a request.
+	Every session gets a random token kept in the session (the synchronizer token pattern), the app
+	gets it from GET /auth/csrf-token and sends it back in the X-CSRF-Token header.
+
+	Every POST, PUT, PATCH and DELETE request that comes with the cookie of an existing session has
+	to carry the token of that session. Requests authenticated with an Authorization: Bearer header
+	do not rely on the cookie so they do not need it. A new token is made whenever the session gets
+	a new id at a sign in and is sent back in the X-CSRF-Token header of that response.
+
+*/
+
+const (
+	// csrfHeader is the header the token is sent in
+	csrfHeader = "X-CSRF-Token"
+	// csrfTokenSize is the amount of random bytes in a token
+	csrfTokenSize = 32
+)
+
+var errCSRFInvalid = errors.New("The csrf token is missing or invalid")
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureCSRFRoutes - Configure all the routes for csrf tokens here
+func (s *Server) configureCSRFRoutes() {
+
+	// returns the csrf token of the session, a session is started when there is none
+	s.echo.GET("/auth/csrf-token", s.getCSRFToken)
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// getCSRFToken returns the token the state changing requests of this session have to send
+func (s *Server) getCSRFToken(c echo.Context) error {
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	token, _ := session.Values["csrfToken"].(string)
+	if token == "" {
+		token, err = setCSRFToken(c, session)
+		if err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusInternalServerError, "failed creating the csrf token")
+		}
+
+		session.IsNew = false
+		if err := session.Save(c.Request(), c.Response()); err != nil {
+			fmt.Println("failed saving session: ", err)
+			return c.String(http.StatusNotAcceptable, "failed saving session")
+		}
+	}
+	c.Response().Header().Set(csrfHeader, token)
+
+	return c.JSON(http.StatusOK, echo.Map{"csrfToken": token})
+}
+
+// END ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// CSRFMiddleware refuses the state changing requests that rely on the session cookie
+// and do not carry the csrf token of the session
+func (s *Server) CSRFMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			switch c.Request().Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			default:
+				return next(c)
+			}
+
+			// bearer clients never send the cookie on their own so they can not be forged
+			if bearerToken(c) != "" {
+				return next(c)
+			}
+			if _, err := c.Request().Cookie(sessionName); err != nil {
+				return next(c)
+			}
+
+			session, err := s.getSession(c)
+			if err != nil || session.IsNew {
+				// the cookie is not of an existing session so nothing relies on it
+				return next(c)
+			}
+
+			token, _ := session.Values["csrfToken"].(string)
+			sent := c.Request().Header.Get(csrfHeader)
+			if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(sent)) != 1 {
+				return c.JSON(http.StatusForbidden, errCSRFInvalid.Error())
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// setCSRFToken gives the session a new token and sends it in the header of the response,
+// the session still has to be saved
+func setCSRFToken(c echo.Context, session *sessions.Session) (string, error) {
+	b := make([]byte, csrfTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	session.Values["csrfToken"] = token
+	c.Response().Header().Set(csrfHeader, token)
+	return token, nil
+}
+
+// END INTERNAL FUNCTIONS --------------------------------------------------------------------------
@@ -0,0 +1,72 @@
+package gosession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// signOutWith signs out with the cookie, sending the headers with it
+func signOutWith(cookie *http.Cookie, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/auth/sign-out", nil)
+	req.AddCookie(cookie)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCSRFTokenIsRequiredWithTheSessionCookie(t *testing.T) {
+	email := uniqueEmail("csrf")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	// the token of the session before the sign in is of no use after it
+	anonymous := testRequest{method: http.MethodGet, path: "/auth/csrf-token"}.do(t)
+	expectStatus(t, anonymous, http.StatusOK)
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", cookies: []*http.Cookie{sessionCookie(t, anonymous)}, body: SignInUser{
+		Email:    email,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	cookie := sessionCookie(t, rec)
+	token := rec.Header().Get(csrfHeader)
+	if token == "" || token == anonymous.Header().Get(csrfHeader) {
+		t.Fatalf("expected a new csrf token at the sign in but got %q", token)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-out", cookies: []*http.Cookie{cookie}, withoutCSRF: true}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+	expectStatus(t, signOutWith(cookie, map[string]string{csrfHeader: anonymous.Header().Get(csrfHeader)}), http.StatusForbidden)
+
+	// the request was refused so the session is still signed in
+	if status, _ := getUserViaSessionCookie(t, cookie); status != http.StatusOK {
+		t.Fatalf("expected the session to still be signed in but got %d", status)
+	}
+
+	// the token endpoint gives the same token for the session
+	rec = testRequest{method: http.MethodGet, path: "/auth/csrf-token", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get(csrfHeader) != token {
+		t.Fatal("expected the token endpoint to give the token of the session")
+	}
+
+	expectStatus(t, signOutWith(cookie, map[string]string{csrfHeader: token}), http.StatusOK)
+}
+
+func TestCSRFTokenIsNotRequiredForBearerRequests(t *testing.T) {
+	email := uniqueEmail("csrf-bearer")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+	cookie := signInAs(t, email, password)
+
+	rec := signOutWith(cookie, map[string]string{echo.HeaderAuthorization: "Bearer token"})
+	if rec.Code == http.StatusForbidden {
+		t.Fatalf("expected the bearer request to not need a csrf token but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,249 @@
+package gosession
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/sessions"
+	redisSessions "github.com/rbcervilla/redisstore/v8"
+	"github.com/ulule/limiter/v3"
+	memoryLimiter "github.com/ulule/limiter/v3/drivers/store/memory"
+	redisLimiter "github.com/ulule/limiter/v3/drivers/store/redis"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoInstance contains the Mongo client and database objects
+type MongoInstance struct {
+	Client *mongo.Client
+	Db     *mongo.Database
+}
+
+// RedisLimiterInstance contains the Redis limiter client and store objects
+type RedisLimiterInstance struct {
+	Client *redis.Client
+	Store  limiter.Store
+}
+
+// RedisSessionInstance contains the Redis session client and store objects
+type RedisSessionInstance struct {
+	Client *redis.Client
+	Store  *redisSessions.RedisStore
+}
+
+// closeDatabases disconnects the mongo and redis clients that were opened by the server,
+// stores that were passed in as options are left to their owner
+func (s *Server) closeDatabases(ctx context.Context) error {
+	var closeErr error
+
+	if s.mongo != nil {
+		err := s.mongo.Client.Disconnect(ctx)
+		if err != nil {
+			fmt.Println("failed disconnecting from mongo: ", err)
+			closeErr = err
+		}
+		s.mongo = nil
+	}
+	if s.redisLimiter != nil {
+		err := s.redisLimiter.Client.Close()
+		if err != nil {
+			fmt.Println("failed closing the limiter redis client: ", err)
+			closeErr = err
+		}
+		s.redisLimiter = nil
+	}
+	if s.redisSession != nil {
+		err := s.redisSession.Client.Close()
+		if err != nil {
+			fmt.Println("failed closing the session redis client: ", err)
+			closeErr = err
+		}
+		s.redisSession = nil
+	}
+
+	return closeErr
+}
+
+// connectToLimiterStore will setup the rate limiter store selected in the config
+func (s *Server) connectToLimiterStore() error {
+	if strings.ToUpper(s.config.LimiterStore) == SessionStoreMemory {
+		fmt.Println("using the memory rate limiter store, limits are not shared between instances")
+		s.limiterStore = memoryLimiter.NewStore()
+		return nil
+	}
+
+	return s.connectToRedisLimiterDatabase()
+}
+
+func (s *Server) connectToRedisLimiterDatabase() error {
+	redisLimiterClient := redis.NewClient(&redis.Options{
+		Addr:     s.config.RedisLimiterAddress,
+		Password: s.config.RedisLimiterPassword,
+		DB:       s.config.RedisLimiterDB,
+	})
+
+	store, err := redisLimiter.NewStoreWithOptions(redisLimiterClient, limiter.StoreOptions{
+		Prefix:   "domain_rate_limiter_",
+		MaxRetry: 3,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	// panic: failed to load incr lua script: EOF
+
+	s.redisLimiter = &RedisLimiterInstance{
+		Client: redisLimiterClient,
+		Store:  store,
+	}
+	s.limiterStore = store
+	return nil
+}
+
+func (s *Server) connectToRedisSessionDatabase() error {
+	redisSessionClient := redis.NewClient(&redis.Options{
+		Addr:     s.config.RedisSessionAddress,
+		Password: s.config.RedisSessionPassword,
+		DB:       s.config.RedisSessionDB,
+	})
+	// New default RedisStore
+	store, err := redisSessions.NewRedisStore(context.Background(), redisSessionClient)
+	if err != nil {
+		fmt.Println("failed to create redis store: ", err)
+		return err
+	}
+
+	store.KeyPrefix(sessionKeyPrefix)
+	store.Options(s.sessionOptions())
+
+	s.redisSession = &RedisSessionInstance{
+		Client: redisSessionClient,
+		Store:  store,
+	}
+	return nil
+}
+
+// connectToSessionStore will setup the session store selected in the config
+func (s *Server) connectToSessionStore() error {
+	if strings.ToUpper(s.config.SessionStore) == SessionStoreMemory {
+		fmt.Println("using the memory session store, sessions will be lost on restart")
+		s.sessions = NewMemorySessionStore(s.sessionOptions())
+		return nil
+	}
+
+	err := s.connectToRedisSessionDatabase()
+	if err != nil {
+		return err
+	}
+	s.sessions = s.redisSession
+	return nil
+}
+
+// sessionOptions are the options of the session cookie from the config for every session store
+func (s *Server) sessionOptions() sessions.Options {
+	sameSite, _ := sameSiteMode(s.config.CookieSameSite)
+
+	return sessions.Options{
+		Path:     s.config.CookiePath,
+		Domain:   s.config.CookieDomain,
+		MaxAge:   s.config.CookieMaxAge,
+		Secure:   s.config.CookieSecure,
+		HttpOnly: s.config.CookieHTTPOnly,
+		SameSite: sameSite,
+	}
+}
+
+// connectToDatabaseStore will setup the repositories for the database selected in the config,
+// repositories that were passed in as options are kept
+func (s *Server) connectToDatabaseStore() error {
+	if strings.ToUpper(s.config.DBStore) == DatabaseStoreMemory {
+		fmt.Println("using the memory database, documents will be lost on restart")
+		if s.users == nil {
+			s.users = NewMemoryUserRepository()
+		}
+		if s.emailAuthTokens == nil {
+			s.emailAuthTokens = NewMemoryEmailAuthTokenRepository()
+		}
+		if s.posts == nil {
+			s.posts = NewMemoryPostRepository()
+		}
+		if s.oidcClients == nil {
+			s.oidcClients = NewMemoryOIDCClientRepository()
+		}
+		return nil
+	}
+
+	err := s.connectToDatabase()
+	if err != nil {
+		return err
+	}
+	if err := CreateMongoUserIndexes(context.Background(), s.mongo.Db); err != nil {
+		fmt.Println("failed creating the indexes of the users: ", err)
+		return err
+	}
+	if s.users == nil {
+		s.users = NewMongoUserRepository(s.mongo.Db)
+	}
+	if s.emailAuthTokens == nil {
+		s.emailAuthTokens = NewMongoEmailAuthTokenRepository(s.mongo.Db)
+	}
+	if s.posts == nil {
+		s.posts = NewMongoPostRepository(s.mongo.Db)
+	}
+	if s.oidcClients == nil {
+		s.oidcClients = NewMongoOIDCClientRepository(s.mongo.Db)
+	}
+	return nil
+}
+
+//dbPort := os.Getenv("DOMAIN_API_PORT")
+
+// Connect configures the MongoDB client and initializes the database connection.
+// Source: https://www.mongodb.com/blog/post/quick-start-golang--mongodb--starting-and-setup
+func (s *Server) connectToDatabase() error {
+
+	mongoURI := url.URL{
+		Scheme: "mongodb",
+		User:   url.UserPassword(s.config.DBUsername, s.config.DBPassword),
+		Host:   s.config.DBHost + ":" + s.config.DBPort,
+		Path:   "/" + s.config.DBName,
+	}
+
+	// the password is never printed
+	fmt.Println("connecting to mongo at", mongoURI.Redacted())
+
+	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI.String()))
+	if err != nil {
+		fmt.Println("Cannot connect 1...")
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	db := client.Database(s.config.DBName)
+	if err != nil {
+		fmt.Println("Cannot connect...")
+		return err
+	}
+
+	err = client.Ping(context.TODO(), nil)
+	// Check the connection
+	if err != nil {
+		fmt.Println("Cannot ping...")
+		return err
+	}
+	fmt.Printf("Database listening on port:%s", s.config.DBPort)
+	fmt.Println("finished connecting to mongo db")
+	s.mongo = &MongoInstance{
+		Client: client,
+		Db:     db,
+	}
+
+	return nil
+}
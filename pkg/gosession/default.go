@@ -7,13 +7,13 @@ import (
 )
 
 // ConfigureDefaultRoutes - Configure all the default routes here
-func configureDefaultRoutes() {
+func (s *Server) configureDefaultRoutes() {
 
-	e.GET("/", defaultRoute, SessionMiddleware("user"))
+	s.echo.GET("/", s.defaultRoute, s.SessionMiddleware("user"))
 
 }
 
-func defaultRoute(c echo.Context) error {
+func (s *Server) defaultRoute(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, "VALID")
 }
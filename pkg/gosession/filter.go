@@ -15,11 +15,12 @@ import (
 	v0.1
 */
 
-func addFiltersToPipeline(c echo.Context, role string, pipelineType string) []bson.M {
+func (s *Server) addFiltersToPipeline(c echo.Context, role string, pipelineType string) []bson.M {
 
 	pipeline := []bson.M{}
 
-	if role == "admin" {
+	// the roles that inherit from admin in the policy get the admin filters too
+	if s.rbac.hasRole(role, "admin") {
 		switch pipelineType {
 		case "users":
 			pipeline = addFiltersToAdminUsersPipeline(c, pipeline)
@@ -0,0 +1,118 @@
+package gosession
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAddFiltersToAdminUsersPipeline(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/users?email=admin@domain.com&verified=true&createdBefore=2020-01-02T03:04:05.000Z", nil)
+	c := testServer.echo.NewContext(req, httptest.NewRecorder())
+
+	pipeline := testServer.addFiltersToPipeline(c, "admin", "users")
+
+	createdBefore := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	expected := []bson.M{
+		{"$match": bson.M{"email": "admin@domain.com"}},
+		{"$match": bson.M{"verified": true}},
+		{"$match": bson.M{"$and": []interface{}{
+			bson.M{"createdAt": bson.M{"$ne": nil}},
+			bson.M{"createdAt": bson.M{"$lt": createdBefore}},
+		}}},
+	}
+	if !reflect.DeepEqual(pipeline, expected) {
+		t.Fatalf("expected pipeline %v but got %v", expected, pipeline)
+	}
+}
+
+func TestAddFiltersToPipelineIgnoresFiltersForUsers(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/users?email=admin@domain.com&verified=true", nil)
+	c := testServer.echo.NewContext(req, httptest.NewRecorder())
+
+	if pipeline := testServer.addFiltersToPipeline(c, "user", "users"); len(pipeline) != 0 {
+		t.Fatalf("expected no filters for the user role but got %v", pipeline)
+	}
+}
+
+func TestAddFiltersToPipelineFollowsInheritance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.json")
+	err = ioutil.WriteFile(policyFile, []byte(`{"roles": [
+		{"name": "user"},
+		{"name": "admin", "inherits": ["user"], "permissions": ["*"]},
+		{"name": "owner", "inherits": ["admin"]}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestServer(t, nil, WithPolicySource(NewFilePolicySource(policyFile)))
+
+	req := httptest.NewRequest(http.MethodGet, "/users?verified=true", nil)
+	c := server.echo.NewContext(req, httptest.NewRecorder())
+	if pipeline := server.addFiltersToPipeline(c, "owner", "users"); len(pipeline) != 1 {
+		t.Fatalf("expected the role that inherits from admin to get the admin filters but got %v", pipeline)
+	}
+}
+
+func TestGetUsersWithAdminFilters(t *testing.T) {
+	password := "password1234"
+	adminEmail := uniqueEmail("filters-admin")
+	verifiedEmail := uniqueEmail("filters-verified")
+	unverifiedEmail := uniqueEmail("filters-unverified")
+
+	insertUser(t, testServer, adminEmail, password, "admin")
+	registerAndConfirm(t, verifiedEmail, password)
+	rec := testRequest{method: http.MethodPost, path: "/auth/register", body: NewUser{
+		Email:     unverifiedEmail,
+		FirstName: "Test",
+		Password:  password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	cookie := signInAs(t, adminEmail, password)
+
+	rec = testRequest{method: http.MethodGet, path: "/users?verified=true", ip: unique("10.0.0."), cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	var users []ExistingUser
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, user := range users {
+		if !user.Verified {
+			t.Fatalf("expected only verified users but got %s", user.Email)
+		}
+		if user.Email == verifiedEmail {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the verified user in %v", users)
+	}
+
+	rec = testRequest{method: http.MethodGet, path: "/users?verified=true&email=" + verifiedEmail, ip: unique("10.0.0."), cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	users = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Email != verifiedEmail {
+		t.Fatalf("expected only the verified user but got %v", users)
+	}
+}
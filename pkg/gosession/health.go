@@ -0,0 +1,145 @@
+package gosession
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+	HEALTH SYSTEM
+
+	These routes are used by the kubernetes probes so they do not need a session.
+	/livez only checks the process is able to answer requests.
+	/healthz and /readyz ping every database the server connected to and report
+	the status of each of them, the memory stores and the stores passed in as
+	options are not probed.
+
+*/
+
+const (
+	// healthCheckTimeout is how long each database has to answer the ping
+	healthCheckTimeout = 2 * time.Second
+
+	healthStatusOK          = "ok"
+	healthStatusUnavailable = "unavailable"
+)
+
+// HealthStatus is the status of the server and of each of its databases
+type HealthStatus struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// DependencyStatus is the result of pinging a database
+type DependencyStatus struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureHealthRoutes - Configure all the health routes here
+func (s *Server) configureHealthRoutes() {
+
+	s.echo.GET("/livez", s.getLiveness)
+
+	s.echo.GET("/healthz", s.getHealth)
+
+	s.echo.GET("/readyz", s.getHealth)
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// getLiveness returns ok as long as the server can answer requests
+func (s *Server) getLiveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"status": healthStatusOK,
+	})
+}
+
+// getHealth pings the databases and returns 503 if any of them is unavailable
+func (s *Server) getHealth(c echo.Context) error {
+	health := s.checkHealth(c.Request().Context())
+
+	if health.Status != healthStatusOK {
+		return c.JSON(http.StatusServiceUnavailable, health)
+	}
+	return c.JSON(http.StatusOK, health)
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// healthChecks returns a ping function for each database the server connected to
+func (s *Server) healthChecks() map[string]func(ctx context.Context) error {
+	checks := map[string]func(ctx context.Context) error{}
+
+	if s.mongo != nil {
+		client := s.mongo.Client
+		checks["mongo"] = func(ctx context.Context) error {
+			return client.Ping(ctx, nil)
+		}
+	}
+	if s.redisLimiter != nil {
+		client := s.redisLimiter.Client
+		checks["limiterRedis"] = func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
+		}
+	}
+	if s.redisSession != nil {
+		client := s.redisSession.Client
+		checks["sessionRedis"] = func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
+		}
+	}
+
+	return checks
+}
+
+// checkHealth runs the health checks at the same time, each with its own timeout
+func (s *Server) checkHealth(ctx context.Context) HealthStatus {
+	checks := s.healthChecks()
+
+	health := HealthStatus{
+		Status:       healthStatusOK,
+		Dependencies: make(map[string]DependencyStatus, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			status := DependencyStatus{
+				Status:  healthStatusOK,
+				Latency: time.Since(start).String(),
+			}
+			if err != nil {
+				status.Status = healthStatusUnavailable
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			health.Dependencies[name] = status
+			if err != nil {
+				health.Status = healthStatusUnavailable
+			}
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	return health
+}
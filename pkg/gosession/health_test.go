@@ -0,0 +1,42 @@
+package gosession
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestHealthRoutesDoNotNeedASession(t *testing.T) {
+	for _, path := range []string{"/livez", "/healthz", "/readyz"} {
+		rec := testRequest{method: http.MethodGet, path: path}.do(t)
+		expectStatus(t, rec, http.StatusOK)
+	}
+}
+
+func TestHealthReportsUnavailableDependency(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	// nothing listens on this port so the ping fails straight away
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	server.redisSession = &RedisSessionInstance{Client: client}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+
+	var health HealthStatus
+	if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Dependencies["sessionRedis"].Status != healthStatusUnavailable {
+		t.Fatalf("expected the session redis to be unavailable: %+v", health)
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	expectStatus(t, rec, http.StatusOK)
+}
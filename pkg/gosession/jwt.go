@@ -0,0 +1,311 @@
+package gosession
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+/*
+	JSON WEB TOKENS
+
+	The tokens are signed with RS256 only (RFC 7518 section 3.3), every other algorithm is refused
+	so a token can not pick a weaker one or "none". The public keys are shared as a JSON Web Key
+	set (RFC 7517) so the other side can fetch them and pick the key by its kid.
+
+	The tokens this service issues are signed with the key in the JWT_SIGNING_KEY_FILE pem file.
+	When no file is set a new key is generated on every start, which signs out every token holder
+	on a restart so it is only meant for development.
+
+	The public key is served at /.well-known/jwks.json whenever this service issues tokens, as the
+	OpenID Connect provider or at a jwt sign in, so other services can check them on their own.
+
+*/
+
+const jwtAlgorithmRS256 = "RS256"
+
+var errJWTInvalid = errors.New("The token is invalid")
+
+// signingKey is the key the tokens of this service are signed with
+type signingKey struct {
+	private *rsa.PrivateKey
+	keyID   string
+}
+
+// JWK is the public part of an rsa signing key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JWKSet is the document served by the jwks endpoints
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// jwtHeader is the first part of the token
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// jwtAudience is the aud claim, which can be a single string or a list of them
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a jwtAudience) contains(audience string) bool {
+	for _, value := range a {
+		if value == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureJWKSRoutes - Configure the route of the public key here, it is only there when tokens are issued
+func (s *Server) configureJWKSRoutes() {
+	if s.signingKey == nil {
+		return
+	}
+
+	// the public key the tokens are signed with
+	s.echo.GET("/.well-known/jwks.json", s.getJWKS)
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// getJWKS returns the public key the tokens are signed with
+func (s *Server) getJWKS(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.signingKey.keySet())
+}
+
+// END ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// signRS256 returns the claims as a token signed with the key
+func signRS256(key *rsa.PrivateKey, keyID string, claims interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: jwtAlgorithmRS256, KeyID: keyID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyRS256 checks the signature of the token with the key returned for its kid and
+// decodes the claims into claims, the claims themselves are checked by the caller
+func verifyRS256(token string, keyFor func(keyID string) (*rsa.PublicKey, error), claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errJWTInvalid
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errJWTInvalid
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return errJWTInvalid
+	}
+	if header.Algorithm != jwtAlgorithmRS256 {
+		return errors.New("the token is not signed with RS256")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errJWTInvalid
+	}
+
+	key, err := keyFor(header.KeyID)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return errJWTInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errJWTInvalid
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return errJWTInvalid
+	}
+	return nil
+}
+
+// rsaPublicJWK returns the JWK of the public key
+func rsaPublicJWK(keyID string, key *rsa.PublicKey) JWK {
+	return JWK{
+		KeyType:   "RSA",
+		Use:       "sig",
+		KeyID:     keyID,
+		Algorithm: jwtAlgorithmRS256,
+		Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// rsaPublicKey returns the public key of the JWK, only rsa signing keys are accepted
+func (k JWK) rsaPublicKey() (*rsa.PublicKey, error) {
+	if k.KeyType != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Algorithm != "" && k.Algorithm != jwtAlgorithmRS256) {
+		return nil, errors.New("the key is not an rsa signing key")
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(k.Modulus)
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("the key has an invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.Exponent)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("the key has an invalid exponent")
+	}
+
+	key := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}
+	// anything shorter can be factored
+	if key.N.BitLen() < 2048 {
+		return nil, errors.New("the key is shorter than 2048 bits")
+	}
+	return key, nil
+}
+
+// keyThumbprint returns the RFC 7638 thumbprint of the key, it is used as the kid
+func keyThumbprint(key *rsa.PublicKey) string {
+	jwk := rsaPublicJWK("", key)
+	// the members have to be in this order with no whitespace
+	canonical := `{"e":"` + jwk.Exponent + `","kty":"RSA","n":"` + jwk.Modulus + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// configureSigningKey loads the signing key when a feature that issues tokens is turned on
+func (s *Server) configureSigningKey() error {
+	if s.config.OIDCProviderIssuer == "" && s.config.AccessTokenIssuer == "" {
+		return nil
+	}
+
+	if s.config.JWTSigningKeyFile == "" {
+		fmt.Println("no JWT_SIGNING_KEY_FILE set, the tokens are signed with a new key until restart")
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		s.signingKey = newSigningKey(key)
+		return nil
+	}
+
+	key, err := loadSigningKey(s.config.JWTSigningKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed loading JWT_SIGNING_KEY_FILE: %v", err)
+	}
+	s.signingKey = key
+	return nil
+}
+
+func newSigningKey(key *rsa.PrivateKey) *signingKey {
+	return &signingKey{private: key, keyID: keyThumbprint(&key.PublicKey)}
+}
+
+// loadSigningKey reads a PKCS #1 or PKCS #8 rsa private key from the pem file
+func loadSigningKey(file string) (*signingKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("the file has no pem block")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("the key is not an rsa key")
+		}
+		key = rsaKey
+	}
+	if key.N.BitLen() < 2048 {
+		return nil, errors.New("the key is shorter than 2048 bits")
+	}
+	return newSigningKey(key), nil
+}
+
+// sign returns the claims as a token signed with the key
+func (k *signingKey) sign(claims interface{}) (string, error) {
+	return signRS256(k.private, k.keyID, claims)
+}
+
+// verify checks the token was signed with the key and decodes its claims
+func (k *signingKey) verify(token string, claims interface{}) error {
+	return verifyRS256(token, func(keyID string) (*rsa.PublicKey, error) {
+		if keyID != k.keyID {
+			return nil, errJWTInvalid
+		}
+		return &k.private.PublicKey, nil
+	}, claims)
+}
+
+// keySet returns the public key as the document of the jwks endpoint
+func (k *signingKey) keySet() JWKSet {
+	return JWKSet{Keys: []JWK{rsaPublicJWK(k.keyID, &k.private.PublicKey)}}
+}
+
+// END INTERNAL FUNCTIONS --------------------------------------------------------------------------
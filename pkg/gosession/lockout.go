@@ -0,0 +1,293 @@
+package gosession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ulule/limiter/v3"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+	SIGN IN PROTECTION SYSTEM
+
+	Failed sign ins are counted per email and per ip in the limiter store for SIGN_IN_FAILURE_WINDOW seconds.
+	https://timoh6.github.io/2015/05/07/Rate-limiting-web-application-login-attempts.html
+
+	After every failed sign in the email has to wait before it can try again, the wait starts at
+	SIGN_IN_BACKOFF_BASE seconds and doubles with every failure up to SIGN_IN_BACKOFF_MAX seconds.
+	Once an email failed SIGN_IN_MAX_FAILURES times the account is locked for SIGN_IN_LOCKOUT seconds
+	and an email is sent with a link to unlock it straight away, resetting the password also unlocks it.
+
+	An ip that failed SIGN_IN_MAX_IP_FAILURES times can not sign in to any account until the window is over,
+	this stops one ip from trying a few passwords on a lot of accounts without locking any of them.
+
+	Every refused sign in is answered with 429 and a Retry-After header in seconds.
+
+*/
+
+const (
+	// emailAuthTokenModeUnlockAccount is the mode of the token sent when the account is locked
+	emailAuthTokenModeUnlockAccount = "UNLOCK_ACCOUNT"
+
+	signInFailuresEmailPrefix = "sign_in_failures_email_"
+	signInFailuresIPPrefix    = "sign_in_failures_ip_"
+	signInBackoffPrefix       = "sign_in_backoff_"
+)
+
+var errSignInBackoff = errors.New("Too many failed sign ins, please wait before trying again")
+var errSignInIPBlocked = errors.New("Too many failed sign ins from this ip, please try again later")
+var errAccountLocked = errors.New("This account is locked after too many failed sign ins, check your email to unlock it")
+
+// signInRefused is returned when a sign in is not allowed yet
+type signInRefused struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (r *signInRefused) Error() string {
+	return r.err.Error()
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureLockoutRoutes - Configure all the routes for locked accounts here
+func (s *Server) configureLockoutRoutes() {
+
+	// unlocks the account with the code from the email sent when it was locked
+	s.echo.POST("/auth/unlock-account/:email/:code", s.unlockAccount)
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// This route will unlock an account that was locked after too many failed sign ins
+func (s *Server) unlockAccount(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	email := c.Param("email")
+	code := c.Param("code")
+
+	token, err := s.findEmailAuthTokenForMode(ctx, code, email, emailAuthTokenModeUnlockAccount)
+	if err != nil {
+		return c.String(http.StatusNotFound, err.Error())
+	}
+
+	// the update by email would insert a user when the account was deleted since the email was sent
+	databaseUser, err := s.users.FindUserByEmail(ctx, token.Email)
+	if err == errNotFound {
+		return c.String(http.StatusNotFound, "No user found")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The account could not be unlocked")
+	}
+
+	err = s.users.UpdateUser(ctx, databaseUser.ID, bson.D{
+		{Key: "lockedUntil", Value: time.Time{}},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The account could not be unlocked")
+	}
+
+	s.resetSignInFailures(ctx, token.Email)
+
+	_, err = s.emailAuthTokens.DeleteEmailAuthTokensByMode(ctx, token.Email, emailAuthTokenModeUnlockAccount)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return c.JSON(http.StatusOK, "User account has been unlocked")
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// checkSignInAllowed returns a signInRefused error if this ip or email has to wait before signing in again
+func (s *Server) checkSignInAllowed(ctx context.Context, email string, ip string) error {
+	ipCtx, err := s.limiterStore.Peek(ctx, signInFailuresIPPrefix+ip, s.signInIPRate())
+	if err != nil {
+		return err
+	}
+	if ipCtx.Remaining == 0 {
+		return &signInRefused{err: errSignInIPBlocked, retryAfter: untilReset(ipCtx)}
+	}
+
+	// the backoff is a counter of 1 that expires when the wait is over
+	backoffCtx, err := s.limiterStore.Peek(ctx, signInBackoffPrefix+signInEmailKey(email), limiter.Rate{Period: time.Second, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if backoffCtx.Remaining == 0 {
+		return &signInRefused{err: errSignInBackoff, retryAfter: untilReset(backoffCtx)}
+	}
+
+	return nil
+}
+
+// checkAccountLocked returns a signInRefused error if the account is locked
+func checkAccountLocked(user *DatabaseUser) error {
+	if wait := time.Until(user.LockedUntil); wait > 0 {
+		return &signInRefused{err: errAccountLocked, retryAfter: wait}
+	}
+	return nil
+}
+
+// recordSignInFailure counts the failed sign in for the email and the ip, and either makes the email wait
+// before the next try or locks the account once it failed too many times. user is nil when no account
+// has this email.
+func (s *Server) recordSignInFailure(ctx context.Context, email string, ip string, user *DatabaseUser) error {
+	_, err := s.limiterStore.Get(ctx, signInFailuresIPPrefix+ip, s.signInIPRate())
+	if err != nil {
+		return err
+	}
+
+	emailRate := s.signInEmailRate()
+	emailCtx, err := s.limiterStore.Get(ctx, signInFailuresEmailPrefix+signInEmailKey(email), emailRate)
+	if err != nil {
+		return err
+	}
+
+	if emailCtx.Remaining == 0 && user != nil {
+		return s.lockAccount(ctx, user)
+	}
+
+	wait := signInBackoff(emailRate.Limit-emailCtx.Remaining, s.config.SignInBackoffBase, s.config.SignInBackoffMax)
+	if wait <= 0 {
+		return nil
+	}
+
+	backoffRate := limiter.Rate{Period: wait, Limit: 1}
+	backoffKey := signInBackoffPrefix + signInEmailKey(email)
+	if _, err := s.limiterStore.Reset(ctx, backoffKey, backoffRate); err != nil {
+		return err
+	}
+	_, err = s.limiterStore.Get(ctx, backoffKey, backoffRate)
+	return err
+}
+
+// resetSignInFailures forgets the failed sign ins of the email, the ip keeps its count
+// so it can not be cleared by signing in to an account the attacker owns
+func (s *Server) resetSignInFailures(ctx context.Context, email string) {
+	key := signInEmailKey(email)
+
+	if _, err := s.limiterStore.Reset(ctx, signInFailuresEmailPrefix+key, s.signInEmailRate()); err != nil {
+		fmt.Println(err)
+	}
+	if _, err := s.limiterStore.Reset(ctx, signInBackoffPrefix+key, limiter.Rate{Period: time.Second, Limit: 1}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// lockAccount locks the account for SIGN_IN_LOCKOUT seconds and sends the unlock email
+func (s *Server) lockAccount(ctx context.Context, user *DatabaseUser) error {
+	lockout := time.Duration(s.config.SignInLockout) * time.Second
+
+	err := s.users.UpdateUser(ctx, user.ID, bson.D{
+		{Key: "lockedUntil", Value: time.Now().UTC().Add(lockout)},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the lockout takes over from here so the email starts from 0 once it is over
+	s.resetSignInFailures(ctx, user.Email)
+
+	// only the link in the latest email can unlock the account
+	_, err = s.emailAuthTokens.DeleteEmailAuthTokensByMode(ctx, user.Email, emailAuthTokenModeUnlockAccount)
+	if err != nil {
+		return err
+	}
+
+	token, err := generateEmailAuthToken(user.Email, 0, 0, 1, true, emailAuthTokenModeUnlockAccount)
+	if err != nil {
+		return err
+	}
+	token.UserID = user.ID.Hex()
+
+	err = s.addEmailAuthTokenToDatabase(token)
+	if err != nil {
+		return err
+	}
+
+	err = s.sendEmail(SendEmail{
+		RecipientEmail:   user.Email,
+		RecipientName:    user.FirstName,
+		SenderEmail:      "contact@domain.com",
+		SenderName:       "Domain",
+		Subject:          "Your Account Has Been Locked",
+		PlainTextContent: "Your account was locked after too many failed sign ins, click this link to unlock it. If this was not you then please reset your password. ",
+		HTMLContent:      "",
+		Template:         emailAuthTokenModeUnlockAccount,
+		Code:             token.Code,
+	})
+	if err != nil {
+		fmt.Println("error at send unlock account email")
+		return err
+	}
+
+	return &signInRefused{err: errAccountLocked, retryAfter: lockout}
+}
+
+func (s *Server) signInEmailRate() limiter.Rate {
+	return limiter.Rate{
+		Period: time.Duration(s.config.SignInFailureWindow) * time.Second,
+		Limit:  int64(s.config.SignInMaxFailures),
+	}
+}
+
+func (s *Server) signInIPRate() limiter.Rate {
+	return limiter.Rate{
+		Period: time.Duration(s.config.SignInFailureWindow) * time.Second,
+		Limit:  int64(s.config.SignInMaxIPFailures),
+	}
+}
+
+// signInEmailKey makes sure the same email in a different case is counted together
+func signInEmailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// signInBackoff returns how long to wait after this many failures, base * 2^(failures-1) up to max seconds
+func signInBackoff(failures int64, base int, max int) time.Duration {
+	if failures <= 0 || base <= 0 {
+		return 0
+	}
+
+	wait := time.Duration(base) * time.Second
+	limit := time.Duration(max) * time.Second
+	for i := int64(1); i < failures && wait < limit; i++ {
+		wait *= 2
+	}
+	if wait > limit {
+		wait = limit
+	}
+	return wait
+}
+
+// untilReset returns the time left until the limiter counter expires
+func untilReset(limiterCtx limiter.Context) time.Duration {
+	return time.Until(time.Unix(limiterCtx.Reset, 0))
+}
+
+// tooManyRequests answers with 429 and tells the client how many seconds to wait in Retry-After
+func tooManyRequests(c echo.Context, retryAfter time.Duration, message string) error {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	return c.JSON(http.StatusTooManyRequests, echo.Map{
+		"success": false,
+		"message": message,
+	})
+}
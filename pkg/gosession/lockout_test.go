@@ -0,0 +1,122 @@
+package gosession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// expectRetryAfter fails the test if the response is not a 429 with a Retry-After header
+func expectRetryAfter(t *testing.T, rec *httptest.ResponseRecorder) int {
+	t.Helper()
+
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	seconds, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		t.Fatalf("expected a Retry-After in seconds but got %q", rec.Header().Get("Retry-After"))
+	}
+	return seconds
+}
+
+func TestSignInBackoff(t *testing.T) {
+	server := newTestServer(t, func(config *ConfigApplication) {
+		config.SignInBackoffBase = 1
+		config.SignInBackoffMax = 1
+	})
+
+	email := uniqueEmail("backoff")
+	password := "password1234"
+	insertUser(t, server, email, password, "user")
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: "wrongpassword"}, server: server}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	// even the right password has to wait
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}, server: server}.do(t)
+	expectRetryAfter(t, rec)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}, server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestSignInBackoffDoubles(t *testing.T) {
+	waits := []time.Duration{}
+	for failures := int64(1); failures <= 5; failures++ {
+		waits = append(waits, signInBackoff(failures, 1, 10))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}
+	for i := range want {
+		if waits[i] != want[i] {
+			t.Fatalf("expected the waits %v but got %v", want, waits)
+		}
+	}
+	if signInBackoff(3, 0, 10) != 0 {
+		t.Fatal("expected no wait when the backoff is turned off")
+	}
+}
+
+func TestAccountLockedAfterTooManyFailures(t *testing.T) {
+	email := uniqueEmail("lockout")
+	password := "password1234"
+	ip := unique("10.1.5.")
+	registerAndConfirm(t, email, password)
+
+	for i := 1; i < testServer.config.SignInMaxFailures; i++ {
+		rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: "wrongpassword"}, ip: ip}.do(t)
+		expectStatus(t, rec, http.StatusNotAcceptable)
+	}
+
+	// the last failure locks the account and sends the unlock email
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: "wrongpassword"}, ip: ip}.do(t)
+	if seconds := expectRetryAfter(t, rec); seconds > testServer.config.SignInLockout {
+		t.Fatalf("expected to wait at most the lockout but got %d seconds", seconds)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}, ip: ip}.do(t)
+	expectRetryAfter(t, rec)
+
+	unlockEmail := emailService.lastEmailTo(t, email)
+	if unlockEmail.Template != emailAuthTokenModeUnlockAccount {
+		t.Fatalf("expected the unlock email but got %s", unlockEmail.Template)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/unlock-account/" + email + "/wrongcode"}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/unlock-account/" + email + "/" + unlockEmail.Code}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	signInAs(t, email, password)
+
+	// the code can only be used once
+	rec = testRequest{method: http.MethodPost, path: "/auth/unlock-account/" + email + "/" + unlockEmail.Code}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestSignInBlockedForIPAfterTooManyFailures(t *testing.T) {
+	server := newTestServer(t, func(config *ConfigApplication) {
+		config.SignInMaxIPFailures = 2
+	})
+
+	email := uniqueEmail("ip-block")
+	password := "password1234"
+	insertUser(t, server, email, password, "user")
+	ip := unique("10.1.6.")
+
+	// failures on emails that do not exist count towards the ip as well
+	for i := 0; i < 2; i++ {
+		rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: uniqueEmail("unknown"), Password: "wrongpassword"}, ip: ip, server: server}.do(t)
+		expectStatus(t, rec, http.StatusNotAcceptable)
+	}
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}, ip: ip, server: server}.do(t)
+	expectRetryAfter(t, rec)
+
+	// another ip can still sign in to the account
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}, ip: unique("10.1.6."), server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+}
@@ -0,0 +1,85 @@
+package gosession
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+/*
+	MAILER SYSTEM
+
+	The mailer sends the emails of the authentication system.
+	By default the emails are posted to the email service which renders the template
+	and sends them. Another mailer can be passed in with WithMailer.
+
+*/
+
+// Mailer sends the emails of the authentication system
+type Mailer interface {
+	SendEmail(email SendEmail) error
+}
+
+// EmailServiceMailer posts the emails to the email service
+type EmailServiceMailer struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewEmailServiceMailer returns a mailer that posts to the email service listening on url
+func NewEmailServiceMailer(url string) *EmailServiceMailer {
+	return &EmailServiceMailer{
+		URL:    url,
+		Client: &http.Client{},
+	}
+}
+
+// SendEmail posts the email to the route of the email service for its template
+func (m *EmailServiceMailer) SendEmail(email SendEmail) error {
+
+	var endpoint = ""
+	if email.Template == "CONFIRM_ACCOUNT" {
+		endpoint = m.URL + "/auth/confirm-account"
+	} else if email.Template == "RESET_PASSWORD" {
+		endpoint = m.URL + "/auth/reset-password"
+	} else if email.Template == "CHANGE_EMAIL" {
+		endpoint = m.URL + "/auth/change-email"
+	} else if email.Template == "UNDO_CHANGE_EMAIL" {
+		endpoint = m.URL + "/auth/undo-change-email"
+	} else if email.Template == "UNLOCK_ACCOUNT" {
+		endpoint = m.URL + "/auth/unlock-account"
+	} else {
+		return errors.New("No valid template option supplied")
+	}
+
+	byteInfo, err := json.Marshal(email)
+	if err != nil {
+		fmt.Println(err)
+		return errors.New(err.Error())
+	}
+
+	resp, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(byteInfo))
+	if err != nil {
+		fmt.Println(err)
+		return errors.New(err.Error())
+	}
+
+	newResp, err := m.Client.Do(resp)
+	if err != nil {
+		fmt.Println(err)
+		return errors.New(err.Error())
+	}
+
+	defer newResp.Body.Close()
+	body, err := ioutil.ReadAll(newResp.Body)
+	if err != nil {
+		fmt.Println(string(body))
+		fmt.Println(err)
+		return errors.New(err.Error())
+	}
+	return nil
+
+}
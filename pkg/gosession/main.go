@@ -0,0 +1,294 @@
+package gosession
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ulule/limiter/v3"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+var v = validator.New()
+
+// Server is the session service, it can be started on its own with Start or
+// mounted on another server as an http.Handler
+type Server struct {
+	echo   *echo.Echo
+	config ConfigApplication
+
+	sessions     SessionStore
+	limiterStore limiter.Store
+
+	users           UserRepository
+	emailAuthTokens EmailAuthTokenRepository
+	posts           PostRepository
+	oidcClients     OIDCClientRepository
+
+	mailer Mailer
+
+	accounts *accountCache
+
+	oidc       *oidcProvider
+	signingKey *signingKey
+
+	policySource     PolicySource
+	rbac             *rbacEngine
+	stopPolicyReload chan struct{}
+
+	// the connections opened by the server, these are nil when the store was passed in
+	mongo        *MongoInstance
+	redisLimiter *RedisLimiterInstance
+	redisSession *RedisSessionInstance
+
+	hasConfig bool
+}
+
+// Option configures the server created by New
+type Option func(s *Server)
+
+// WithConfig uses this config instead of loading it from the config.env file,
+// start from DefaultConfig to only change some of the values
+func WithConfig(config ConfigApplication) Option {
+	return func(s *Server) {
+		s.config = config
+		s.hasConfig = true
+	}
+}
+
+// WithEcho registers the routes and middlewares on this echo instance
+func WithEcho(e *echo.Echo) Option {
+	return func(s *Server) {
+		s.echo = e
+	}
+}
+
+// WithSessionStore uses this session store instead of the one selected in the config
+func WithSessionStore(store SessionStore) Option {
+	return func(s *Server) {
+		s.sessions = store
+	}
+}
+
+// WithLimiterStore uses this rate limiter store instead of the one selected in the config
+func WithLimiterStore(store limiter.Store) Option {
+	return func(s *Server) {
+		s.limiterStore = store
+	}
+}
+
+// WithUserRepository uses this repository for the users
+func WithUserRepository(users UserRepository) Option {
+	return func(s *Server) {
+		s.users = users
+	}
+}
+
+// WithEmailAuthTokenRepository uses this repository for the email auth tokens
+func WithEmailAuthTokenRepository(tokens EmailAuthTokenRepository) Option {
+	return func(s *Server) {
+		s.emailAuthTokens = tokens
+	}
+}
+
+// WithPostRepository uses this repository for the posts
+func WithPostRepository(posts PostRepository) Option {
+	return func(s *Server) {
+		s.posts = posts
+	}
+}
+
+// WithOIDCClientRepository uses this repository for the clients of the OpenID Connect provider
+func WithOIDCClientRepository(clients OIDCClientRepository) Option {
+	return func(s *Server) {
+		s.oidcClients = clients
+	}
+}
+
+// WithMailer uses this mailer to send the emails instead of the email service
+func WithMailer(mailer Mailer) Option {
+	return func(s *Server) {
+		s.mailer = mailer
+	}
+}
+
+// WithPolicySource loads the rbac policy from this source instead of the one selected in the config
+func WithPolicySource(source PolicySource) Option {
+	return func(s *Server) {
+		s.policySource = source
+	}
+}
+
+// New creates the server, any store that was not passed in as an option
+// is connected to using the config
+func New(opts ...Option) (*Server, error) {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if !s.hasConfig {
+		config, err := LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+		s.config = config
+	} else {
+		err := s.config.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.echo == nil {
+		s.echo = echo.New()
+	}
+	if s.mailer == nil {
+		s.mailer = NewEmailServiceMailer(s.config.EmailServiceURL)
+	}
+
+	s.accounts = newAccountCache(time.Duration(s.config.AccountCacheTTL) * time.Second)
+
+	// the clients that were already connected are closed when the server can not be made
+	err := s.configureDatabases()
+	if err != nil {
+		s.closeDatabases(context.Background())
+		return nil, err
+	}
+
+	err = s.configureRBAC()
+	if err != nil {
+		s.closeDatabases(context.Background())
+		return nil, err
+	}
+
+	err = s.configureSigningKey()
+	if err != nil {
+		s.closeDatabases(context.Background())
+		return nil, err
+	}
+
+	// TODO can we make this private?
+	s.echo.Static("/", "public")
+
+	// Configure Middlewares
+	s.configureDefaultMiddlewares()
+
+	// Configure Routes
+	s.configureRoutes()
+
+	return s, nil
+}
+
+// Start - Starts the server on the port from the config
+func (s *Server) Start() error {
+	return s.echo.Start(fmt.Sprintf(s.config.AppEnv+":%s", s.config.Port))
+}
+
+// Run starts the server and blocks until SIGINT or SIGTERM is received,
+// the in flight requests then have SHUTDOWN_TIMEOUT seconds to finish before the server is stopped
+func (s *Server) Run() error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Start()
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	select {
+	case err := <-errs:
+		if err != http.ErrServerClosed {
+			s.closeDatabases(context.Background())
+			return err
+		}
+		return nil
+	case sig := <-quit:
+		fmt.Println("received signal, shutting down: ", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	return s.Shutdown(ctx)
+}
+
+// Shutdown stops accepting requests, waits for the in flight requests to finish
+// until ctx is done and then closes the connections opened by the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.stopPolicyReload != nil {
+		close(s.stopPolicyReload)
+		s.stopPolicyReload = nil
+	}
+
+	err := s.echo.Shutdown(ctx)
+	if err != nil {
+		fmt.Println("failed draining the requests: ", err)
+	}
+
+	closeErr := s.closeDatabases(ctx)
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// ServeHTTP lets the server be mounted on another server
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.echo.ServeHTTP(w, r)
+}
+
+// Echo returns the echo instance the routes are registered on
+func (s *Server) Echo() *echo.Echo {
+	return s.echo
+}
+
+// configureDatabase will setup the stores that were not passed in as options
+func (s *Server) configureDatabases() error {
+	if s.users == nil || s.emailAuthTokens == nil || s.posts == nil || s.oidcClients == nil {
+		err := s.connectToDatabaseStore()
+		if err != nil {
+			return err
+		}
+	}
+	if s.limiterStore == nil {
+		err := s.connectToLimiterStore()
+		if err != nil {
+			return err
+		}
+	}
+	if s.sessions == nil {
+		err := s.connectToSessionStore()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfigureRoutes will make calls to configure all the different routes for fiber
+func (s *Server) configureRoutes() {
+
+	s.configureDefaultRoutes()
+	s.configureHealthRoutes()
+	s.configureUserRoutes()
+	s.configureAuthenticationRoutes()
+	s.configureLockoutRoutes()
+	s.configureTOTPRoutes()
+	s.configurePasskeyRoutes()
+	s.configureOIDCRoutes()
+	s.configureOIDCProviderRoutes()
+	s.configureJWKSRoutes()
+	s.configureAccessTokenRoutes()
+	s.configureChangeEmailRoutes()
+	s.configureSessionRoutes()
+	s.configureCSRFRoutes()
+	s.configureRBACRoutes()
+	s.configureAccountRoutes()
+	s.configureS3Routes()
+}
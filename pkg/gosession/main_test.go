@@ -0,0 +1,299 @@
+package gosession
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeEmailService records the emails that would have been sent by the email service
+type fakeEmailService struct {
+	mu     sync.Mutex
+	emails []SendEmail
+}
+
+func (f *fakeEmailService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var email SendEmail
+	if err := json.NewDecoder(r.Body).Decode(&email); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.emails = append(f.emails, email)
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// lastEmailTo returns the last email that was sent to this address
+func (f *fakeEmailService) lastEmailTo(t *testing.T, recipient string) SendEmail {
+	t.Helper()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := len(f.emails) - 1; i >= 0; i-- {
+		if f.emails[i].RecipientEmail == recipient {
+			return f.emails[i]
+		}
+	}
+	t.Fatalf("no email was sent to %s", recipient)
+	return SendEmail{}
+}
+
+var emailService = &fakeEmailService{}
+
+// testServer is the server the tests send their requests to
+var testServer *Server
+
+// TestMain runs the tests against the memory stores and a fake email service
+// so they do not need mongo, redis or the network
+func TestMain(m *testing.M) {
+	emailServer := httptest.NewServer(emailService)
+
+	var err error
+	testServer, err = New(
+		WithConfig(memoryConfig()),
+		WithMailer(NewEmailServiceMailer(emailServer.URL)),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+
+	emailServer.Close()
+	os.Exit(code)
+}
+
+// memoryConfig is the default config with every store kept in memory
+func memoryConfig() ConfigApplication {
+	config := DefaultConfig()
+	config.AppName = "gosession-test"
+	config.SessionStore = SessionStoreMemory
+	config.LimiterStore = SessionStoreMemory
+	config.DBStore = DatabaseStoreMemory
+	// the tests sign in straight after a wrong password, lockout_test.go turns it back on
+	config.SignInBackoffBase = 0
+	return config
+}
+
+// newTestServer returns a server with every store kept in memory, configure changes the config
+// before the server is made and can be nil
+func newTestServer(t *testing.T, configure func(config *ConfigApplication), options ...Option) *Server {
+	t.Helper()
+
+	config := memoryConfig()
+	if configure != nil {
+		configure(&config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := New(append([]Option{WithConfig(config)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+	return server
+}
+
+// insertUser adds a confirmed user with this password and role straight to the database of the server,
+// it is how the tests get an admin as there is no route to make one
+func insertUser(t *testing.T, server *Server, email string, password string, role string) primitive.ObjectID {
+	t.Helper()
+
+	id, err := server.users.InsertUser(context.Background(), SubmitNewUser{
+		Email:          email,
+		HashedPassword: hashAndSalt([]byte(password)),
+		CreatedAt:      time.Now().UTC(),
+		Role:           role,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// signInOn signs in on the server and returns the session cookie
+func signInOn(t *testing.T, server *Server, email string, password string) *http.Cookie {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", server: server, body: SignInUser{
+		Email:    email,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	return sessionCookie(t, rec)
+}
+
+// signInAs signs in on the test server and returns the session cookie
+func signInAs(t *testing.T, email string, password string) *http.Cookie {
+	t.Helper()
+
+	return signInOn(t, testServer, email, password)
+}
+
+// testRequest is a request made against the configured echo instance
+type testRequest struct {
+	method  string
+	path    string
+	body    interface{}
+	ip      string
+	cookies []*http.Cookie
+	// server is the server the request is sent to, the test server is used when it is nil
+	server *Server
+	// withoutCSRF sends the request without the csrf token of the session, like another site would
+	withoutCSRF bool
+	headers     map[string]string
+}
+
+// do sends the request and returns the recorded response
+func (r testRequest) do(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	if r.body != nil {
+		if err := json.NewEncoder(&body).Encode(r.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(r.method, r.path, &body)
+	req.Header.Set("Content-Type", "application/json")
+	if r.ip != "" {
+		req.Header.Set("X-Real-IP", r.ip)
+	}
+	for _, cookie := range r.cookies {
+		req.AddCookie(cookie)
+	}
+	for name, value := range r.headers {
+		req.Header.Set(name, value)
+	}
+
+	server := r.server
+	if server == nil {
+		server = testServer
+	}
+
+	// like the app, get the csrf token of the session before changing anything with its cookie
+	if len(r.cookies) > 0 && r.method != http.MethodGet && !r.withoutCSRF {
+		req.Header.Set(csrfHeader, csrfTokenFor(server, r.cookies))
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+// csrfTokenFor returns the csrf token of the session of the cookies
+func csrfTokenFor(server *Server, cookies []*http.Cookie) string {
+	req := httptest.NewRequest(http.MethodGet, "/auth/csrf-token", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec.Header().Get(csrfHeader)
+}
+
+// sessionCookie returns the session cookie that was set on the response
+func sessionCookie(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+
+	// the session can be saved more than once, like the browser the last cookie is kept
+	var last *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionName {
+			last = cookie
+		}
+	}
+	if last == nil {
+		t.Fatalf("no session cookie was set, status %d: %s", rec.Code, rec.Body.String())
+	}
+	return last
+}
+
+// expectStatus fails the test if the response does not have the wanted status
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if rec.Code != want {
+		body, _ := ioutil.ReadAll(rec.Result().Body)
+		t.Fatalf("expected status %d but got %d: %s", want, rec.Code, string(body))
+	}
+}
+
+var uniqueCounter int64
+
+// unique appends a number to the name that is unique for this test binary,
+// so the tests can be run more than once against the same memory stores
+func unique(name string) string {
+	return name + strconv.FormatInt(atomic.AddInt64(&uniqueCounter, 1), 10)
+}
+
+// uniqueEmail returns an email address that has not been registered yet
+func uniqueEmail(name string) string {
+	return unique(name) + "@domain.com"
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	server := newTestServer(t, nil)
+
+	started := make(chan struct{})
+	server.Echo().GET("/slow", func(c echo.Context) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return c.String(http.StatusOK, "done")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Echo().Listener = listener
+	go server.Start()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	resp := <-responses
+	if resp == nil {
+		t.Fatal("the in flight request was dropped")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+}
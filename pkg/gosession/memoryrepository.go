@@ -0,0 +1,855 @@
+package gosession
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	MEMORY REPOSITORY
+
+	The memory repositories keep the documents of each collection in memory.
+	Documents are converted to bson when they are stored and read so they behave
+	the same way as the documents in mongo, including the bson struct tags.
+	Only the query operators and pipeline stages that the repositories and the
+	filters system use are supported.
+
+*/
+
+// NewMemoryUserRepository returns a user repository backed by a new empty memory collection
+func NewMemoryUserRepository() UserRepository {
+	return &memoryUserRepository{collection: newMemoryCollection("email", "passkeys.id")}
+}
+
+// NewMemoryEmailAuthTokenRepository returns an email auth token repository backed by a new empty memory collection
+func NewMemoryEmailAuthTokenRepository() EmailAuthTokenRepository {
+	return &memoryEmailAuthTokenRepository{collection: newMemoryCollection()}
+}
+
+// NewMemoryPostRepository returns a post repository backed by a new empty memory collection
+func NewMemoryPostRepository() PostRepository {
+	return &memoryPostRepository{collection: newMemoryCollection()}
+}
+
+// NewMemoryOIDCClientRepository returns an OpenID Connect client repository backed by a new empty memory collection
+func NewMemoryOIDCClientRepository() OIDCClientRepository {
+	return &memoryOIDCClientRepository{collection: newMemoryCollection()}
+}
+
+// MEMORY USER REPOSITORY --------------------------------------------------------------------------
+
+type memoryUserRepository struct {
+	collection *memoryCollection
+}
+
+func (r *memoryUserRepository) InsertUser(ctx context.Context, user SubmitNewUser) (primitive.ObjectID, error) {
+	return r.collection.insertOne(user)
+}
+
+func (r *memoryUserRepository) FindUserByID(ctx context.Context, id primitive.ObjectID) (*DatabaseUser, error) {
+	var user DatabaseUser
+	if err := r.collection.findOne(bson.M{"_id": id}, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *memoryUserRepository) FindUserByEmail(ctx context.Context, email string) (*DatabaseUser, error) {
+	var user DatabaseUser
+	if err := r.collection.findOne(bson.M{"email": email}, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *memoryUserRepository) FindUserByIdentity(ctx context.Context, provider string, subject string) (*DatabaseUser, error) {
+	var user DatabaseUser
+	if err := r.collection.findOne(identityQuery(provider, subject), &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *memoryUserRepository) FindUsers(ctx context.Context, pipeline []bson.M) ([]*ExistingUser, error) {
+	docs, err := r.collection.aggregate(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*ExistingUser
+	for _, doc := range docs {
+		var user ExistingUser
+		if err := decodeMemoryDocument(doc, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+func (r *memoryUserRepository) UpdateUser(ctx context.Context, id primitive.ObjectID, fields bson.D) error {
+	_, err := r.collection.updateOne(bson.M{"_id": id}, bson.M{"$set": fields})
+	return err
+}
+
+func (r *memoryUserRepository) UpdateUserByEmail(ctx context.Context, email string, fields bson.D) (*DatabaseUser, error) {
+	before, err := r.collection.updateOne(bson.M{"email": email}, bson.M{"$set": fields})
+	if err == errNotFound {
+		// like the upsert in mongo, which returns no document from before the insert
+		doc := bson.M{"email": email}
+		for _, field := range fields {
+			doc[field.Key] = field.Value
+		}
+		if _, err := r.collection.insertOne(doc); err != nil {
+			return nil, err
+		}
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var user DatabaseUser
+	if err := decodeMemoryDocument(before, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *memoryUserRepository) UpdateTOTPLastStep(ctx context.Context, id primitive.ObjectID, step int64) error {
+	_, err := r.collection.updateOne(bson.M{"_id": id, "$or": totpLastStepBefore(step)}, bson.M{"$set": bson.M{"totpLastStep": step}})
+	return err
+}
+
+func (r *memoryUserRepository) RemoveRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) error {
+	_, err := r.collection.updateOne(bson.M{"_id": id, "recoveryCodes": hash}, bson.M{"$pull": bson.M{"recoveryCodes": hash}})
+	return err
+}
+
+func (r *memoryUserRepository) AddPasskey(ctx context.Context, id primitive.ObjectID, passkey Passkey) error {
+	_, err := r.collection.updateOne(bson.M{"_id": id, "passkeys.id": bson.M{"$ne": passkey.ID}}, bson.M{
+		"$push": bson.M{"passkeys": passkey},
+		"$set":  bson.M{"updatedAt": time.Now().UTC()},
+	})
+	return err
+}
+
+func (r *memoryUserRepository) UpdatePasskeySignCount(ctx context.Context, id primitive.ObjectID, credentialID string, signCount int64, usedAt time.Time) error {
+	_, err := r.collection.updateOne(bson.M{"_id": id, "passkeys": passkeySignCountBefore(credentialID, signCount)}, bson.M{
+		"$set": bson.M{
+			"passkeys.$[passkey].signCount":  signCount,
+			"passkeys.$[passkey].lastUsedAt": usedAt,
+		},
+	}, bson.M{"passkey.id": credentialID})
+	return err
+}
+
+func (r *memoryUserRepository) RemovePasskey(ctx context.Context, id primitive.ObjectID, credentialID string) error {
+	_, err := r.collection.updateOne(bson.M{"_id": id, "passkeys.id": credentialID}, bson.M{
+		"$pull": bson.M{"passkeys": bson.M{"id": credentialID}},
+		"$set":  bson.M{"updatedAt": time.Now().UTC()},
+	})
+	return err
+}
+
+func (r *memoryUserRepository) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	if r.collection.deleteMany(bson.M{"_id": id}, 1) < 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+// MEMORY EMAIL AUTH TOKEN REPOSITORY --------------------------------------------------------------------------
+
+type memoryEmailAuthTokenRepository struct {
+	collection *memoryCollection
+}
+
+func (r *memoryEmailAuthTokenRepository) InsertEmailAuthToken(ctx context.Context, token EmailAuthToken) error {
+	_, err := r.collection.insertOne(token)
+	return err
+}
+
+func (r *memoryEmailAuthTokenRepository) FindEmailAuthToken(ctx context.Context, code string) (*EmailAuthToken, error) {
+	var token EmailAuthToken
+	if err := r.collection.findOne(bson.M{"code": code}, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *memoryEmailAuthTokenRepository) DeleteEmailAuthToken(ctx context.Context, email string, code string) error {
+	if r.collection.deleteMany(bson.M{"email": email, "code": code}, 1) < 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *memoryEmailAuthTokenRepository) DeleteEmailAuthTokensByMode(ctx context.Context, email string, mode string) (int64, error) {
+	return r.collection.deleteMany(bson.M{"email": email, "mode": mode}, 0), nil
+}
+
+func (r *memoryEmailAuthTokenRepository) DeleteEmailAuthTokensByUser(ctx context.Context, userID string, mode string) (int64, error) {
+	return r.collection.deleteMany(bson.M{"userID": userID, "mode": mode}, 0), nil
+}
+
+// MEMORY POST REPOSITORY --------------------------------------------------------------------------
+
+type memoryPostRepository struct {
+	collection *memoryCollection
+}
+
+func (r *memoryPostRepository) InsertPost(ctx context.Context, post DatabasePost) (primitive.ObjectID, error) {
+	return r.collection.insertOne(post)
+}
+
+func (r *memoryPostRepository) FindPostByID(ctx context.Context, id primitive.ObjectID) (*ReturnedPost, error) {
+	var post ReturnedPost
+	if err := r.collection.findOne(bson.M{"_id": id}, &post); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+func (r *memoryPostRepository) FindPosts(ctx context.Context, afterID primitive.ObjectID, limit int64) ([]ReturnedPost, error) {
+	query := bson.M{}
+	if !afterID.IsZero() {
+		query = bson.M{"_id": bson.M{"$gt": afterID}}
+	}
+
+	// object ids start with their creation time so sorting by id sorts by creation
+	docs := r.collection.find(query)
+	sort.Slice(docs, func(i, j int) bool {
+		a, _ := docs[i]["_id"].(primitive.ObjectID)
+		b, _ := docs[j]["_id"].(primitive.ObjectID)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+	if limit > 0 && int64(len(docs)) > limit {
+		docs = docs[:limit]
+	}
+
+	var posts []ReturnedPost
+	for _, doc := range docs {
+		var post ReturnedPost
+		if err := decodeMemoryDocument(doc, &post); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// MEMORY OIDC CLIENT REPOSITORY --------------------------------------------------------------------------
+
+type memoryOIDCClientRepository struct {
+	collection *memoryCollection
+}
+
+func (r *memoryOIDCClientRepository) InsertOIDCClient(ctx context.Context, client OIDCClient) (primitive.ObjectID, error) {
+	return r.collection.insertOne(client)
+}
+
+func (r *memoryOIDCClientRepository) FindOIDCClient(ctx context.Context, clientID string) (*OIDCClient, error) {
+	var client OIDCClient
+	if err := r.collection.findOne(bson.M{"clientID": clientID}, &client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *memoryOIDCClientRepository) FindOIDCClients(ctx context.Context) ([]OIDCClient, error) {
+	var clients []OIDCClient
+	for _, doc := range r.collection.find(bson.M{}) {
+		var client OIDCClient
+		if err := decodeMemoryDocument(doc, &client); err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func (r *memoryOIDCClientRepository) DeleteOIDCClient(ctx context.Context, clientID string) error {
+	if r.collection.deleteMany(bson.M{"clientID": clientID}, 1) < 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+// MEMORY COLLECTION --------------------------------------------------------------------------
+
+// memoryCollection is a list of bson documents that can be queried with mongo filters
+type memoryCollection struct {
+	mu   sync.Mutex
+	docs []bson.M
+	// unique are the fields that no two documents can share a value of, like a unique index in mongo
+	unique []string
+}
+
+func newMemoryCollection(unique ...string) *memoryCollection {
+	return &memoryCollection{unique: unique}
+}
+
+// insertOne stores the document and sets its _id if it does not have one
+func (m *memoryCollection) insertOne(document interface{}) (primitive.ObjectID, error) {
+	doc, err := toMemoryDocument(document)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	id, ok := doc["_id"].(primitive.ObjectID)
+	if !ok || id.IsZero() {
+		id = primitive.NewObjectID()
+		doc["_id"] = id
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sharesUniqueValue(doc, -1) {
+		return primitive.NilObjectID, errDuplicate
+	}
+	m.docs = append(m.docs, doc)
+	return id, nil
+}
+
+// findOne decodes the first document that matches the filter into out
+func (m *memoryCollection) findOne(filter bson.M, out interface{}) error {
+	docs := m.find(filter)
+	if len(docs) == 0 {
+		return errNotFound
+	}
+	return decodeMemoryDocument(docs[0], out)
+}
+
+// find returns copies of all the documents that match the filter
+func (m *memoryCollection) find(filter bson.M) []bson.M {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var found []bson.M
+	for _, doc := range m.docs {
+		if matchesMemoryFilter(doc, filter) {
+			found = append(found, copyMemoryDocument(doc))
+		}
+	}
+	return found
+}
+
+// aggregate runs the pipeline against all the documents, only $match, $skip and $limit stages are supported
+func (m *memoryCollection) aggregate(pipeline []bson.M) ([]bson.M, error) {
+	docs := m.find(bson.M{})
+
+	for _, stage := range pipeline {
+		for operator, value := range stage {
+			switch operator {
+			case "$match":
+				filter, ok := toMemoryFilter(value)
+				if !ok {
+					return nil, fmt.Errorf("memory repository: invalid $match stage %v", value)
+				}
+				var matched []bson.M
+				for _, doc := range docs {
+					if matchesMemoryFilter(doc, filter) {
+						matched = append(matched, doc)
+					}
+				}
+				docs = matched
+			case "$skip", "$limit":
+				n, ok := toMemoryNumber(value)
+				if !ok {
+					return nil, fmt.Errorf("memory repository: invalid %s stage %v", operator, value)
+				}
+				count := int(n)
+				if count > len(docs) {
+					count = len(docs)
+				}
+				if operator == "$skip" {
+					docs = docs[count:]
+				} else {
+					docs = docs[:count]
+				}
+			default:
+				return nil, fmt.Errorf("memory repository: the %s stage is not supported", operator)
+			}
+		}
+	}
+
+	return docs, nil
+}
+
+// updateOne applies the update to the first document that matches the filter and returns it from before the update.
+// The $set, $unset, $push and $pull operators are supported, $set also takes the array$[name].field keys of the
+// array filters.
+func (m *memoryCollection) updateOne(filter bson.M, update bson.M, arrayFilters ...bson.M) (bson.M, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, doc := range m.docs {
+		if !matchesMemoryFilter(doc, filter) {
+			continue
+		}
+
+		before := copyMemoryDocument(doc)
+		updated := copyMemoryDocument(doc)
+		for operator, value := range update {
+			fields, err := toMemoryDocument(bson.M{"fields": value})
+			if err != nil {
+				return nil, err
+			}
+			values, ok := fields["fields"].(bson.M)
+			if !ok {
+				return nil, fmt.Errorf("memory repository: invalid %s update %v", operator, value)
+			}
+
+			for key, value := range values {
+				switch operator {
+				case "$set":
+					if !setMemoryArrayElements(updated, key, value, arrayFilters) {
+						updated[key] = value
+					}
+				case "$unset":
+					delete(updated, key)
+				case "$push":
+					array, _ := updated[key].(bson.A)
+					updated[key] = append(array, value)
+				case "$pull":
+					array, _ := updated[key].(bson.A)
+					kept := bson.A{}
+					for _, element := range array {
+						if !matchesMemoryValue(element, value) {
+							kept = append(kept, element)
+						}
+					}
+					updated[key] = kept
+				default:
+					return nil, fmt.Errorf("memory repository: the %s update operator is not supported", operator)
+				}
+			}
+		}
+
+		if m.sharesUniqueValue(updated, i) {
+			return nil, errDuplicate
+		}
+		m.docs[i] = updated
+		return before, nil
+	}
+
+	return nil, errNotFound
+}
+
+// deleteMany deletes up to limit documents that match the filter, 0 means no limit
+func (m *memoryCollection) deleteMany(filter bson.M, limit int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	kept := m.docs[:0]
+	for _, doc := range m.docs {
+		if (limit == 0 || deleted < limit) && matchesMemoryFilter(doc, filter) {
+			deleted++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	m.docs = kept
+
+	return deleted
+}
+
+// sharesUniqueValue checks if a document other than the one at skip has a value of a unique field of doc,
+// the lock must be held by the caller
+func (m *memoryCollection) sharesUniqueValue(doc bson.M, skip int) bool {
+	for _, key := range m.unique {
+		value, ok := lookupMemoryField(doc, key)
+		if !ok {
+			continue
+		}
+		values, isArray := toMemoryArray(value)
+		if !isArray {
+			values = []interface{}{value}
+		}
+
+		for i, other := range m.docs {
+			if i == skip {
+				continue
+			}
+			otherValue, ok := lookupMemoryField(other, key)
+			if !ok {
+				continue
+			}
+			for _, value := range values {
+				if matchesMemoryValue(otherValue, value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// setMemoryArrayElements sets a field of the array elements that match their array filter, for keys like
+// passkeys.$[passkey].signCount with the array filter {"passkey.id": id}. It returns false for other keys.
+func setMemoryArrayElements(doc bson.M, key string, value interface{}, arrayFilters []bson.M) bool {
+	start := strings.Index(key, ".$[")
+	if start < 0 {
+		return false
+	}
+	end := strings.Index(key[start:], "].")
+	if end < 0 {
+		return false
+	}
+	field, name, elementField := key[:start], key[start+len(".$["):start+end], key[start+end+len("]."):]
+
+	filter := bson.M{}
+	for _, arrayFilter := range arrayFilters {
+		for path, condition := range arrayFilter {
+			if strings.HasPrefix(path, name+".") {
+				filter[strings.TrimPrefix(path, name+".")] = condition
+			}
+		}
+	}
+
+	array, _ := doc[field].(bson.A)
+	for _, element := range array {
+		if sub, ok := element.(bson.M); ok && matchesMemoryFilter(sub, filter) {
+			sub[elementField] = value
+		}
+	}
+	return true
+}
+
+// DOCUMENT HELPERS --------------------------------------------------------------------------
+
+// toMemoryDocument converts a struct or map into a bson document the same way the mongo driver would
+func toMemoryDocument(document interface{}) (bson.M, error) {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+func decodeMemoryDocument(doc bson.M, out interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, out)
+}
+
+func copyMemoryDocument(doc bson.M) bson.M {
+	copied, err := toMemoryDocument(doc)
+	if err != nil {
+		return bson.M{}
+	}
+	return copied
+}
+
+// toMemoryFilter converts the value of a $match, $and or $elemMatch into a bson document
+func toMemoryFilter(value interface{}) (bson.M, bool) {
+	filter, err := toMemoryDocument(value)
+	return filter, err == nil
+}
+
+// FILTER MATCHING --------------------------------------------------------------------------
+
+// matchesMemoryFilter checks if the document matches every field of the filter
+func matchesMemoryFilter(doc bson.M, filter bson.M) bool {
+	for key, condition := range filter {
+		if key == "$and" {
+			conditions, ok := toMemoryArray(condition)
+			if !ok {
+				return false
+			}
+			for _, sub := range conditions {
+				subFilter, ok := toMemoryFilter(sub)
+				if !ok || !matchesMemoryFilter(doc, subFilter) {
+					return false
+				}
+			}
+			continue
+		}
+		if key == "$or" {
+			conditions, ok := toMemoryArray(condition)
+			if !ok {
+				return false
+			}
+			matched := false
+			for _, sub := range conditions {
+				if subFilter, ok := toMemoryFilter(sub); ok && matchesMemoryFilter(doc, subFilter) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+
+		value, exists := lookupMemoryField(doc, key)
+		if !matchesMemoryCondition(value, exists, condition) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesMemoryCondition checks a single field against either a value or an operator document
+func matchesMemoryCondition(value interface{}, exists bool, condition interface{}) bool {
+	operators, ok := toMemoryOperators(condition)
+	if !ok {
+		return exists && matchesMemoryValue(value, condition)
+	}
+
+	for operator, operand := range operators {
+		switch operator {
+		case "$eq":
+			if !exists || !matchesMemoryValue(value, operand) {
+				return false
+			}
+		case "$ne":
+			if exists && matchesMemoryValue(value, operand) {
+				return false
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if !exists {
+				return false
+			}
+			result, ok := compareMemoryValues(value, operand)
+			if !ok {
+				return false
+			}
+			if (operator == "$gt" && result <= 0) || (operator == "$gte" && result < 0) ||
+				(operator == "$lt" && result >= 0) || (operator == "$lte" && result > 0) {
+				return false
+			}
+		case "$in":
+			options, ok := toMemoryArray(operand)
+			if !ok || !exists {
+				return false
+			}
+			found := false
+			for _, option := range options {
+				if matchesMemoryValue(value, option) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case "$exists":
+			if want, _ := operand.(bool); want != exists {
+				return false
+			}
+		case "$elemMatch":
+			array, ok := toMemoryArray(value)
+			subFilter, isFilter := toMemoryFilter(operand)
+			if !ok || !isFilter {
+				return false
+			}
+			found := false
+			for _, element := range array {
+				if doc, isDoc := element.(bson.M); isDoc && matchesMemoryFilter(doc, subFilter) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchesMemoryValue compares two values, arrays match if any of their elements match
+func matchesMemoryValue(value interface{}, expected interface{}) bool {
+	if array, ok := toMemoryArray(value); ok {
+		if _, expectsArray := toMemoryArray(expected); !expectsArray {
+			for _, element := range array {
+				if matchesMemoryValue(element, expected) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	// sub documents are matched by their fields
+	if doc, ok := value.(bson.M); ok {
+		if filter, ok := expected.(bson.M); ok {
+			return matchesMemoryFilter(doc, filter)
+		}
+	}
+
+	if result, ok := compareMemoryValues(value, expected); ok {
+		return result == 0
+	}
+	return reflect.DeepEqual(normalizeMemoryValue(value), normalizeMemoryValue(expected))
+}
+
+// compareMemoryValues orders numbers, strings, dates and object ids
+func compareMemoryValues(a interface{}, b interface{}) (int, bool) {
+	a = normalizeMemoryValue(a)
+	b = normalizeMemoryValue(b)
+
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case primitive.ObjectID:
+		y, ok := b.(primitive.ObjectID)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare(x[:], y[:]), true
+	}
+	return 0, false
+}
+
+// normalizeMemoryValue converts numbers to float64 and dates to milliseconds
+func normalizeMemoryValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return float64(primitive.NewDateTimeFromTime(v))
+	case primitive.DateTime:
+		return float64(v)
+	case *time.Time:
+		return float64(primitive.NewDateTimeFromTime(*v))
+	case *string:
+		return *v
+	case *primitive.ObjectID:
+		return *v
+	}
+	if n, ok := toMemoryNumber(value); ok {
+		return n
+	}
+	return value
+}
+
+// lookupMemoryField follows a dotted path such as "subscriptions.0.premium" through the document
+func lookupMemoryField(doc bson.M, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case bson.M:
+			value, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case bson.A:
+			index, err := strconv.Atoi(part)
+			if err != nil {
+				// a field of an array of documents matches any of the documents
+				var values bson.A
+				for _, element := range node {
+					if sub, ok := element.(bson.M); ok {
+						if value, ok := sub[part]; ok {
+							values = append(values, value)
+						}
+					}
+				}
+				if len(values) == 0 {
+					return nil, false
+				}
+				current = values
+				continue
+			}
+			if index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// toMemoryOperators returns the condition as a document if all its keys are operators
+func toMemoryOperators(condition interface{}) (bson.M, bool) {
+	var operators bson.M
+	switch c := condition.(type) {
+	case bson.M:
+		operators = c
+	case bson.D:
+		operators = c.Map()
+	default:
+		return nil, false
+	}
+	if len(operators) == 0 {
+		return nil, false
+	}
+	for key := range operators {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return operators, true
+}
+
+func toMemoryArray(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case bson.A:
+		return v, true
+	case []interface{}:
+		return v, true
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	array := make([]interface{}, rv.Len())
+	for i := range array {
+		array[i] = rv.Index(i).Interface()
+	}
+	return array, true
+}
+
+func toMemoryNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
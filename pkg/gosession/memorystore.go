@@ -0,0 +1,365 @@
+package gosession
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/gob"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+/*
+	MEMORY SESSION STORE
+
+	The memory session store keeps everything in maps inside this process.
+	Entries expire the same way they do in redis, expired entries are ignored when read
+	and swept from the maps every so often when the store is written to.
+	Sessions are lost when the process stops and are not shared between instances,
+	so only use this for development and tests.
+
+*/
+
+// how often the expired entries are swept from the maps
+const memorySweepInterval = time.Minute
+
+type memoryEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+type memoryUserSession struct {
+	createdAt time.Time
+	expiresAt time.Time
+}
+
+type memoryInfo struct {
+	info      SessionInfo
+	expiresAt time.Time
+}
+
+// MemorySessionStore is a SessionStore that keeps the sessions in memory
+type MemorySessionStore struct {
+	mu           sync.Mutex
+	options      sessions.Options
+	sessions     map[string]memoryEntry
+	userSessions map[string]map[string]memoryUserSession
+	infos        map[string]memoryInfo
+	temporaries  map[string]memoryEntry
+	lastSweep    time.Time
+}
+
+// NewMemorySessionStore returns a new memory session store with the default session options
+func NewMemorySessionStore(options sessions.Options) *MemorySessionStore {
+	return &MemorySessionStore{
+		options:      options,
+		sessions:     map[string]memoryEntry{},
+		userSessions: map[string]map[string]memoryUserSession{},
+		infos:        map[string]memoryInfo{},
+		temporaries:  map[string]memoryEntry{},
+		lastSweep:    time.Now(),
+	}
+}
+
+// Get returns the session for the given name after adding it to the registry
+func (m *MemorySessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(m, name)
+}
+
+// New returns the session for the given name without adding it to the registry
+func (m *MemorySessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(m, name)
+	opts := m.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	session.ID = cookie.Value
+
+	m.mu.Lock()
+	entry, ok := m.sessions[session.ID]
+	m.mu.Unlock()
+	if !ok || time.Now().After(entry.expiresAt) {
+		return session, nil
+	}
+
+	err = gob.NewDecoder(bytes.NewBuffer(entry.data)).Decode(&session.Values)
+	if err != nil {
+		return session, err
+	}
+	session.IsNew = false
+
+	return session, nil
+}
+
+// Save stores the session in memory and sets the session cookie.
+// The session is deleted if its MaxAge is <= 0.
+func (m *MemorySessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		m.mu.Lock()
+		delete(m.sessions, session.ID)
+		m.mu.Unlock()
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id, err := generateSessionID()
+		if err != nil {
+			return errors.New("memorystore: failed to generate session id")
+		}
+		session.ID = id
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(session.Values); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.sweep()
+	m.sessions[session.ID] = memoryEntry{
+		data:      buf.Bytes(),
+		expiresAt: time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+	m.mu.Unlock()
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// DeleteSession deletes the session and its info
+func (m *MemorySessionStore) DeleteSession(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, sessionID)
+	delete(m.infos, sessionID)
+	return nil
+}
+
+// SessionExists checks if the session has not expired or been deleted
+func (m *MemorySessionStore) SessionExists(ctx context.Context, sessionID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.sessions[sessionID]
+	return ok && time.Now().Before(entry.expiresAt), nil
+}
+
+// AddUserSession adds the session to the index of the user
+func (m *MemorySessionStore) AddUserSession(ctx context.Context, userID string, sessionID string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.userSessions[userID] == nil {
+		m.userSessions[userID] = map[string]memoryUserSession{}
+	}
+	now := time.Now()
+	m.userSessions[userID][sessionID] = memoryUserSession{
+		createdAt: now,
+		expiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+// ReserveUserSession checks the limit and adds the session to the index of the user while the lock is held
+func (m *MemorySessionStore) ReserveUserSession(ctx context.Context, userID string, sessionID string, replacedID string, limit int, evict bool, ttl time.Duration) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	index := m.userSessions[userID]
+	if index == nil {
+		index = map[string]memoryUserSession{}
+	}
+
+	counted := []string{}
+	for id, userSession := range index {
+		entry, ok := m.sessions[id]
+		if !ok || now.After(entry.expiresAt) || now.After(userSession.expiresAt) {
+			delete(index, id)
+			continue
+		}
+		if id != replacedID {
+			counted = append(counted, id)
+		}
+	}
+	sort.Slice(counted, func(i, j int) bool {
+		return index[counted[i]].createdAt.Before(index[counted[j]].createdAt)
+	})
+
+	var evicted []string
+	if excess := len(counted) - limit + 1; limit > 0 && excess > 0 {
+		if !evict {
+			return nil, errMaxSessionsReached
+		}
+		evicted = counted[:excess]
+		for _, id := range evicted {
+			delete(index, id)
+			delete(m.sessions, id)
+			delete(m.infos, id)
+		}
+	}
+
+	index[sessionID] = memoryUserSession{
+		createdAt: now,
+		expiresAt: now.Add(ttl),
+	}
+	m.userSessions[userID] = index
+
+	// the session counts as existing until it is saved over this
+	m.sessions[sessionID] = memoryEntry{expiresAt: now.Add(ttl)}
+	return evicted, nil
+}
+
+// GetUserSessions returns the ids in the index of the user oldest first
+func (m *MemorySessionStore) GetUserSessions(ctx context.Context, userID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	ids := []string{}
+	for id, userSession := range m.userSessions[userID] {
+		if now.Before(userSession.expiresAt) {
+			ids = append(ids, id)
+		}
+	}
+
+	index := m.userSessions[userID]
+	sort.Slice(ids, func(i, j int) bool {
+		return index[ids[i]].createdAt.Before(index[ids[j]].createdAt)
+	})
+
+	return ids, nil
+}
+
+// RemoveUserSession removes the session from the index of the user
+func (m *MemorySessionStore) RemoveUserSession(ctx context.Context, userID string, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.userSessions[userID], sessionID)
+	if len(m.userSessions[userID]) == 0 {
+		delete(m.userSessions, userID)
+	}
+	return nil
+}
+
+// SetSessionInfo stores the info of the session
+func (m *MemorySessionStore) SetSessionInfo(ctx context.Context, sessionID string, info SessionInfo, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.infos[sessionID] = memoryInfo{
+		info:      info,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+// TouchSessionInfo updates the last seen time of the session if it has info
+func (m *MemorySessionStore) TouchSessionInfo(ctx context.Context, sessionID string, lastSeen time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.infos[sessionID]
+	if !ok {
+		return nil
+	}
+	entry.info.LastSeen = lastSeen
+	m.infos[sessionID] = entry
+	return nil
+}
+
+// GetSessionInfo returns the info of the session
+func (m *MemorySessionStore) GetSessionInfo(ctx context.Context, sessionID string) (SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.infos[sessionID]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return SessionInfo{}, errSessionInfoNotFound
+	}
+	return entry.info, nil
+}
+
+// SetTemporary stores the value until ttl has passed
+func (m *MemorySessionStore) SetTemporary(ctx context.Context, key string, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+	m.temporaries[key] = memoryEntry{
+		data:      []byte(value),
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+// TakeTemporary returns the value and deletes it
+func (m *MemorySessionStore) TakeTemporary(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.temporaries[key]
+	delete(m.temporaries, key)
+	if !ok || time.Now().After(entry.expiresAt) {
+		return "", errTemporaryNotFound
+	}
+	return string(entry.data), nil
+}
+
+// sweep removes the expired entries, the lock must be held by the caller
+func (m *MemorySessionStore) sweep() {
+	now := time.Now()
+	if now.Sub(m.lastSweep) < memorySweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for id, entry := range m.sessions {
+		if now.After(entry.expiresAt) {
+			delete(m.sessions, id)
+		}
+	}
+	for id, entry := range m.infos {
+		if now.After(entry.expiresAt) {
+			delete(m.infos, id)
+		}
+	}
+	for key, entry := range m.temporaries {
+		if now.After(entry.expiresAt) {
+			delete(m.temporaries, key)
+		}
+	}
+	for userID, index := range m.userSessions {
+		for id, userSession := range index {
+			if now.After(userSession.expiresAt) {
+				delete(index, id)
+			}
+		}
+		if len(index) == 0 {
+			delete(m.userSessions, userID)
+		}
+	}
+}
+
+// generateSessionID returns a new random session id in the same format as the redis store
+func generateSessionID() (string, error) {
+	k := make([]byte, 64)
+	if _, err := rand.Read(k); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(k), "="), nil
+}
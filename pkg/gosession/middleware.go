@@ -0,0 +1,206 @@
+package gosession
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ConfigureMiddlewares will make calls to configure all the different middlewares
+func (s *Server) configureDefaultMiddlewares() {
+	// This runs before the router
+	s.echo.Pre(middleware.RemoveTrailingSlash())
+	// Use this ID to track the route through the microservices for logging, etc
+	s.echo.Pre(middleware.RequestID())
+	// token clients send the session in the Authorization header instead of the cookie
+	s.echo.Pre(s.BearerSessionMiddleware())
+
+	// TODO
+	//e.Use(middleware.CORS())
+	s.echo.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     s.config.CORSAllowOrigins,
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAccessControlAllowCredentials, echo.HeaderCookie, echo.HeaderSetCookie, csrfHeader, echo.HeaderAuthorization, sessionModeHeader},
+		ExposeHeaders:    []string{echo.HeaderSetCookie, csrfHeader, sessionTokenHeader},
+		AllowCredentials: true,
+	}))
+	// the state changing requests made with the session cookie need the csrf token of the session
+	s.echo.Use(s.CSRFMiddleware())
+	// checks the permissions the rbac policy gives the routes
+	s.echo.Use(s.RoutePermissionMiddleware())
+	//e.Use(middleware.Gzip())
+	//e.Use((middleware.HTTPSRedirect()))
+	//e.Use((middleware.Secure())) TODO readd
+	// TODO change the secret to be env passed in via kubernetes secrets
+	//e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+
+	// TODO setup the auth model and the auth policy
+	// check the role from the cookie
+	// TODO is checking the role from the cookie secure?
+	// If not should we go to one where the session token is secure?
+	// OR else also store in the redis store the sessionID, the userSessionID and also the role
+	// enforcer, err := casbin.NewEnforcer("casbin_auth_model.conf", "casbin_auth_policy.csv")
+	// if err != nil {
+	// 	fmt.Println("Error")
+	// }
+	// e.Use(casbin_mw.Middleware(enforcer))
+}
+
+// Custom Middlewares -----------------------------------------------------------------------
+
+// SessionMiddleware to confirm the user has a valid session,
+// the session comes from the cookie or from the bearer token of token clients
+func (s *Server) SessionMiddleware(role string) echo.MiddlewareFunc {
+
+	// 2. Return middleware handler
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+
+			session, err := s.getSession(c)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, "authentication required")
+			}
+
+			userID, ok := session.Values["userID"].(string)
+			if !ok || userID == "" {
+				// the password was correct but the code of the second factor was not sent yet
+				if session.Values["pendingUserID"] != nil {
+					return c.JSON(http.StatusUnauthorized, errTOTPRequired.Error())
+				}
+				return c.JSON(http.StatusUnauthorized, "authentication required")
+			}
+
+			// the role and status are read from the database as the session only has a snapshot of them
+			acc, err := s.lookupAccount(c.Request().Context(), userID)
+			if err == errNotFound {
+				// the user was deleted so the session can never be used again
+				err = s.deleteUserSession(c.Request().Context(), userID, session.ID)
+				if err != nil {
+					fmt.Println("failed deleting the session of a deleted user: ", err)
+				}
+				return c.JSON(http.StatusUnauthorized, "authentication required")
+			}
+			if err != nil {
+				fmt.Println("failed looking up the account: ", err)
+				return c.JSON(http.StatusInternalServerError, "failed checking the account")
+			}
+			if !acc.active() {
+				return c.JSON(http.StatusForbidden, errAccountSuspended.Error())
+			}
+
+			// pass in min role to use this route here.
+			userRole := acc.Role
+
+			fmt.Println("Role passed into middleware: " + role)
+			fmt.Println("UserRole determined: ", userRole)
+			fmt.Println("-------------------------------------")
+
+			// the role of the user has to be the role of the route or inherit from it
+			if role != "" && !s.rbac.hasRole(userRole, role) {
+				return c.JSON(http.StatusForbidden, "access denied")
+			}
+
+			// the timeouts of the current role apply, not the ones of the role the user signed in with
+			now := time.Now()
+			expiresAt := s.sessionExpiresAt(session, userRole)
+			if expiresAt.IsZero() {
+				// sessions from before the timeouts start them now
+				startSessionTimeouts(session, now)
+			} else if !now.Before(expiresAt) {
+				if err := s.expireSession(c, session, userID); err != nil {
+					fmt.Println("failed deleting the expired session: ", err)
+				}
+				return c.JSON(http.StatusUnauthorized, "the session has expired, please sign in again")
+			}
+
+			// the idle timeout is extended at most every tenth of it so not every request saves the session
+			idle, _ := s.sessionTimeouts(userRole)
+			interval := idle / 10
+			if interval > time.Minute {
+				interval = time.Minute
+			}
+			lastActiveAt, _ := session.Values["lastActiveAt"].(int64)
+			extend := expiresAt.IsZero() || now.Sub(time.Unix(0, lastActiveAt)) >= interval
+			if extend {
+				session.Values["lastActiveAt"] = now.UnixNano()
+				setSessionExpiry(session, s.sessionExpiresAt(session, userRole))
+			}
+
+			// a new role is a change of privileges, the session gets a new id for it
+			if sessionRole, _ := session.Values["role"].(string); sessionRole != userRole {
+				session.Values["role"] = userRole
+				setSessionExpiry(session, s.sessionExpiresAt(session, userRole))
+				if err := s.rotateSession(c, session, userID, userRole); err != nil {
+					fmt.Println("failed rotating the session: ", err)
+					return c.JSON(http.StatusInternalServerError, "failed saving session")
+				}
+			} else if extend {
+				if err := session.Save(c.Request(), c.Response()); err != nil {
+					fmt.Println("failed extending the session: ", err)
+				}
+			}
+
+			err = s.touchSessionInfo(c.Request().Context(), session.ID)
+			if err != nil {
+				fmt.Println("failed updating session info: ", err)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// OwnerMiddleware only lets the user whose id is in the :id param or an admin through,
+// it must be used after SessionMiddleware
+func (s *Server) OwnerMiddleware() echo.MiddlewareFunc {
+	return s.ownerMiddleware(func(c echo.Context) (string, error) {
+		return c.Param("id"), nil
+	})
+}
+
+// OwnerByEmailMiddleware only lets the user whose email is in the :email param or an admin through,
+// it must be used after SessionMiddleware
+func (s *Server) OwnerByEmailMiddleware() echo.MiddlewareFunc {
+	return s.ownerMiddleware(func(c echo.Context) (string, error) {
+		user, err := s.users.FindUserByEmail(c.Request().Context(), c.Param("email"))
+		if err != nil {
+			return "", err
+		}
+		return user.ID.Hex(), nil
+	})
+}
+
+// ownerMiddleware compares the user of the session with the owner of the resource,
+// users that do not own it get a 403 whether or not it exists so they can not probe for other users
+func (s *Server) ownerMiddleware(ownerID func(c echo.Context) (string, error)) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+
+			userID, acc, err := s.sessionAccount(c)
+			if err == errSessionNotSignedIn || err == errNotFound {
+				return c.JSON(http.StatusUnauthorized, "authentication required")
+			}
+			if err != nil {
+				fmt.Println("failed looking up the account: ", err)
+				return c.JSON(http.StatusInternalServerError, "failed checking the account")
+			}
+			if !acc.active() {
+				return c.JSON(http.StatusForbidden, errAccountSuspended.Error())
+			}
+
+			// admins can access every user
+			if s.rbac.hasRole(acc.Role, "admin") {
+				return next(c)
+			}
+
+			owner, err := ownerID(c)
+			if err != nil || owner != userID {
+				return c.JSON(http.StatusForbidden, "access denied")
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package gosession
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSessionMiddlewareRequiresRole(t *testing.T) {
+	rec := testRequest{method: http.MethodGet, path: "/"}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	email := uniqueEmail("middleware")
+	registerAndConfirm(t, email, "password1234")
+	cookie := signInAs(t, email, "password1234")
+
+	rec = testRequest{method: http.MethodGet, path: "/", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodDelete, path: "/users/000000000000000000000000/sessions", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+}
@@ -0,0 +1,583 @@
+package gosession
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+	OPENID CONNECT SIGN IN SYSTEM
+
+	Users can sign in with the OpenID Connect provider at OIDC_ISSUER instead of a password, the routes are
+	only registered when it is set. The endpoints of the provider are read from its discovery document.
+	https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowAuth
+
+	The sign in route sends the browser to the provider with a state, a nonce and a PKCE challenge (RFC 7636).
+	The nonce and the code verifier are kept in the session store under the state for oidcFlowTTL and can only
+	be taken once, the state is also kept in the session so the callback has to come from the same browser.
+
+	The callback exchanges the code for an id token, checks its signature against the keys of the provider and
+	its claims, and signs in the user the provider account is linked to. The first time a provider account is
+	used it is linked to the user with the same email when the provider verified that email, or a new verified
+	user is created when there is none. Users that did not verify their email are not linked as anyone could
+	have registered them with an email they do not own.
+
+*/
+
+const (
+	oidcStatePrefix = "oidc_state_"
+	// oidcFlowTTL is how long the user has to sign in at the provider
+	oidcFlowTTL = 10 * time.Minute
+	// oidcClockSkew is how far the clock of the provider can be off from ours
+	oidcClockSkew = time.Minute
+	// oidcKeysRefetchInterval is how often the keys of the provider can be fetched for an unknown kid,
+	// so tokens with made up kids do not make us call the provider on every sign in
+	oidcKeysRefetchInterval = time.Minute
+)
+
+var errOIDCState = errors.New("The sign in expired or was started in another browser, please try again")
+var errOIDCInvalid = errors.New("The sign in could not be verified")
+var errOIDCEmailNotVerified = errors.New("The provider has not verified the email of this account")
+var errOIDCAccountNotVerified = errors.New("An account with this email exists but is not verified, confirm it or sign in with the password to link it")
+
+// Identity is an account at an OpenID Connect provider that is linked to the user
+type Identity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"subject" bson:"subject"`
+	Email    string    `json:"email,omitempty" bson:"email,omitempty"`
+	LinkedAt time.Time `json:"linkedAt" bson:"linkedAt"`
+}
+
+// oidcFlow is what the callback needs from the start of the sign in
+type oidcFlow struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+}
+
+// oidcDiscovery is the part of the discovery document of the provider that is used
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint,omitempty"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcTokenResponse is the answer of the token endpoint
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// idTokenClaims are the claims of an id token that are used
+type idTokenClaims struct {
+	Issuer          string      `json:"iss"`
+	Subject         string      `json:"sub"`
+	Audience        jwtAudience `json:"aud"`
+	AuthorizedParty string      `json:"azp,omitempty"`
+	ExpiresAt       int64       `json:"exp"`
+	IssuedAt        int64       `json:"iat"`
+	AuthTime        int64       `json:"auth_time,omitempty"`
+	Nonce           string      `json:"nonce,omitempty"`
+	SessionID       string      `json:"sid,omitempty"`
+	Email           string      `json:"email,omitempty"`
+	// some providers send the string "true" instead of a boolean
+	EmailVerified interface{} `json:"email_verified,omitempty"`
+	GivenName     string      `json:"given_name,omitempty"`
+	FamilyName    string      `json:"family_name,omitempty"`
+}
+
+func (c idTokenClaims) emailVerified() bool {
+	switch verified := c.EmailVerified.(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+// oidcProvider caches the discovery document and the signing keys of the provider
+type oidcProvider struct {
+	issuer string
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	// keysFetchedAt is when the keys were last fetched
+	keysFetchedAt time.Time
+}
+
+func newOIDCProvider(issuer string) *oidcProvider {
+	return &oidcProvider{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]*rsa.PublicKey{},
+	}
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureOIDCRoutes - Configure all the routes for signing in with an OpenID Connect provider here
+func (s *Server) configureOIDCRoutes() {
+	if s.config.OIDCIssuer == "" {
+		return
+	}
+	s.oidc = newOIDCProvider(s.config.OIDCIssuer)
+
+	// sends the browser to the provider to sign in
+	s.echo.GET("/auth/oidc/sign-in", s.startOIDCSignIn, s.RateLimit("oidc_sign_in", RateLimitByIP))
+
+	// the provider sends the browser back here with the code
+	s.echo.GET("/auth/oidc/callback", s.finishOIDCSignIn, s.RateLimit("oidc_callback", RateLimitByIP))
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// This route starts the sign in with the provider and redirects to it
+func (s *Server) startOIDCSignIn(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	discovery, err := s.oidc.discover(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusBadGateway, "The sign in provider could not be reached")
+	}
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	state, err := generateRandomAuthString()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "failed starting the sign in")
+	}
+	nonce, err := generateRandomAuthString()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "failed starting the sign in")
+	}
+	// 60 hex characters, the verifier has to be 43 to 128 characters long
+	codeVerifier, err := generateRandomAuthString()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "failed starting the sign in")
+	}
+
+	flow, err := json.Marshal(oidcFlow{Nonce: nonce, CodeVerifier: codeVerifier})
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "failed starting the sign in")
+	}
+	err = s.sessions.SetTemporary(ctx, oidcStatePrefix+state, string(flow), oidcFlowTTL)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusInternalServerError, "failed starting the sign in")
+	}
+
+	session.Values["oidcState"] = state
+	session.IsNew = false
+	if err = session.Save(c.Request(), c.Response()); err != nil {
+		fmt.Println("failed saving session: ", err)
+		return c.String(http.StatusNotAcceptable, "failed saving session")
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", s.config.OIDCClientID)
+	query.Set("redirect_uri", s.config.OIDCRedirectURL)
+	query.Set("scope", strings.Join(s.config.OIDCScopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	return c.Redirect(http.StatusFound, withQuery(discovery.AuthorizationEndpoint, query))
+}
+
+// This route finishes the sign in with the code from the provider and signs the user in
+func (s *Server) finishOIDCSignIn(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if providerError := c.QueryParam("error"); providerError != "" {
+		log.Printf("The provider refused the sign in: %s %s", providerError, c.QueryParam("error_description"))
+		return c.String(http.StatusUnauthorized, "The sign in was cancelled at the provider")
+	}
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	state := c.QueryParam("state")
+	sessionState, _ := session.Values["oidcState"].(string)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(sessionState)) != 1 {
+		return c.String(http.StatusUnauthorized, errOIDCState.Error())
+	}
+	delete(session.Values, "oidcState")
+
+	// taking the flow makes sure each state can only be used once
+	storedFlow, err := s.sessions.TakeTemporary(ctx, oidcStatePrefix+state)
+	if err != nil {
+		return c.String(http.StatusUnauthorized, errOIDCState.Error())
+	}
+	var flow oidcFlow
+	if err := json.Unmarshal([]byte(storedFlow), &flow); err != nil {
+		return c.String(http.StatusUnauthorized, errOIDCState.Error())
+	}
+
+	claims, err := s.oidc.exchangeCode(ctx, s.config, c.QueryParam("code"), flow)
+	if err != nil {
+		log.Printf("Unable to verify the sign in with the provider %v", err)
+		return c.String(http.StatusUnauthorized, errOIDCInvalid.Error())
+	}
+
+	databaseUser, status, err := s.oidcUser(ctx, claims)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	// the provider stands in for the password, not for the lockout
+	if err := checkAccountLocked(databaseUser); err != nil {
+		return s.signInFailed(c, err)
+	}
+
+	if !(account{Status: databaseUser.Status}).active() {
+		return c.String(http.StatusForbidden, errAccountSuspended.Error())
+	}
+
+	// the provider stands in for the password, two factor is still asked for
+	if databaseUser.TOTPEnabled {
+		if err = s.startPendingSignIn(c, session, databaseUser); err != nil {
+			fmt.Println("failed saving session: ", err)
+			return c.String(http.StatusNotAcceptable, "failed saving session")
+		}
+		return c.Redirect(http.StatusFound, s.config.OIDCPostSignInURL+"?totpRequired=true")
+	}
+
+	err = s.startUserSession(c, session, databaseUser)
+	if err == errMaxSessionsReached {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		fmt.Println("failed starting the session: ", err)
+		return c.String(http.StatusNotAcceptable, "failed saving session")
+	}
+
+	return c.Redirect(http.StatusFound, s.config.OIDCPostSignInURL)
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// oidcUser returns the user the provider account is linked to, linking or creating it the first time,
+// the status is the one to answer with when there is an error
+func (s *Server) oidcUser(ctx context.Context, claims *idTokenClaims) (*DatabaseUser, int, error) {
+	databaseUser, err := s.users.FindUserByIdentity(ctx, claims.Issuer, claims.Subject)
+	if err == nil {
+		return databaseUser, 0, nil
+	}
+	if err != errNotFound {
+		fmt.Println(err)
+		return nil, http.StatusInternalServerError, errors.New("failed finding the user")
+	}
+
+	if claims.Email == "" || !claims.emailVerified() {
+		return nil, http.StatusForbidden, errOIDCEmailNotVerified
+	}
+
+	identity := Identity{
+		Provider: claims.Issuer,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now().UTC(),
+	}
+
+	databaseUser, err = s.users.FindUserByEmail(ctx, claims.Email)
+	if err == nil {
+		return s.linkOIDCIdentity(ctx, databaseUser, identity)
+	}
+	if err != errNotFound {
+		fmt.Println(err)
+		return nil, http.StatusInternalServerError, errors.New("failed finding the user")
+	}
+
+	// the user has no password, one can be set with the reset password email
+	password, err := generateRandomAuthString()
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("failed creating the user")
+	}
+
+	var submitNewUser SubmitNewUser
+
+	submitNewUser.Email = claims.Email
+	submitNewUser.HashedPassword = hashAndSalt([]byte(password))
+	submitNewUser.CreatedAt = time.Now().UTC()
+	submitNewUser.UpdatedAt = time.Now().UTC()
+	submitNewUser.Role = "user"
+	submitNewUser.Verified = true
+	submitNewUser.Identities = []Identity{identity}
+
+	// the names are only kept when they pass the same validation as the register route
+	if v.Var(claims.GivenName, "min=1,max=64,alpha") == nil {
+		submitNewUser.FirstName = claims.GivenName
+	}
+	if v.Var(claims.FamilyName, "min=1,max=64,alpha") == nil {
+		submitNewUser.LastName = claims.FamilyName
+	}
+
+	if err := v.Struct(submitNewUser); err != nil {
+		log.Printf("Unable to validate the user %+v %v", submitNewUser, err)
+		return nil, http.StatusNotAcceptable, errors.New("The account of the provider can not be used to register")
+	}
+
+	id, err := s.users.InsertUser(ctx, submitNewUser)
+	if err == errDuplicate {
+		// the email was registered since it was looked up, by another sign in of the provider account too
+		databaseUser, err = s.users.FindUserByEmail(ctx, claims.Email)
+		if err != nil {
+			fmt.Println(err)
+			return nil, http.StatusInternalServerError, errors.New("failed finding the user")
+		}
+		return s.linkOIDCIdentity(ctx, databaseUser, identity)
+	}
+	if err != nil {
+		log.Printf("Unable to insert new user :%v", err)
+		return nil, http.StatusInternalServerError, errors.New("failed creating the user")
+	}
+
+	databaseUser, err = s.users.FindUserByID(ctx, id)
+	if err != nil {
+		fmt.Println(err)
+		return nil, http.StatusInternalServerError, errors.New("failed finding the user")
+	}
+	return databaseUser, 0, nil
+}
+
+// linkOIDCIdentity links the provider account to the user with its email, the user must have verified the email
+func (s *Server) linkOIDCIdentity(ctx context.Context, databaseUser *DatabaseUser, identity Identity) (*DatabaseUser, int, error) {
+	for _, linked := range databaseUser.Identities {
+		if linked.Provider == identity.Provider && linked.Subject == identity.Subject {
+			return databaseUser, 0, nil
+		}
+	}
+
+	if !databaseUser.Verified {
+		return nil, http.StatusConflict, errOIDCAccountNotVerified
+	}
+
+	identities := append(databaseUser.Identities, identity)
+	err := s.users.UpdateUser(ctx, databaseUser.ID, bson.D{
+		{Key: "identities", Value: identities},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return nil, http.StatusInternalServerError, errors.New("failed linking the account")
+	}
+	databaseUser.Identities = identities
+	return databaseUser, 0, nil
+}
+
+// identityQuery finds the user with this provider account linked
+func identityQuery(provider string, subject string) bson.M {
+	return bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+}
+
+// discover returns the discovery document of the provider, it is only fetched once
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	// the document has to be about the issuer it was fetched from
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("the discovery document is for the issuer %q", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("the discovery document is missing an endpoint")
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// exchangeCode trades the code for an id token at the token endpoint and returns its verified claims
+func (p *oidcProvider) exchangeCode(ctx context.Context, config ConfigApplication, code string, flow oidcFlow) (*idTokenClaims, error) {
+	if code == "" {
+		return nil, errors.New("the provider sent no code")
+	}
+
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.OIDCRedirectURL)
+	form.Set("code_verifier", flow.CodeVerifier)
+	form.Set("client_id", config.OIDCClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.OIDCClientSecret != "" {
+		// client_secret_basic, the id and secret are form encoded first
+		req.SetBasicAuth(url.QueryEscape(config.OIDCClientID), url.QueryEscape(config.OIDCClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the token endpoint answered %d: %s", resp.StatusCode, string(body))
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("the token endpoint sent no id token")
+	}
+
+	return p.verifyIDToken(ctx, config, tokens.IDToken, flow.Nonce)
+}
+
+// verifyIDToken checks the signature and the claims of the id token
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (p *oidcProvider) verifyIDToken(ctx context.Context, config ConfigApplication, idToken string, nonce string) (*idTokenClaims, error) {
+	var claims idTokenClaims
+	err := verifyRS256(idToken, func(keyID string) (*rsa.PublicKey, error) {
+		return p.signingKey(ctx, keyID)
+	}, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if strings.TrimSuffix(claims.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("the id token was issued by %q", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("the id token has no subject")
+	}
+	if !claims.Audience.contains(config.OIDCClientID) {
+		return nil, errors.New("the id token is not for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != config.OIDCClientID {
+		return nil, errors.New("the id token was issued to another client")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)) {
+		return nil, errors.New("the id token has expired")
+	}
+	if time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("the id token was issued in the future")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("the id token has the wrong nonce")
+	}
+
+	return &claims, nil
+}
+
+// signingKey returns the key of the provider with this kid, the keys are fetched again
+// when the kid is not known so the provider can rotate them, at most once per oidcKeysRefetchInterval
+func (p *oidcProvider) signingKey(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcKeysRefetchInterval {
+		return nil, fmt.Errorf("the provider has no key %q", keyID)
+	}
+
+	var keySet JWKSet
+	if err := p.getJSON(ctx, discovery.JWKSURI, &keySet); err != nil {
+		return nil, err
+	}
+	p.keysFetchedAt = time.Now()
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			// the provider can have other keys that are not used for the id tokens
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	p.keys = keys
+
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("the provider has no key %q", keyID)
+	}
+	return key, nil
+}
+
+// getJSON decodes the json at the url into out
+func (p *oidcProvider) getJSON(ctx context.Context, endpoint string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
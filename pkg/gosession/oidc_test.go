@@ -0,0 +1,380 @@
+package gosession
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mockIdP is an OpenID Connect provider that signs in whoever is in next
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu sync.Mutex
+	// next are the claims of the user that signs in at the authorize endpoint
+	next idTokenClaims
+	// wrongNonce makes the id tokens carry another nonce
+	wrongNonce bool
+	codes      map[string]mockAuthorization
+	// keyFetches counts the calls to the jwks endpoint
+	keyFetches int
+}
+
+// mockAuthorization is what the provider remembers of an authorize request until the code is used
+type mockAuthorization struct {
+	claims        idTokenClaims
+	codeChallenge string
+	redirectURI   string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, codes: map[string]mockAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		idp.keyFetches++
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{rsaPublicJWK("mock", &idp.key.PublicKey)}})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != "gosession" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	claims := idp.next
+	claims.Nonce = query.Get("nonce")
+	if idp.wrongNonce {
+		claims.Nonce = "another nonce"
+	}
+	code := unique("code")
+	idp.codes[code] = mockAuthorization{
+		claims:        claims,
+		codeChallenge: query.Get("code_challenge"),
+		redirectURI:   query.Get("redirect_uri"),
+	}
+	idp.mu.Unlock()
+
+	redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, _ := r.BasicAuth()
+	if clientID != "gosession" || secret != "secret" {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	idp.mu.Lock()
+	authorization, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	// the verifier has to hash to the challenge sent to the authorize endpoint
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" ||
+		r.PostFormValue("redirect_uri") != authorization.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := authorization.claims
+	claims.Issuer = idp.server.URL
+	claims.Audience = jwtAudience{"gosession"}
+	claims.IssuedAt = time.Now().Unix()
+	claims.ExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	idToken, err := signRS256(idp.key, "mock", claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(oidcTokenResponse{AccessToken: "access", TokenType: "Bearer", IDToken: idToken, ExpiresIn: 60})
+}
+
+// signInAs sets the user the next sign in at the provider is for
+func (idp *mockIdP) signInAs(subject string, email string, verified bool) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.next = idTokenClaims{Subject: subject, Email: email, EmailVerified: verified, GivenName: "Oidc"}
+}
+
+// oidcServer returns a server that signs in with the mock provider
+func oidcServer(t *testing.T, idp *mockIdP) *Server {
+	t.Helper()
+
+	return newTestServer(t, func(config *ConfigApplication) {
+		config.OIDCIssuer = idp.server.URL
+		config.OIDCClientID = "gosession"
+		config.OIDCClientSecret = "secret"
+		config.OIDCRedirectURL = "http://localhost:8080/auth/oidc/callback"
+		config.OIDCPostSignInURL = "http://localhost:4200/home"
+	})
+}
+
+// startOIDCSignIn goes to the provider and returns the callback url it redirects back to with the session cookie
+func startOIDCSignIn(t *testing.T, server *Server) (string, *http.Cookie) {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodGet, path: "/auth/oidc/sign-in", server: server}.do(t)
+	expectStatus(t, rec, http.StatusFound)
+	cookie := sessionCookie(t, rec)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the provider to redirect but got %d", resp.StatusCode)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback.RequestURI(), cookie
+}
+
+// finishOIDCSignIn goes through the whole sign in and returns the response of the callback
+func finishOIDCSignIn(t *testing.T, server *Server) *httptest.ResponseRecorder {
+	t.Helper()
+
+	callback, cookie := startOIDCSignIn(t, server)
+	return testRequest{method: http.MethodGet, path: callback, cookies: []*http.Cookie{cookie}, server: server}.do(t)
+}
+
+// oidcSessionUser returns the user the callback signed in
+func oidcSessionUser(t *testing.T, server *Server, rec *httptest.ResponseRecorder) ExistingUser {
+	t.Helper()
+
+	expectStatus(t, rec, http.StatusFound)
+	if location := rec.Header().Get("Location"); location != "http://localhost:4200/home" {
+		t.Fatalf("expected to be sent to the app but was sent to %q", location)
+	}
+
+	rec = testRequest{method: http.MethodGet, path: "/auth/get-user-via-session", cookies: []*http.Cookie{sessionCookie(t, rec)}, server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	var user ExistingUser
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestOIDCSignInCreatesAVerifiedUser(t *testing.T) {
+	idp := newMockIdP(t)
+	server := oidcServer(t, idp)
+
+	email := uniqueEmail("oidc")
+	subject := unique("subject")
+	idp.signInAs(subject, email, true)
+
+	user := oidcSessionUser(t, server, finishOIDCSignIn(t, server))
+	if user.Email != email || !user.Verified || user.Role != "user" || user.FirstName != "Oidc" {
+		t.Fatalf("expected a new verified user but got %+v", user)
+	}
+
+	// the provider account stays linked when its email changes
+	idp.signInAs(subject, uniqueEmail("changed"), true)
+	again := oidcSessionUser(t, server, finishOIDCSignIn(t, server))
+	if again.ID != user.ID {
+		t.Fatalf("expected to sign in as %s but signed in as %s", user.ID.Hex(), again.ID.Hex())
+	}
+}
+
+func TestOIDCSignInLinksAVerifiedAccount(t *testing.T) {
+	idp := newMockIdP(t)
+	server := oidcServer(t, idp)
+
+	email := uniqueEmail("oidc")
+	insertUser(t, server, email, "password123456", "user")
+	if _, err := server.users.UpdateUserByEmail(context.Background(), email, bson.D{{Key: "verified", Value: true}}); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := server.users.FindUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject := unique("subject")
+	idp.signInAs(subject, email, true)
+	user := oidcSessionUser(t, server, finishOIDCSignIn(t, server))
+	if user.ID != existing.ID {
+		t.Fatalf("expected to sign in as the existing user %s but signed in as %s", existing.ID.Hex(), user.ID.Hex())
+	}
+
+	linked, err := server.users.FindUserByIdentity(context.Background(), idp.server.URL, subject)
+	if err != nil || linked.ID != existing.ID {
+		t.Fatalf("expected the provider account to be linked: %v", err)
+	}
+}
+
+func TestConcurrentOIDCSignInsCreateOneUser(t *testing.T) {
+	idp := newMockIdP(t)
+	server := oidcServer(t, idp)
+
+	claims := idTokenClaims{Issuer: idp.server.URL, Subject: unique("subject"), Email: uniqueEmail("oidc-race"), EmailVerified: true}
+
+	// the sign ins that lose the insert of the email link the provider account to the user that won it
+	ids := make(chan string, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := claims
+			user, status, err := server.oidcUser(context.Background(), &c)
+			if err != nil {
+				t.Errorf("expected the sign in to work but got %d %v", status, err)
+				return
+			}
+			ids <- user.ID.Hex()
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	user, err := server.users.FindUserByEmail(context.Background(), claims.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Identities) != 1 {
+		t.Fatalf("expected the provider account to be linked once but got %+v", user.Identities)
+	}
+	for id := range ids {
+		if id != user.ID.Hex() {
+			t.Fatalf("expected every sign in to be %s but got %s", user.ID.Hex(), id)
+		}
+	}
+}
+
+func TestOIDCProviderFetchesUnknownKeysOncePerInterval(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := newOIDCProvider(idp.server.URL)
+
+	if _, err := provider.signingKey(context.Background(), "mock"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := provider.signingKey(context.Background(), "unknown"); err == nil {
+			t.Fatal("expected an unknown kid to be refused")
+		}
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	if idp.keyFetches != 1 {
+		t.Fatalf("expected the keys to be fetched once but they were fetched %d times", idp.keyFetches)
+	}
+}
+
+func TestOIDCSignInRefusesUnverifiedEmails(t *testing.T) {
+	idp := newMockIdP(t)
+	server := oidcServer(t, idp)
+
+	// the provider did not verify the email
+	idp.signInAs(unique("subject"), uniqueEmail("oidc"), false)
+	expectStatus(t, finishOIDCSignIn(t, server), http.StatusForbidden)
+
+	// the user with this email never confirmed it
+	email := uniqueEmail("oidc")
+	insertUser(t, server, email, "password123456", "user")
+	idp.signInAs(unique("subject"), email, true)
+	expectStatus(t, finishOIDCSignIn(t, server), http.StatusConflict)
+}
+
+func TestOIDCSignInRefusesLockedAccounts(t *testing.T) {
+	idp := newMockIdP(t)
+	server := oidcServer(t, idp)
+
+	email := uniqueEmail("oidc-locked")
+	subject := unique("subject")
+	idp.signInAs(subject, email, true)
+	oidcSessionUser(t, server, finishOIDCSignIn(t, server))
+
+	_, err := server.users.UpdateUserByEmail(context.Background(), email, bson.D{{Key: "lockedUntil", Value: time.Now().Add(time.Hour).UTC()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider stands in for the password, the account stays locked
+	expectRetryAfter(t, finishOIDCSignIn(t, server))
+}
+
+func TestOIDCCallbackChecksTheState(t *testing.T) {
+	idp := newMockIdP(t)
+	server := oidcServer(t, idp)
+	idp.signInAs(unique("subject"), uniqueEmail("oidc"), true)
+
+	// the callback has to come from the browser that started the sign in
+	callback, _ := startOIDCSignIn(t, server)
+	_, otherCookie := startOIDCSignIn(t, server)
+	rec := testRequest{method: http.MethodGet, path: callback, cookies: []*http.Cookie{otherCookie}, server: server}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	// each state can only be used once
+	callback, cookie := startOIDCSignIn(t, server)
+	rec = testRequest{method: http.MethodGet, path: callback, cookies: []*http.Cookie{cookie}, server: server}.do(t)
+	expectStatus(t, rec, http.StatusFound)
+	rec = testRequest{method: http.MethodGet, path: callback, cookies: []*http.Cookie{cookie}, server: server}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	// the id token has to carry the nonce of this sign in
+	idp.mu.Lock()
+	idp.wrongNonce = true
+	idp.mu.Unlock()
+	expectStatus(t, finishOIDCSignIn(t, server), http.StatusUnauthorized)
+}
+
+func TestOIDCRoutesAreOffWithoutAnIssuer(t *testing.T) {
+	rec := testRequest{method: http.MethodGet, path: "/auth/oidc/sign-in"}.do(t)
+	if rec.Code == http.StatusFound || strings.Contains(rec.Header().Get("Location"), "authorize") {
+		t.Fatalf("expected the sign in to be off but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,575 @@
+package gosession
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	OPENID CONNECT PROVIDER SYSTEM
+
+	The other services can sign their users in with the accounts of this service, it acts as an OpenID
+	Connect provider for the clients registered by an admin. The provider is only turned on when
+	OIDC_PROVIDER_ISSUER is set to the url of this service.
+	https://openid.net/specs/openid-connect-core-1_0.html#CodeFlowAuth
+
+	The authorize endpoint uses the session cookie of the browser, users that are not signed in are sent
+	to OIDC_PROVIDER_SIGN_IN_URL first. The code it returns is kept in the session store and can only be
+	exchanged once within OIDC_PROVIDER_CODE_TTL seconds, PKCE is checked when the client used it.
+
+	The id and access tokens are signed with the signing key and carry a handle of the session they
+	were issued from, the userinfo endpoint refuses them once that session is signed out or revoked
+	so signing out here also signs out of the clients that check with it.
+
+	Clients are stored in the oidcClients collection with a hash of their secret, the secret is only
+	shown once when the client is registered.
+
+*/
+
+const (
+	oidcCodePrefix = "oidc_code_"
+
+	// tokenUseAccess marks the access tokens so an id token can not be used as one
+	tokenUseAccess = "access"
+)
+
+var errOIDCClientInvalid = errors.New("The client id or secret is wrong")
+
+// OIDCClient is a service that can sign its users in with this service
+type OIDCClient struct {
+	ID           primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	ClientID     string             `json:"clientID" bson:"clientID"`
+	HashedSecret string             `json:"-" bson:"hashedSecret"`
+	Name         string             `json:"name" bson:"name"`
+	RedirectURIs []string           `json:"redirectURIs" bson:"redirectURIs"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// NewOIDCClient is sent by an admin to register a client
+type NewOIDCClient struct {
+	Name         string   `json:"name" validate:"required,min=1,max=64"`
+	RedirectURIs []string `json:"redirectURIs" validate:"required,min=1,max=16,dive,url"`
+}
+
+// oidcAuthorization is what the token endpoint needs to know about the code
+type oidcAuthorization struct {
+	ClientID      string `json:"clientID"`
+	RedirectURI   string `json:"redirectURI"`
+	UserID        string `json:"userID"`
+	SessionHandle string `json:"sessionHandle"`
+	Scope         string `json:"scope"`
+	Nonce         string `json:"nonce,omitempty"`
+	CodeChallenge string `json:"codeChallenge,omitempty"`
+	AuthTime      int64  `json:"authTime"`
+}
+
+// accessTokenClaims are the claims of the access tokens issued by this service
+type accessTokenClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	IssuedAt  int64       `json:"iat"`
+	SessionID string      `json:"sid"`
+	ClientID  string      `json:"client_id,omitempty"`
+	Scope     string      `json:"scope,omitempty"`
+	Role      string      `json:"role,omitempty"`
+	TokenUse  string      `json:"token_use"`
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureOIDCProviderRoutes - Configure all the routes of the OpenID Connect provider here
+func (s *Server) configureOIDCProviderRoutes() {
+	if s.config.OIDCProviderIssuer == "" {
+		return
+	}
+
+	// the discovery document the clients read the endpoints from
+	s.echo.GET("/.well-known/openid-configuration", s.getOIDCDiscovery)
+
+	// signs the user of the session in to the client and sends the browser back with a code
+	s.echo.GET("/oidc/authorize", s.authorizeOIDCClient)
+
+	// exchanges the code for the tokens, it is called by the client itself
+	s.echo.POST("/oidc/token", s.issueOIDCTokens, s.RateLimit("oidc_token", RateLimitByIP))
+
+	// returns the claims of the user the access token is for
+	s.echo.GET("/oidc/userinfo", s.getOIDCUserInfo, s.RateLimit("oidc_userinfo", RateLimitByIP))
+	s.echo.POST("/oidc/userinfo", s.getOIDCUserInfo, s.RateLimit("oidc_userinfo", RateLimitByIP))
+
+	// registers a client and returns its secret
+	s.echo.POST("/oidc/clients", s.postOIDCClient, s.SessionMiddleware("user"), s.PermissionMiddleware("oidc:clients"))
+
+	// lists the registered clients
+	s.echo.GET("/oidc/clients", s.getOIDCClients, s.SessionMiddleware("user"), s.PermissionMiddleware("oidc:clients"))
+
+	// removes a client, the tokens it was given stop working when they expire
+	s.echo.DELETE("/oidc/clients/:clientID", s.deleteOIDCClient, s.SessionMiddleware("user"), s.PermissionMiddleware("oidc:clients"))
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// getOIDCDiscovery returns the discovery document of the provider
+func (s *Server) getOIDCDiscovery(c echo.Context) error {
+	issuer := strings.TrimSuffix(s.config.OIDCProviderIssuer, "/")
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oidc/authorize",
+		"token_endpoint":                        issuer + "/oidc/token",
+		"userinfo_endpoint":                     issuer + "/oidc/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwtAlgorithmRS256},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "sid", "email", "email_verified", "given_name", "family_name"},
+	})
+}
+
+// authorizeOIDCClient is the authorize endpoint, the errors are sent back to the client once its redirect uri is known
+func (s *Server) authorizeOIDCClient(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	clientID := c.QueryParam("client_id")
+	redirectURI := c.QueryParam("redirect_uri")
+	state := c.QueryParam("state")
+
+	client, err := s.oidcClients.FindOIDCClient(ctx, clientID)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "This client is not registered")
+	}
+	if !client.allowsRedirectURI(redirectURI) {
+		return c.String(http.StatusBadRequest, "This redirect uri is not registered for the client")
+	}
+
+	if c.QueryParam("response_type") != "code" {
+		return redirectOIDCError(c, redirectURI, state, "unsupported_response_type")
+	}
+	scope := strings.Fields(c.QueryParam("scope"))
+	if !containsString(scope, "openid") {
+		return redirectOIDCError(c, redirectURI, state, "invalid_scope")
+	}
+	codeChallenge := c.QueryParam("code_challenge")
+	if method := c.QueryParam("code_challenge_method"); (codeChallenge != "" || method != "") && method != "S256" {
+		return redirectOIDCError(c, redirectURI, state, "invalid_request")
+	}
+
+	userID, acc, err := s.sessionAccount(c)
+	if err == errSessionNotSignedIn || err == errNotFound {
+		if c.QueryParam("prompt") == "none" {
+			return redirectOIDCError(c, redirectURI, state, "login_required")
+		}
+		// the app signs the user in and sends the browser back to this request
+		returnTo := strings.TrimSuffix(s.config.OIDCProviderIssuer, "/") + c.Request().URL.RequestURI()
+		return c.Redirect(http.StatusFound, s.config.OIDCProviderSignInURL+"?"+url.Values{"redirect": {returnTo}}.Encode())
+	}
+	if err != nil {
+		fmt.Println("failed looking up the account: ", err)
+		return redirectOIDCError(c, redirectURI, state, "server_error")
+	}
+	if !acc.active() {
+		return redirectOIDCError(c, redirectURI, state, "access_denied")
+	}
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return redirectOIDCError(c, redirectURI, state, "server_error")
+	}
+
+	authTime := time.Now().Unix()
+	if info, err := s.getSessionInfo(ctx, session.ID); err == nil {
+		authTime = info.CreatedAt.Unix()
+	}
+
+	authorization, err := json.Marshal(oidcAuthorization{
+		ClientID:      client.ClientID,
+		RedirectURI:   redirectURI,
+		UserID:        userID,
+		SessionHandle: sessionHandle(session.ID),
+		Scope:         strings.Join(scope, " "),
+		Nonce:         c.QueryParam("nonce"),
+		CodeChallenge: codeChallenge,
+		AuthTime:      authTime,
+	})
+	if err != nil {
+		return redirectOIDCError(c, redirectURI, state, "server_error")
+	}
+
+	code, err := generateRandomAuthString()
+	if err != nil {
+		return redirectOIDCError(c, redirectURI, state, "server_error")
+	}
+	err = s.sessions.SetTemporary(ctx, oidcCodePrefix+code, string(authorization), time.Duration(s.config.OIDCProviderCodeTTL)*time.Second)
+	if err != nil {
+		fmt.Println(err)
+		return redirectOIDCError(c, redirectURI, state, "server_error")
+	}
+
+	query := url.Values{"code": {code}}
+	if state != "" {
+		query.Set("state", state)
+	}
+	return c.Redirect(http.StatusFound, withQuery(redirectURI, query))
+}
+
+// issueOIDCTokens is the token endpoint, it exchanges the code for an id token and an access token
+func (s *Server) issueOIDCTokens(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	// the tokens must never be cached
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Pragma", "no-cache")
+
+	client, err := s.authenticateOIDCClient(c)
+	if err != nil {
+		c.Response().Header().Set("WWW-Authenticate", `Basic realm="oidc"`)
+		return oidcTokenError(c, http.StatusUnauthorized, "invalid_client", err.Error())
+	}
+
+	if c.FormValue("grant_type") != "authorization_code" {
+		return oidcTokenError(c, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant is supported")
+	}
+
+	// taking the code makes sure it can only be used once
+	stored, err := s.sessions.TakeTemporary(ctx, oidcCodePrefix+c.FormValue("code"))
+	if err != nil {
+		return oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "The code is invalid or has expired")
+	}
+	var authorization oidcAuthorization
+	if err := json.Unmarshal([]byte(stored), &authorization); err != nil {
+		return oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "The code is invalid or has expired")
+	}
+
+	if authorization.ClientID != client.ClientID || authorization.RedirectURI != c.FormValue("redirect_uri") {
+		return oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "The code was issued to another client or redirect uri")
+	}
+	if authorization.CodeChallenge != "" {
+		challenge := sha256.Sum256([]byte(c.FormValue("code_verifier")))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(authorization.CodeChallenge)) != 1 {
+			return oidcTokenError(c, http.StatusBadRequest, "invalid_grant", "The code verifier is wrong")
+		}
+	}
+
+	databaseUser, err := s.oidcSessionUser(ctx, authorization.UserID, authorization.SessionHandle)
+	if err != nil {
+		return oidcTokenError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+	}
+
+	now := time.Now()
+	expiresIn := int64(s.config.OIDCProviderTokenTTL)
+	issuer := strings.TrimSuffix(s.config.OIDCProviderIssuer, "/")
+	scope := strings.Fields(authorization.Scope)
+
+	idClaims := idTokenClaims{
+		Issuer:    issuer,
+		Subject:   authorization.UserID,
+		Audience:  jwtAudience{client.ClientID},
+		ExpiresAt: now.Unix() + expiresIn,
+		IssuedAt:  now.Unix(),
+		AuthTime:  authorization.AuthTime,
+		Nonce:     authorization.Nonce,
+		SessionID: authorization.SessionHandle,
+	}
+	if containsString(scope, "email") {
+		idClaims.Email = databaseUser.Email
+		idClaims.EmailVerified = databaseUser.Verified
+	}
+	if containsString(scope, "profile") {
+		idClaims.GivenName = databaseUser.FirstName
+		idClaims.FamilyName = databaseUser.LastName
+	}
+
+	idToken, err := s.signingKey.sign(idClaims)
+	if err != nil {
+		fmt.Println(err)
+		return oidcTokenError(c, http.StatusInternalServerError, "server_error", "The tokens could not be signed")
+	}
+
+	accessToken, err := s.signingKey.sign(accessTokenClaims{
+		Issuer:    issuer,
+		Subject:   authorization.UserID,
+		Audience:  jwtAudience{client.ClientID},
+		ExpiresAt: now.Unix() + expiresIn,
+		IssuedAt:  now.Unix(),
+		SessionID: authorization.SessionHandle,
+		ClientID:  client.ClientID,
+		Scope:     authorization.Scope,
+		TokenUse:  tokenUseAccess,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return oidcTokenError(c, http.StatusInternalServerError, "server_error", "The tokens could not be signed")
+	}
+
+	return c.JSON(http.StatusOK, oidcTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		IDToken:     idToken,
+		ExpiresIn:   expiresIn,
+		Scope:       authorization.Scope,
+	})
+}
+
+// getOIDCUserInfo returns the claims of the user of the access token, the scopes decide which ones
+func (s *Server) getOIDCUserInfo(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	token := bearerToken(c)
+	if token == "" {
+		c.Response().Header().Set("WWW-Authenticate", `Bearer realm="oidc"`)
+		return c.JSON(http.StatusUnauthorized, "authentication required")
+	}
+
+	var claims accessTokenClaims
+	err := s.signingKey.verify(token, &claims)
+	if err == nil {
+		err = s.checkAccessToken(claims)
+	}
+	var databaseUser *DatabaseUser
+	if err == nil {
+		databaseUser, err = s.oidcSessionUser(ctx, claims.Subject, claims.SessionID)
+	}
+	if err != nil {
+		log.Printf("Refused the access token: %v", err)
+		c.Response().Header().Set("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		return c.JSON(http.StatusUnauthorized, errJWTInvalid.Error())
+	}
+
+	scope := strings.Fields(claims.Scope)
+	userInfo := echo.Map{"sub": claims.Subject}
+	if containsString(scope, "email") {
+		userInfo["email"] = databaseUser.Email
+		userInfo["email_verified"] = databaseUser.Verified
+	}
+	if containsString(scope, "profile") {
+		userInfo["given_name"] = databaseUser.FirstName
+		userInfo["family_name"] = databaseUser.LastName
+	}
+	return c.JSON(http.StatusOK, userInfo)
+}
+
+// postOIDCClient registers a client, the secret is only returned here
+func (s *Server) postOIDCClient(c echo.Context) error {
+	var newClient NewOIDCClient
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&newClient); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(newClient); err != nil {
+		log.Printf("Unable to validate the client %+v %v", newClient, err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	secret, err := generateRandomAuthString()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "failed creating the client")
+	}
+
+	client := OIDCClient{
+		ClientID:     primitive.NewObjectID().Hex(),
+		HashedSecret: hashClientSecret(secret),
+		Name:         newClient.Name,
+		RedirectURIs: newClient.RedirectURIs,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	id, err := s.oidcClients.InsertOIDCClient(c.Request().Context(), client)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusInternalServerError, "failed creating the client")
+	}
+	client.ID = id
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"client":       client,
+		"clientSecret": secret,
+	})
+}
+
+// getOIDCClients lists the registered clients
+func (s *Server) getOIDCClients(c echo.Context) error {
+	clients, err := s.oidcClients.FindOIDCClients(c.Request().Context())
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusInternalServerError, "failed finding the clients")
+	}
+	if clients == nil {
+		clients = []OIDCClient{}
+	}
+	return c.JSON(http.StatusOK, clients)
+}
+
+// deleteOIDCClient removes a client so it can not get new tokens
+func (s *Server) deleteOIDCClient(c echo.Context) error {
+	err := s.oidcClients.DeleteOIDCClient(c.Request().Context(), c.Param("clientID"))
+	if err == errNotFound {
+		return c.String(http.StatusNotFound, "No client found")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusInternalServerError, "failed deleting the client")
+	}
+	return c.JSON(http.StatusOK, "The client has been deleted")
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// authenticateOIDCClient returns the client of the id and secret sent with client_secret_basic or client_secret_post
+func (s *Server) authenticateOIDCClient(c echo.Context) (*OIDCClient, error) {
+	clientID, secret, ok := c.Request().BasicAuth()
+	if ok {
+		// the id and secret are form encoded before they are put in the header
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return nil, errOIDCClientInvalid
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, errOIDCClientInvalid
+		}
+	} else {
+		clientID = c.FormValue("client_id")
+		secret = c.FormValue("client_secret")
+	}
+
+	if clientID == "" || secret == "" {
+		return nil, errOIDCClientInvalid
+	}
+
+	client, err := s.oidcClients.FindOIDCClient(c.Request().Context(), clientID)
+	if err != nil {
+		return nil, errOIDCClientInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashClientSecret(secret)), []byte(client.HashedSecret)) != 1 {
+		return nil, errOIDCClientInvalid
+	}
+	return client, nil
+}
+
+// checkAccessToken checks the claims of an access token issued by this service
+func (s *Server) checkAccessToken(claims accessTokenClaims) error {
+	if claims.TokenUse != tokenUseAccess {
+		return errors.New("the token is not an access token")
+	}
+	// the access tokens of a jwt sign in are signed with the same key but not issued to a client
+	if claims.ClientID == "" {
+		return errors.New("the token was not issued to a client")
+	}
+	if claims.Issuer != strings.TrimSuffix(s.config.OIDCProviderIssuer, "/") {
+		return fmt.Errorf("the token was issued by %q", claims.Issuer)
+	}
+	if time.Now().After(time.Unix(claims.ExpiresAt, 0)) {
+		return errors.New("the token has expired")
+	}
+	return nil
+}
+
+// oidcSessionUser returns the user when the session the tokens were issued from is still signed in
+// and the account is active
+func (s *Server) oidcSessionUser(ctx context.Context, userID string, handle string) (*DatabaseUser, error) {
+	ids, err := s.getUserSessionIDs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	signedIn := false
+	for _, id := range ids {
+		if subtle.ConstantTimeCompare([]byte(sessionHandle(id)), []byte(handle)) == 1 {
+			signedIn = true
+		}
+	}
+	if !signedIn {
+		return nil, errors.New("The session has been signed out")
+	}
+
+	acc, err := s.lookupAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.active() {
+		return nil, errAccountSuspended
+	}
+
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.users.FindUserByID(ctx, id)
+}
+
+// allowsRedirectURI checks the redirect uri is one the client registered, they have to match exactly
+func (client *OIDCClient) allowsRedirectURI(redirectURI string) bool {
+	return redirectURI != "" && containsString(client.RedirectURIs, redirectURI)
+}
+
+// hashClientSecret hashes the secret of a client, the secrets are random so they do not need bcrypt
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// redirectOIDCError sends the browser back to the client with the error
+func redirectOIDCError(c echo.Context, redirectURI string, state string, code string) error {
+	query := url.Values{"error": {code}}
+	if state != "" {
+		query.Set("state", state)
+	}
+	return c.Redirect(http.StatusFound, withQuery(redirectURI, query))
+}
+
+// oidcTokenError answers the token endpoint with an error of RFC 6749 section 5.2
+func oidcTokenError(c echo.Context, status int, code string, description string) error {
+	return c.JSON(status, echo.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// bearerToken returns the token of the Authorization header or an empty string
+func bearerToken(c echo.Context) string {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// withQuery adds the query to the url, keeping the query it already has
+func withQuery(rawURL string, query url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + query.Encode()
+	}
+	return rawURL + "?" + query.Encode()
+}
+
+func containsString(values []string, wanted string) bool {
+	for _, value := range values {
+		if value == wanted {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package gosession
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testRedirectURI = "http://localhost:9000/callback"
+
+// oidcProviderServer returns a server that acts as a provider, with a client registered by an admin
+func oidcProviderServer(t *testing.T) (*Server, string, string) {
+	t.Helper()
+
+	server := newTestServer(t, func(config *ConfigApplication) {
+		config.OIDCProviderIssuer = "http://localhost:8080"
+	})
+
+	adminEmail := uniqueEmail("provider-admin")
+	insertUser(t, server, adminEmail, "password123456", "admin")
+	adminCookie := signInOn(t, server, adminEmail, "password123456")
+
+	rec := testRequest{method: http.MethodPost, path: "/oidc/clients", server: server, cookies: []*http.Cookie{adminCookie}, body: NewOIDCClient{
+		Name:         "Shop",
+		RedirectURIs: []string{testRedirectURI},
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	var created struct {
+		Client       OIDCClient `json:"client"`
+		ClientSecret string     `json:"clientSecret"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return server, created.Client.ClientID, created.ClientSecret
+}
+
+// authorizeClient calls the authorize endpoint with a PKCE challenge for the verifier and returns the redirect
+func authorizeClient(t *testing.T, server *Server, clientID string, verifier string, cookie *http.Cookie) *url.URL {
+	t.Helper()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"openid email"},
+		"state":                 {"state123"},
+		"nonce":                 {"nonce123"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	req := testRequest{method: http.MethodGet, path: "/oidc/authorize?" + query.Encode(), server: server}
+	if cookie != nil {
+		req.cookies = []*http.Cookie{cookie}
+	}
+	rec := req.do(t)
+	expectStatus(t, rec, http.StatusFound)
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+// exchangeCode calls the token endpoint the way a client does
+func exchangeCode(t *testing.T, server *Server, clientID string, secret string, code string, verifier string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oidc/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, secret)
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+// getUserInfo calls the userinfo endpoint with the token
+func getUserInfo(server *Server, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/oidc/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOIDCProviderSignsInAClient(t *testing.T) {
+	server, clientID, secret := oidcProviderServer(t)
+
+	email := uniqueEmail("provider")
+	insertUser(t, server, email, "password123456", "user")
+	user, err := server.users.FindUserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the browser is sent to the app to sign in first
+	location := authorizeClient(t, server, clientID, "verifier", nil)
+	if !strings.HasPrefix(location.String(), server.config.OIDCProviderSignInURL) || location.Query().Get("redirect") == "" {
+		t.Fatalf("expected to be sent to sign in but was sent to %s", location)
+	}
+
+	cookie := signInOn(t, server, email, "password123456")
+
+	// the code is refused with the wrong verifier and then can not be used again
+	location = authorizeClient(t, server, clientID, "verifier", cookie)
+	expectStatus(t, exchangeCode(t, server, clientID, secret, location.Query().Get("code"), "another verifier"), http.StatusBadRequest)
+
+	location = authorizeClient(t, server, clientID, "verifier", cookie)
+	if location.Query().Get("state") != "state123" || location.Query().Get("code") == "" {
+		t.Fatalf("expected a code and the state but was sent to %s", location)
+	}
+	code := location.Query().Get("code")
+
+	rec := exchangeCode(t, server, clientID, secret, code, "verifier")
+	expectStatus(t, rec, http.StatusOK)
+	var tokens oidcTokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, exchangeCode(t, server, clientID, secret, code, "verifier"), http.StatusBadRequest)
+
+	// the id token can be checked with the published key
+	rec = testRequest{method: http.MethodGet, path: "/.well-known/jwks.json", server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var keySet JWKSet
+	if err := json.Unmarshal(rec.Body.Bytes(), &keySet); err != nil {
+		t.Fatal(err)
+	}
+	var claims idTokenClaims
+	err = verifyRS256(tokens.IDToken, func(keyID string) (*rsa.PublicKey, error) {
+		return keySet.Keys[0].rsaPublicKey()
+	}, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != user.ID.Hex() || claims.Nonce != "nonce123" || !claims.Audience.contains(clientID) || claims.Email != email {
+		t.Fatalf("unexpected id token claims %+v", claims)
+	}
+
+	rec = getUserInfo(server, tokens.AccessToken)
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), email) {
+		t.Fatalf("expected the email in the user info but got %s", rec.Body.String())
+	}
+	expectStatus(t, getUserInfo(server, tokens.IDToken), http.StatusUnauthorized)
+
+	// signing out here also signs out of the client
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-out", server: server, cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	expectStatus(t, getUserInfo(server, tokens.AccessToken), http.StatusUnauthorized)
+}
+
+func TestOIDCProviderChecksTheClient(t *testing.T) {
+	server, clientID, _ := oidcProviderServer(t)
+
+	// a redirect uri that was not registered is never redirected to
+	query := url.Values{"response_type": {"code"}, "client_id": {clientID}, "redirect_uri": {"http://evil.com/callback"}, "scope": {"openid"}}
+	rec := testRequest{method: http.MethodGet, path: "/oidc/authorize?" + query.Encode(), server: server}.do(t)
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	email := uniqueEmail("provider")
+	insertUser(t, server, email, "password123456", "user")
+	cookie := signInOn(t, server, email, "password123456")
+
+	location := authorizeClient(t, server, clientID, "verifier", cookie)
+	expectStatus(t, exchangeCode(t, server, clientID, "wrong secret", location.Query().Get("code"), "verifier"), http.StatusUnauthorized)
+
+	// only admins can manage the clients
+	rec = testRequest{method: http.MethodGet, path: "/oidc/clients", server: server, cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+}
@@ -7,9 +7,7 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/go-playground/validator.v9"
 )
 
@@ -83,18 +81,18 @@ func (u *PostValidator) Validate(i interface{}) error {
 }
 
 // ConfigurePostRoutes - Configure all the routes for the posts here
-func configurePostRoutes() {
+func (s *Server) configurePostRoutes() {
 
 	// Get a specific post
 	// Docs: https://docs.mongodb.com/manual/reference/command/find/
-	e.GET("/posts/:id", getPost)
+	s.echo.GET("/posts/:id", s.getPost)
 
 	// Get a post page
-	e.GET("/posts", getPosts)
+	s.echo.GET("/posts", s.getPosts)
 
 	// Insert a new post for a user
 	// Docs: https://docs.mongodb.com/manual/reference/command/insert/
-	e.POST("/user/posts", postPosts)
+	s.echo.POST("/user/posts", s.postPosts)
 
 	// Update an post record in MongoDB
 	// Docs: https://docs.mongodb.com/manual/reference/command/findAndModify/
@@ -105,7 +103,7 @@ func configurePostRoutes() {
 	//e.DELETE("/posts/:id", deletePosts)
 }
 
-func getPost(c echo.Context) error {
+func (s *Server) getPost(c echo.Context) error {
 	// get all records as a cursor
 
 	if c.Param("id") == "" {
@@ -113,7 +111,6 @@ func getPost(c echo.Context) error {
 	}
 	id := c.Param("id")
 	objID, _ := primitive.ObjectIDFromHex(id)
-	query := bson.M{"_id": objID}
 
 	//db.inventory.find( { qty: { $eq: 20 } } )
 
@@ -160,9 +157,7 @@ func getPost(c echo.Context) error {
 		profitable := c.QueryParam("profitable")
 	*/
 
-	var post ReturnedPost
-
-	err := mg.Db.Collection("posts").FindOne(c.Request().Context(), &query).Decode(&post)
+	post, err := s.posts.FindPostByID(c.Request().Context(), objID)
 
 	if err != nil {
 		fmt.Println(err.Error())
@@ -173,24 +168,21 @@ func getPost(c echo.Context) error {
 	return c.JSON(http.StatusOK, post)
 }
 
-func getPosts(c echo.Context) error {
+func (s *Server) getPosts(c echo.Context) error {
 	// get all records as a cursor
 
 	afterID := c.QueryParam("afterID")
 	fmt.Println(afterID)
-	var query = bson.M{}
-	opts := options.Find().
-		SetSort(bson.M{"_id": 1}).
-		SetLimit(3) // TODO
+	var limit int64 = 3 // TODO
 
+	var convertedAfterID primitive.ObjectID
 	if afterID != "" {
-		convertedAfterID, err := primitive.ObjectIDFromHex(afterID)
+		var err error
+		convertedAfterID, err = primitive.ObjectIDFromHex(afterID)
 		if err != nil {
 			fmt.Println(err)
 		}
 		fmt.Println(convertedAfterID)
-
-		query = bson.M{"_id": bson.M{"$gt": convertedAfterID}}
 	} else {
 		fmt.Println("Should only send back first page")
 	}
@@ -244,45 +236,34 @@ func getPosts(c echo.Context) error {
 
 	// TODO dont returned createdBy, instead get the brand name to send back
 
-	//var posts ReturnedPost
-	var posts []ReturnedPost
 	//.find(index).limit(amount)
-	//query := bson.M{}
-	//ctx, query, opts
-	cur, err := mg.Db.Collection("posts").Find(c.Request().Context(), query, opts)
+	posts, err := s.posts.FindPosts(c.Request().Context(), convertedAfterID, limit)
 	if err != nil {
 		fmt.Println(err)
 	}
-	if err = cur.All(c.Request().Context(), &posts); err != nil {
-		// Handle error
-	}
 
 	// return posts list in JSON format
 	return c.JSON(http.StatusOK, posts)
 }
 
 // TODO return post after submitted
-func postPosts(c echo.Context) error {
+func (s *Server) postPosts(c echo.Context) error {
 
 	fmt.Println("STARTING post posts")
 
-	postsCollection := mg.Db.Collection("posts")
-
-	store := redisSessionInstance.Store
-
-	session, err := store.Get(c.Request(), "session_")
+	session, err := s.getSession(c)
 	if err != nil {
 		return c.String(http.StatusNotAcceptable, "failed getting session")
 	}
 
-	userID := session.Values["userID"]
-	if err != nil {
+	userID, ok := session.Values["userID"].(string)
+	if !ok {
 		return c.String(http.StatusNotFound, "This user id is invalid")
 	}
 
 	// Get the user object ID from provided hex
-	fmt.Println(userID.(string))
-	userObjectID, err := primitive.ObjectIDFromHex(userID.(string))
+	fmt.Println(userID)
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		return c.String(http.StatusNotFound, "This user id is invalid")
 	}
@@ -323,14 +304,14 @@ func postPosts(c echo.Context) error {
 		return c.JSON(http.StatusPartialContent, err.Error())
 	}
 
-	insertedPost, err := postsCollection.InsertOne(c.Request().Context(), databasePost)
+	insertedPostID, err := s.posts.InsertPost(c.Request().Context(), databasePost)
 	if err != nil {
 		// TODO - Unable to register, please contact support.
 		log.Printf("Unable to insert new post :%v", err)
 		return err
 	}
 	fmt.Println("post created by user: " + " with the id: ")
-	fmt.Println(insertedPost.InsertedID)
+	fmt.Println(insertedPostID)
 
 	// convert databasePost to ReturnedPost then return that
 
@@ -0,0 +1,164 @@
+package gosession
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/ulule/limiter/v3"
+)
+
+/*
+	RATE LIMIT SYSTEM
+
+	Every route that is rate limited gets its own limiter and its own key prefix in the limiter store,
+	so the calls to one route do not use up the limit of another.
+
+	The limit of a route is declared in the config by its name, RATE_LIMITS is a comma separated list of
+	name=rate where the rate is in the limiter format, 100-M is 100 calls a minute. Routes that are not
+	in the list use RATE_LIMIT_DEFAULT.
+
+	The key decides who shares a limit, it can be the ip, the signed in user, the api key or a composite
+	of them. Keying signed in routes by the user stops users behind the same NAT from being throttled together.
+	https://auth0.com/docs/policies/rate-limit-policy/database-connections-rate-limits
+
+*/
+
+const (
+	rateLimitPrefix = "rate_limit_"
+
+	// HeaderAPIKey is the header the api key is read from
+	HeaderAPIKey = "X-API-Key"
+)
+
+// RateLimitKey returns the key the calls are counted under
+type RateLimitKey func(c echo.Context) string
+
+// RateLimitByIP counts the calls of each ip
+func RateLimitByIP(c echo.Context) string {
+	return "ip:" + c.RealIP()
+}
+
+// RateLimitByAPIKey counts the calls of each api key, calls without one are counted by ip.
+// The key is not checked here, so it must only be used on routes where the api key was
+// authenticated first, otherwise a caller gets a new limit by sending a new key every time
+func RateLimitByAPIKey(c echo.Context) string {
+	apiKey := c.Request().Header.Get(HeaderAPIKey)
+	if apiKey == "" {
+		return RateLimitByIP(c)
+	}
+
+	// the api key is a secret so only its hash is kept in the limiter store
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key:" + hex.EncodeToString(sum[:16])
+}
+
+// RateLimitByUser counts the calls of each signed in user, calls without a session are counted by ip
+func (s *Server) RateLimitByUser(c echo.Context) string {
+	session, err := s.getSession(c)
+	if err != nil {
+		return RateLimitByIP(c)
+	}
+
+	userID, _ := session.Values["userID"].(string)
+	if userID == "" {
+		return RateLimitByIP(c)
+	}
+	return "user:" + userID
+}
+
+// RateLimitComposite counts the calls of each combination of the keys
+func RateLimitComposite(keys ...RateLimitKey) RateLimitKey {
+	return func(c echo.Context) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = key(c)
+		}
+		return strings.Join(parts, "|")
+	}
+}
+
+// RateLimit limits the calls to the route named name to the rate given to it in the config,
+// the calls are counted under the key
+func (s *Server) RateLimit(name string, key RateLimitKey) echo.MiddlewareFunc {
+	return s.rateLimit(name, s.routeRate(name), key)
+}
+
+// rateLimit returns the middleware with its own limiter, the calls are counted under the name
+func (s *Server) rateLimit(name string, rate limiter.Rate, key RateLimitKey) echo.MiddlewareFunc {
+	// 1. Configure
+	routeLimiter := limiter.New(s.limiterStore, rate)
+
+	// 2. Return middleware handler
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			limiterKey := key(c)
+			limiterCtx, err := routeLimiter.Get(c.Request().Context(), rateLimitPrefix+name+"_"+limiterKey)
+			if err != nil {
+				log.Printf("RateLimit - routeLimiter.Get - err: %v, %s on %s", err, limiterKey, c.Request().URL)
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"success": false,
+					"message": err,
+				})
+			}
+
+			h := c.Response().Header()
+
+			h.Set("X-RateLimit-Limit", strconv.FormatInt(limiterCtx.Limit, 10))
+			h.Set("X-RateLimit-Remaining", strconv.FormatInt(limiterCtx.Remaining, 10))
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(limiterCtx.Reset, 10))
+
+			if limiterCtx.Reached {
+				log.Printf("Too Many Requests from %s on %s", limiterKey, c.Request().URL)
+				return tooManyRequests(c, untilReset(limiterCtx), "Too many calls to this endpoint, please try again later")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// routeRate returns the rate the config gives the route, or the default rate
+func (s *Server) routeRate(name string) limiter.Rate {
+	rates, err := parseRateLimits(s.config.RateLimits)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if rate, ok := rates[name]; ok {
+		return rate
+	}
+
+	rate, err := limiter.NewRateFromFormatted(s.config.RateLimitDefault)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return rate
+}
+
+// parseRateLimits reads the name=rate entries of RATE_LIMITS
+func parseRateLimits(entries []string) (map[string]limiter.Rate, error) {
+	rates := make(map[string]limiter.Rate, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return rates, fmt.Errorf("the rate limit %q must be name=rate", entry)
+		}
+
+		rate, err := limiter.NewRateFromFormatted(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return rates, fmt.Errorf("the rate limit %q has an invalid rate: %v", entry, err)
+		}
+		rates[strings.TrimSpace(parts[0])] = rate
+	}
+	return rates, nil
+}
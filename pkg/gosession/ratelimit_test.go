@@ -0,0 +1,145 @@
+package gosession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// rateLimitedServer returns a server with two routes that are limited to 2 calls a minute
+func rateLimitedServer(t *testing.T, key func(s *Server) RateLimitKey) *Server {
+	t.Helper()
+
+	server := newTestServer(t, func(config *ConfigApplication) {
+		config.RateLimitDefault = "100-M"
+		config.RateLimits = []string{"first=2-M", "second=2-M"}
+	})
+
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	}
+	server.echo.GET("/first", ok, server.RateLimit("first", key(server)))
+	server.echo.GET("/second", ok, server.RateLimit("second", key(server)))
+	server.echo.GET("/third", ok, server.RateLimit("third", key(server)))
+	return server
+}
+
+func callLimited(t *testing.T, server *Server, path string, ip string, apiKey string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set(echo.HeaderXRealIP, ip)
+	if apiKey != "" {
+		req.Header.Set(HeaderAPIKey, apiKey)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimitIsPerRoute(t *testing.T) {
+	server := rateLimitedServer(t, func(s *Server) RateLimitKey { return RateLimitByIP })
+	ip := unique("10.2.0.")
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, callLimited(t, server, "/first", ip, ""), http.StatusOK)
+	}
+	rec := callLimited(t, server, "/first", ip, "")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header")
+	}
+	if rec.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("expected no remaining calls but got %s", rec.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	// other ips have their own limit
+	expectStatus(t, callLimited(t, server, "/first", unique("10.2.0."), ""), http.StatusOK)
+
+	// the other routes have their own limits
+	expectStatus(t, callLimited(t, server, "/second", ip, ""), http.StatusOK)
+
+	rec = callLimited(t, server, "/third", ip, "")
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("X-RateLimit-Limit") != "100" {
+		t.Fatalf("expected the default limit but got %s", rec.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
+func TestRateLimitByUser(t *testing.T) {
+	server := rateLimitedServer(t, func(s *Server) RateLimitKey { return s.RateLimitByUser })
+	ip := unique("10.2.1.")
+	password := "password1234"
+
+	var cookies []*http.Cookie
+	for i := 0; i < 2; i++ {
+		email := uniqueEmail("rate-limit")
+		insertUser(t, server, email, password, "user")
+		rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}, ip: ip, server: server}.do(t)
+		expectStatus(t, rec, http.StatusOK)
+		cookies = append(cookies, sessionCookie(t, rec))
+	}
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, callLimited(t, server, "/first", ip, "", cookies[0]), http.StatusOK)
+	}
+	expectStatus(t, callLimited(t, server, "/first", ip, "", cookies[0]), http.StatusTooManyRequests)
+
+	// another user behind the same ip is not throttled
+	expectStatus(t, callLimited(t, server, "/first", ip, "", cookies[1]), http.StatusOK)
+
+	// calls without a session are counted by ip
+	expectStatus(t, callLimited(t, server, "/first", ip, ""), http.StatusOK)
+}
+
+func TestRateLimitByAPIKeyAndComposite(t *testing.T) {
+	server := rateLimitedServer(t, func(s *Server) RateLimitKey { return RateLimitComposite(RateLimitByAPIKey, RateLimitByIP) })
+	ip := unique("10.2.2.")
+	apiKey := unique("api-key-")
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, callLimited(t, server, "/first", ip, apiKey), http.StatusOK)
+	}
+	expectStatus(t, callLimited(t, server, "/first", ip, apiKey), http.StatusTooManyRequests)
+
+	// the same key from another ip and another key from the same ip are counted apart
+	expectStatus(t, callLimited(t, server, "/first", unique("10.2.2."), apiKey), http.StatusOK)
+	expectStatus(t, callLimited(t, server, "/first", ip, unique("api-key-")), http.StatusOK)
+}
+
+func TestParseRateLimits(t *testing.T) {
+	rates, err := parseRateLimits([]string{"users=10-M", " login = 5-S ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates["users"].Limit != 10 || rates["users"].Period != time.Minute {
+		t.Fatalf("expected 10 calls a minute but got %+v", rates["users"])
+	}
+	if rates["login"].Limit != 5 || rates["login"].Period != time.Second {
+		t.Fatalf("expected 5 calls a second but got %+v", rates["login"])
+	}
+
+	for _, entry := range []string{"users", "=10-M", "users=10-Y", "users=ten-M"} {
+		if _, err := parseRateLimits([]string{entry}); err == nil {
+			t.Fatalf("expected %q to be invalid", entry)
+		}
+	}
+}
+
+func TestEmailExistsIsRateLimited(t *testing.T) {
+	server := newTestServer(t, func(config *ConfigApplication) {
+		config.RateLimits = []string{"email_exists=2-M"}
+	})
+	ip := unique("10.2.4.")
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, callLimited(t, server, "/auth/emails/"+uniqueEmail("exists"), ip, ""), http.StatusNotFound)
+	}
+	expectStatus(t, callLimited(t, server, "/auth/emails/"+uniqueEmail("exists"), ip, ""), http.StatusTooManyRequests)
+}
@@ -0,0 +1,506 @@
+package gosession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+	RBAC SYSTEM
+
+	The role based access control system decides what each role is allowed to do.
+	A policy lists the roles with the permissions they have and the roles they inherit from,
+	a role has every permission of the roles it inherits. The * permission allows everything.
+	The policy can also give a route a permission, only roles with that permission can use the route.
+
+	The policy is loaded from a json file, from the policies collection in mongo or the default
+	policy below is used. It is selected with the RBAC_POLICY_STORE config value and is reloaded
+	every RBAC_RELOAD_INTERVAL seconds so roles and route permissions can change without a deploy.
+	A policy that fails to load or compile is ignored and the previous one is kept.
+
+*/
+
+const (
+	// PolicyStoreFile loads the policy from the RBAC_POLICY_FILE json file
+	PolicyStoreFile = "FILE"
+	// PolicyStoreMongo loads the policy from the policies collection
+	PolicyStoreMongo = "MONGO"
+	// PolicyStoreDefault uses the default policy and never reloads it
+	PolicyStoreDefault = "DEFAULT"
+
+	// permissionAll allows every permission
+	permissionAll = "*"
+)
+
+var errUnknownRole = errors.New("This role does not exist")
+
+// Policy is the list of roles and the permissions needed for the routes
+type Policy struct {
+	Roles  []RolePolicy  `json:"roles" bson:"roles"`
+	Routes []RoutePolicy `json:"routes" bson:"routes"`
+}
+
+// RolePolicy is a role with its own permissions and the roles it inherits from
+type RolePolicy struct {
+	Name        string   `json:"name" bson:"name"`
+	Inherits    []string `json:"inherits,omitempty" bson:"inherits,omitempty"`
+	Permissions []string `json:"permissions,omitempty" bson:"permissions,omitempty"`
+}
+
+// RoutePolicy is the permission needed to use the route, the path is the path the route was registered with
+type RoutePolicy struct {
+	Method     string `json:"method" bson:"method"`
+	Path       string `json:"path" bson:"path"`
+	Permission string `json:"permission" bson:"permission"`
+}
+
+// Role is a role of the loaded policy with every permission it has
+type Role struct {
+	Name        string   `json:"name"`
+	Inherits    []string `json:"inherits,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+// AssignRole is used by an admin to change the role of a user
+type AssignRole struct {
+	Role string `json:"role" bson:"role" validate:"required,min=1,max=64"`
+}
+
+// defaultPolicy is used when no policy store is configured, it matches the user and admin roles of the routes
+func defaultPolicy() *Policy {
+	return &Policy{
+		Roles: []RolePolicy{
+			{Name: "user", Permissions: []string{"sessions:manage", "posts:create"}},
+			{Name: "admin", Inherits: []string{"user"}, Permissions: []string{permissionAll}},
+		},
+		Routes: []RoutePolicy{
+			{Method: http.MethodGet, Path: "/rbac/roles", Permission: "roles:read"},
+			{Method: http.MethodPut, Path: "/users/:id/role", Permission: "roles:assign"},
+			{Method: http.MethodPost, Path: "/rbac/reload", Permission: "policy:reload"},
+			{Method: http.MethodGet, Path: "/users", Permission: "users:list"},
+			{Method: http.MethodPut, Path: "/users/:id/status", Permission: "users:suspend"},
+			{Method: http.MethodPost, Path: "/oidc/clients", Permission: "oidc:clients"},
+			{Method: http.MethodGet, Path: "/oidc/clients", Permission: "oidc:clients"},
+			{Method: http.MethodDelete, Path: "/oidc/clients/:clientID", Permission: "oidc:clients"},
+		},
+	}
+}
+
+// POLICY SOURCES --------------------------------------------------------------------------
+
+// PolicySource loads the policy, it is called again every time the policy is reloaded
+type PolicySource interface {
+	LoadPolicy(ctx context.Context) (*Policy, error)
+}
+
+// FilePolicySource loads the policy from a json file
+type FilePolicySource struct {
+	Path string
+}
+
+// NewFilePolicySource returns a policy source that reads the json file at path
+func NewFilePolicySource(path string) *FilePolicySource {
+	return &FilePolicySource{Path: path}
+}
+
+// LoadPolicy reads and decodes the policy file
+func (f *FilePolicySource) LoadPolicy(ctx context.Context) (*Policy, error) {
+	content, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy Policy
+	err = json.Unmarshal(content, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding the policy file %s: %v", f.Path, err)
+	}
+	return &policy, nil
+}
+
+// MongoPolicySource loads the policy document named default from the policies collection
+type MongoPolicySource struct {
+	collection *mongo.Collection
+}
+
+// NewMongoPolicySource returns a policy source backed by the policies collection of db
+func NewMongoPolicySource(db *mongo.Database) *MongoPolicySource {
+	return &MongoPolicySource{collection: db.Collection("policies")}
+}
+
+// LoadPolicy finds the default policy document
+func (m *MongoPolicySource) LoadPolicy(ctx context.Context) (*Policy, error) {
+	var policy Policy
+	err := m.collection.FindOne(ctx, bson.M{"name": "default"}).Decode(&policy)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &policy, nil
+}
+
+// staticPolicySource always returns the same policy
+type staticPolicySource struct {
+	policy *Policy
+}
+
+func (p staticPolicySource) LoadPolicy(ctx context.Context) (*Policy, error) {
+	return p.policy, nil
+}
+
+// ENGINE --------------------------------------------------------------------------
+
+// compiledPolicy is the policy with the inheritance of every role resolved
+type compiledPolicy struct {
+	roles map[string]*Role
+	// ancestors holds each role and every role it inherits from
+	ancestors   map[string]map[string]bool
+	permissions map[string]map[string]bool
+	routes      map[string]string
+}
+
+// rbacEngine holds the latest policy that compiled
+type rbacEngine struct {
+	source PolicySource
+
+	mu     sync.RWMutex
+	policy *compiledPolicy
+}
+
+// compilePolicy resolves the inheritance of every role and checks the policy is valid
+func compilePolicy(policy *Policy) (*compiledPolicy, error) {
+	definitions := map[string]RolePolicy{}
+	for _, role := range policy.Roles {
+		if role.Name == "" {
+			return nil, errors.New("every role of the policy needs a name")
+		}
+		if _, ok := definitions[role.Name]; ok {
+			return nil, fmt.Errorf("the role %s is in the policy more than once", role.Name)
+		}
+		definitions[role.Name] = role
+	}
+
+	compiled := &compiledPolicy{
+		roles:       map[string]*Role{},
+		ancestors:   map[string]map[string]bool{},
+		permissions: map[string]map[string]bool{},
+		routes:      map[string]string{},
+	}
+
+	// visit walks up the inheritance of the role, visiting holds the roles being walked to find cycles
+	visiting := map[string]bool{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		if _, ok := compiled.ancestors[name]; ok {
+			return nil
+		}
+		definition, ok := definitions[name]
+		if !ok {
+			return fmt.Errorf("the role %s is inherited but not in the policy", name)
+		}
+		if visiting[name] {
+			return fmt.Errorf("the role %s inherits from itself", name)
+		}
+		visiting[name] = true
+
+		ancestors := map[string]bool{name: true}
+		permissions := map[string]bool{}
+		for _, permission := range definition.Permissions {
+			permissions[permission] = true
+		}
+		for _, parent := range definition.Inherits {
+			if err := visit(parent); err != nil {
+				return err
+			}
+			for ancestor := range compiled.ancestors[parent] {
+				ancestors[ancestor] = true
+			}
+			for permission := range compiled.permissions[parent] {
+				permissions[permission] = true
+			}
+		}
+
+		visiting[name] = false
+		compiled.ancestors[name] = ancestors
+		compiled.permissions[name] = permissions
+		compiled.roles[name] = &Role{
+			Name:        name,
+			Inherits:    definition.Inherits,
+			Permissions: sortedKeys(permissions),
+		}
+		return nil
+	}
+
+	for _, role := range policy.Roles {
+		if err := visit(role.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, route := range policy.Routes {
+		if route.Method == "" || route.Path == "" || route.Permission == "" {
+			return nil, fmt.Errorf("the route %s %s needs a method, a path and a permission", route.Method, route.Path)
+		}
+		compiled.routes[routeKey(route.Method, route.Path)] = route.Permission
+	}
+
+	return compiled, nil
+}
+
+// reload loads and compiles the policy, the current policy is kept if that fails
+func (r *rbacEngine) reload(ctx context.Context) error {
+	policy, err := r.source.LoadPolicy(ctx)
+	if err != nil {
+		return err
+	}
+
+	compiled, err := compilePolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.policy = compiled
+	r.mu.Unlock()
+	return nil
+}
+
+// watch reloads the policy every interval until stop is closed
+func (r *rbacEngine) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := r.reload(ctx)
+			cancel()
+			if err != nil {
+				fmt.Println("failed reloading the rbac policy, keeping the previous one: ", err)
+			}
+		}
+	}
+}
+
+func (r *rbacEngine) current() *compiledPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policy
+}
+
+// hasRole checks if the role is the wanted role or inherits from it
+func (r *rbacEngine) hasRole(role string, wanted string) bool {
+	return r.current().ancestors[role][wanted]
+}
+
+// allowed checks if the role has the permission
+func (r *rbacEngine) allowed(role string, permission string) bool {
+	permissions := r.current().permissions[role]
+	return permissions[permission] || permissions[permissionAll]
+}
+
+// routePermission returns the permission the policy gives the route
+func (r *rbacEngine) routePermission(method string, path string) (string, bool) {
+	permission, ok := r.current().routes[routeKey(method, path)]
+	return permission, ok
+}
+
+// roleExists checks if the role is in the policy
+func (r *rbacEngine) roleExists(role string) bool {
+	_, ok := r.current().roles[role]
+	return ok
+}
+
+// roles returns every role of the policy sorted by name
+func (r *rbacEngine) roles() []*Role {
+	policy := r.current()
+
+	roles := make([]*Role, 0, len(policy.roles))
+	for _, name := range sortedRoleNames(policy.roles) {
+		roles = append(roles, policy.roles[name])
+	}
+	return roles
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureRBACRoutes - Configure all the routes for the roles here
+func (s *Server) configureRBACRoutes() {
+
+	// the permissions of these routes are given by the policy
+	s.echo.GET("/rbac/roles", s.getRoles, s.SessionMiddleware("user"), s.PermissionMiddleware("roles:read"))
+
+	s.echo.PUT("/users/:id/role", s.putUserRole, s.SessionMiddleware("user"), s.PermissionMiddleware("roles:assign"))
+
+	s.echo.POST("/rbac/reload", s.reloadPolicy, s.SessionMiddleware("user"), s.PermissionMiddleware("policy:reload"))
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// getRoles returns the roles of the policy with every permission they have
+func (s *Server) getRoles(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.rbac.roles())
+}
+
+// putUserRole changes the role of a user to one of the roles of the policy
+func (s *Server) putUserRole(c echo.Context) error {
+
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "This user id is invalid")
+	}
+
+	var assignRole AssignRole
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&assignRole); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(assignRole); err != nil {
+		log.Printf("Unable to validate the assignRole %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	if !s.rbac.roleExists(assignRole.Role) {
+		return c.String(http.StatusNotAcceptable, errUnknownRole.Error())
+	}
+
+	err = s.users.UpdateUser(c.Request().Context(), userID, bson.D{
+		{Key: "role", Value: assignRole.Role},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err == errNotFound {
+		return c.String(http.StatusNotFound, "No user found")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The role could not be changed")
+	}
+	s.accounts.forget(c.Param("id"))
+
+	return c.JSON(http.StatusOK, "User role has been changed")
+}
+
+// reloadPolicy loads the policy now instead of waiting for the next reload
+func (s *Server) reloadPolicy(c echo.Context) error {
+	err := s.rbac.reload(c.Request().Context())
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.JSON(http.StatusOK, "The policy has been reloaded")
+}
+
+// MIDDLEWARES --------------------------------------------------------------------------
+
+// PermissionMiddleware only lets users whose role has the permission through,
+// it must be used after SessionMiddleware
+func (s *Server) PermissionMiddleware(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !s.rbac.allowed(s.getUserRole(c), permission) {
+				return c.JSON(http.StatusForbidden, "access denied")
+			}
+			return next(c)
+		}
+	}
+}
+
+// RoutePermissionMiddleware checks the permission the policy gives the matched route,
+// routes that are not in the policy are let through
+func (s *Server) RoutePermissionMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			permission, ok := s.rbac.routePermission(c.Request().Method, c.Path())
+			if !ok {
+				return next(c)
+			}
+
+			role := s.getUserRole(c)
+			if role == "anonymous" {
+				return c.JSON(http.StatusUnauthorized, "authentication required")
+			}
+			if !s.rbac.allowed(role, permission) {
+				return c.JSON(http.StatusForbidden, "access denied")
+			}
+			return next(c)
+		}
+	}
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// configureRBAC loads the policy from the store selected in the config and starts reloading it
+func (s *Server) configureRBAC() error {
+	if s.policySource == nil {
+		switch strings.ToUpper(s.config.RBACPolicyStore) {
+		case PolicyStoreFile:
+			s.policySource = NewFilePolicySource(s.config.RBACPolicyFile)
+		case PolicyStoreMongo:
+			if s.mongo == nil {
+				return errors.New("the MONGO policy store needs the MONGO database store")
+			}
+			s.policySource = NewMongoPolicySource(s.mongo.Db)
+		default:
+			s.policySource = staticPolicySource{policy: defaultPolicy()}
+		}
+	}
+
+	s.rbac = &rbacEngine{source: s.policySource}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s.rbac.reload(ctx)
+	if err != nil {
+		return fmt.Errorf("failed loading the rbac policy: %v", err)
+	}
+
+	if _, ok := s.policySource.(staticPolicySource); !ok && s.config.RBACReloadInterval > 0 {
+		s.stopPolicyReload = make(chan struct{})
+		go s.rbac.watch(time.Duration(s.config.RBACReloadInterval)*time.Second, s.stopPolicyReload)
+	}
+	return nil
+}
+
+// routeKey is the key of the route in the compiled policy
+func routeKey(method string, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedRoleNames(roles map[string]*Role) []string {
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,135 @@
+package gosession
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompilePolicyResolvesInheritance(t *testing.T) {
+	compiled, err := compilePolicy(&Policy{
+		Roles: []RolePolicy{
+			{Name: "admin", Inherits: []string{"moderator"}, Permissions: []string{"users:delete"}},
+			{Name: "moderator", Inherits: []string{"user"}, Permissions: []string{"posts:hide"}},
+			{Name: "user", Permissions: []string{"posts:create"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"posts:create", "posts:hide", "users:delete"}
+	if got := compiled.roles["admin"].Permissions; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the admin permissions %v but got %v", want, got)
+	}
+	if !compiled.ancestors["admin"]["user"] || compiled.ancestors["user"]["admin"] {
+		t.Fatalf("expected admin to inherit from user and not the other way: %v", compiled.ancestors)
+	}
+
+	_, err = compilePolicy(&Policy{Roles: []RolePolicy{
+		{Name: "a", Inherits: []string{"b"}},
+		{Name: "b", Inherits: []string{"a"}},
+	}})
+	if err == nil {
+		t.Fatal("expected a cycle in the inheritance to fail")
+	}
+
+	_, err = compilePolicy(&Policy{Roles: []RolePolicy{
+		{Name: "a", Inherits: []string{"missing"}},
+	}})
+	if err == nil {
+		t.Fatal("expected inheriting from a missing role to fail")
+	}
+}
+
+func TestAssignRole(t *testing.T) {
+	password := "password1234"
+	adminEmail := uniqueEmail("roles-admin")
+	email := uniqueEmail("roles")
+
+	insertUser(t, testServer, adminEmail, password, "admin")
+	registerAndConfirm(t, email, password)
+	userCookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, userCookie)
+	adminCookie := signInAs(t, adminEmail, password)
+	path := "/users/" + user.ID.Hex() + "/role"
+
+	rec := testRequest{method: http.MethodPut, path: path, body: AssignRole{Role: "admin"}}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	rec = testRequest{method: http.MethodPut, path: path, body: AssignRole{Role: "admin"}, cookies: []*http.Cookie{userCookie}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	rec = testRequest{method: http.MethodPut, path: path, body: AssignRole{Role: "superuser"}, cookies: []*http.Cookie{adminCookie}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	rec = testRequest{method: http.MethodPut, path: path, body: AssignRole{Role: "admin"}, cookies: []*http.Cookie{adminCookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// the new role is used by the session the user already has, which gets a new id for it
+	rec = testRequest{method: http.MethodGet, path: "/rbac/roles", cookies: []*http.Cookie{userCookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	rotated := sessionCookie(t, rec)
+	if rotated.Value == userCookie.Value {
+		t.Fatal("expected the session to get a new id when the role changed")
+	}
+	if status, _ := getUserViaSessionCookie(t, userCookie); status == http.StatusOK {
+		t.Fatal("expected the old session id to be signed out")
+	}
+	if status, _ := getUserViaSessionCookie(t, rotated); status != http.StatusOK {
+		t.Fatalf("expected the new session id to be signed in but got %d", status)
+	}
+}
+
+func TestPolicyIsReloaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.json")
+
+	writePolicy := func(content string) {
+		if err := ioutil.WriteFile(policyFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePolicy(`{
+		"roles": [{"name": "user"}, {"name": "admin", "inherits": ["user"], "permissions": ["*"]}],
+		"routes": [{"method": "GET", "path": "/", "permission": "home:view"}]
+	}`)
+
+	server := newTestServer(t, nil, WithPolicySource(NewFilePolicySource(policyFile)))
+
+	email := uniqueEmail("reload")
+	password := "password1234"
+	insertUser(t, server, email, password, "user")
+	cookies := []*http.Cookie{signInOn(t, server, email, password)}
+
+	rec := testRequest{method: http.MethodGet, path: "/", cookies: cookies, server: server}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	writePolicy(`{
+		"roles": [{"name": "user", "permissions": ["home:view"]}, {"name": "admin", "inherits": ["user"], "permissions": ["*"]}],
+		"routes": [{"method": "GET", "path": "/", "permission": "home:view"}]
+	}`)
+	if err := server.rbac.reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = testRequest{method: http.MethodGet, path: "/", cookies: cookies, server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// a broken policy is ignored
+	writePolicy(`{"roles": [{"name": "user", "inherits": ["missing"]}]}`)
+	if err := server.rbac.reload(context.Background()); err == nil {
+		t.Fatal("expected the broken policy to fail")
+	}
+
+	rec = testRequest{method: http.MethodGet, path: "/", cookies: cookies, server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+}
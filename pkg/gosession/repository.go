@@ -0,0 +1,451 @@
+package gosession
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+	REPOSITORY SYSTEM
+
+	The repositories are the only place that talks to the database collections.
+	MongoDB is used in production and the memory repositories can be used to run the
+	service and its tests without a mongo container.
+	The repositories are selected with the DATABASE_STORE config value.
+
+*/
+
+const (
+	// DatabaseStoreMongo keeps the documents in mongo
+	DatabaseStoreMongo = "MONGO"
+	// DatabaseStoreMemory keeps the documents in the memory of this process
+	DatabaseStoreMemory = "MEMORY"
+)
+
+// errNotFound is returned by the repositories when no document matched
+var errNotFound = errors.New("No document found")
+
+// errDuplicate is returned by the repositories when a unique field already has the value in another document
+var errDuplicate = errors.New("A document with this value already exists")
+
+// mongoDuplicateKeyCode is the code of the mongo error for a unique index that was broken
+const mongoDuplicateKeyCode = 11000
+
+// UserRepository stores the users
+type UserRepository interface {
+	// InsertUser returns errDuplicate when another user has the email
+	InsertUser(ctx context.Context, user SubmitNewUser) (primitive.ObjectID, error)
+	FindUserByID(ctx context.Context, id primitive.ObjectID) (*DatabaseUser, error)
+	FindUserByEmail(ctx context.Context, email string) (*DatabaseUser, error)
+	// FindUserByIdentity returns the user the account of the provider is linked to
+	FindUserByIdentity(ctx context.Context, provider string, subject string) (*DatabaseUser, error)
+	// FindUsers runs the pipeline made by the filters system against the users
+	FindUsers(ctx context.Context, pipeline []bson.M) ([]*ExistingUser, error)
+	// UpdateUser sets the fields on the user with this id, it returns errDuplicate when the email is set to one
+	// another user has
+	UpdateUser(ctx context.Context, id primitive.ObjectID, fields bson.D) error
+	// UpdateUserByEmail sets the fields on the user with this email and returns the user before the update,
+	// like the original queries it is an upsert so errNotFound is returned after a user with only the email
+	// and the fields was inserted
+	UpdateUserByEmail(ctx context.Context, email string, fields bson.D) (*DatabaseUser, error)
+	// UpdateTOTPLastStep saves the step of the code that was used, it returns errNotFound when the same
+	// or a later step was used already so two requests can not both use the same code
+	UpdateTOTPLastStep(ctx context.Context, id primitive.ObjectID, step int64) error
+	// RemoveRecoveryCode removes the hash from the recovery codes of the user, it returns errNotFound
+	// when the hash was removed already so two requests can not both use the same recovery code
+	RemoveRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) error
+	// AddPasskey adds the passkey to the user, it returns errNotFound when the user already has it
+	// and errDuplicate when another user has a passkey with the same credential id
+	AddPasskey(ctx context.Context, id primitive.ObjectID, passkey Passkey) error
+	// UpdatePasskeySignCount saves the sign count and the last use of the passkey, it returns errNotFound
+	// when the passkey was used with the same or a higher count already so an assertion can only be used once
+	UpdatePasskeySignCount(ctx context.Context, id primitive.ObjectID, credentialID string, signCount int64, usedAt time.Time) error
+	// RemovePasskey removes the passkey from the user, it returns errNotFound when the user does not have it
+	RemovePasskey(ctx context.Context, id primitive.ObjectID, credentialID string) error
+	DeleteUser(ctx context.Context, id primitive.ObjectID) error
+}
+
+// EmailAuthTokenRepository stores the email auth tokens
+type EmailAuthTokenRepository interface {
+	InsertEmailAuthToken(ctx context.Context, token EmailAuthToken) error
+	FindEmailAuthToken(ctx context.Context, code string) (*EmailAuthToken, error)
+	DeleteEmailAuthToken(ctx context.Context, email string, code string) error
+	// DeleteEmailAuthTokensByMode deletes all the tokens of this email with this mode and returns how many were deleted
+	DeleteEmailAuthTokensByMode(ctx context.Context, email string, mode string) (int64, error)
+	// DeleteEmailAuthTokensByUser deletes all the tokens of this user with this mode and returns how many were deleted
+	DeleteEmailAuthTokensByUser(ctx context.Context, userID string, mode string) (int64, error)
+}
+
+// PostRepository stores the posts
+type PostRepository interface {
+	InsertPost(ctx context.Context, post DatabasePost) (primitive.ObjectID, error)
+	FindPostByID(ctx context.Context, id primitive.ObjectID) (*ReturnedPost, error)
+	// FindPosts returns a page of posts sorted by id that come after afterID, which can be nil
+	FindPosts(ctx context.Context, afterID primitive.ObjectID, limit int64) ([]ReturnedPost, error)
+}
+
+// OIDCClientRepository stores the clients of the OpenID Connect provider
+type OIDCClientRepository interface {
+	InsertOIDCClient(ctx context.Context, client OIDCClient) (primitive.ObjectID, error)
+	// FindOIDCClient returns the client with this client id
+	FindOIDCClient(ctx context.Context, clientID string) (*OIDCClient, error)
+	FindOIDCClients(ctx context.Context) ([]OIDCClient, error)
+	DeleteOIDCClient(ctx context.Context, clientID string) error
+}
+
+// NewMongoUserRepository returns a user repository backed by the users collection of db
+func NewMongoUserRepository(db *mongo.Database) UserRepository {
+	return &mongoUserRepository{collection: db.Collection("users")}
+}
+
+// CreateMongoUserIndexes creates the indexes of the users collection of db, an email and the credential id
+// of a passkey can only be on one user
+func CreateMongoUserIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("users").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "passkeys.id", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"passkeys.id": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+// NewMongoEmailAuthTokenRepository returns an email auth token repository backed by the emailAuthTokens collection of db
+func NewMongoEmailAuthTokenRepository(db *mongo.Database) EmailAuthTokenRepository {
+	return &mongoEmailAuthTokenRepository{collection: db.Collection("emailAuthTokens")}
+}
+
+// NewMongoPostRepository returns a post repository backed by the posts collection of db
+func NewMongoPostRepository(db *mongo.Database) PostRepository {
+	return &mongoPostRepository{collection: db.Collection("posts")}
+}
+
+// NewMongoOIDCClientRepository returns an OpenID Connect client repository backed by the oidcClients collection of db
+func NewMongoOIDCClientRepository(db *mongo.Database) OIDCClientRepository {
+	return &mongoOIDCClientRepository{collection: db.Collection("oidcClients")}
+}
+
+// MONGO USER REPOSITORY --------------------------------------------------------------------------
+
+type mongoUserRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoUserRepository) InsertUser(ctx context.Context, user SubmitNewUser) (primitive.ObjectID, error) {
+	result, err := r.collection.InsertOne(ctx, user)
+	if err != nil {
+		return primitive.NilObjectID, mongoError(err)
+	}
+	id, _ := result.InsertedID.(primitive.ObjectID)
+	return id, nil
+}
+
+func (r *mongoUserRepository) FindUserByID(ctx context.Context, id primitive.ObjectID) (*DatabaseUser, error) {
+	return r.findUser(ctx, bson.M{"_id": id})
+}
+
+func (r *mongoUserRepository) FindUserByEmail(ctx context.Context, email string) (*DatabaseUser, error) {
+	return r.findUser(ctx, bson.M{"email": email})
+}
+
+func (r *mongoUserRepository) FindUserByIdentity(ctx context.Context, provider string, subject string) (*DatabaseUser, error) {
+	return r.findUser(ctx, identityQuery(provider, subject))
+}
+
+func (r *mongoUserRepository) findUser(ctx context.Context, query bson.M) (*DatabaseUser, error) {
+	var user DatabaseUser
+	err := r.collection.FindOne(ctx, &query).Decode(&user)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &user, nil
+}
+
+func (r *mongoUserRepository) FindUsers(ctx context.Context, pipeline []bson.M) ([]*ExistingUser, error) {
+	cur, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var users []*ExistingUser
+	for cur.Next(ctx) {
+		var user *ExistingUser
+		if err = cur.Decode(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, cur.Err()
+}
+
+func (r *mongoUserRepository) UpdateUser(ctx context.Context, id primitive.ObjectID, fields bson.D) error {
+	query := bson.D{{Key: "_id", Value: id}}
+	update := bson.D{{Key: "$set", Value: fields}}
+
+	return mongoError(r.collection.FindOneAndUpdate(ctx, &query, &update).Err())
+}
+
+func (r *mongoUserRepository) UpdateUserByEmail(ctx context.Context, email string, fields bson.D) (*DatabaseUser, error) {
+	query := bson.D{{Key: "email", Value: email}}
+	update := bson.D{{Key: "$set", Value: fields}}
+	opts := options.FindOneAndUpdate().SetUpsert(true)
+
+	var user DatabaseUser
+	err := r.collection.FindOneAndUpdate(ctx, &query, &update, opts).Decode(&user)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &user, nil
+}
+
+func (r *mongoUserRepository) UpdateTOTPLastStep(ctx context.Context, id primitive.ObjectID, step int64) error {
+	query := bson.M{"_id": id, "$or": totpLastStepBefore(step)}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "totpLastStep", Value: step}}}}
+
+	return mongoError(r.collection.FindOneAndUpdate(ctx, query, &update).Err())
+}
+
+func (r *mongoUserRepository) RemoveRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) error {
+	query := bson.M{"_id": id, "recoveryCodes": hash}
+	update := bson.D{{Key: "$pull", Value: bson.D{{Key: "recoveryCodes", Value: hash}}}}
+
+	return mongoError(r.collection.FindOneAndUpdate(ctx, query, &update).Err())
+}
+
+func (r *mongoUserRepository) AddPasskey(ctx context.Context, id primitive.ObjectID, passkey Passkey) error {
+	query := bson.M{"_id": id, "passkeys.id": bson.M{"$ne": passkey.ID}}
+	update := bson.D{
+		{Key: "$push", Value: bson.D{{Key: "passkeys", Value: passkey}}},
+		{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: time.Now().UTC()}}},
+	}
+
+	return mongoError(r.collection.FindOneAndUpdate(ctx, query, &update).Err())
+}
+
+func (r *mongoUserRepository) UpdatePasskeySignCount(ctx context.Context, id primitive.ObjectID, credentialID string, signCount int64, usedAt time.Time) error {
+	query := bson.M{"_id": id, "passkeys": passkeySignCountBefore(credentialID, signCount)}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "passkeys.$[passkey].signCount", Value: signCount},
+		{Key: "passkeys.$[passkey].lastUsedAt", Value: usedAt},
+	}}}
+	opts := options.FindOneAndUpdate().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"passkey.id": credentialID}},
+	})
+
+	return mongoError(r.collection.FindOneAndUpdate(ctx, query, &update, opts).Err())
+}
+
+func (r *mongoUserRepository) RemovePasskey(ctx context.Context, id primitive.ObjectID, credentialID string) error {
+	query := bson.M{"_id": id, "passkeys.id": credentialID}
+	update := bson.D{
+		{Key: "$pull", Value: bson.D{{Key: "passkeys", Value: bson.M{"id": credentialID}}}},
+		{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: time.Now().UTC()}}},
+	}
+
+	return mongoError(r.collection.FindOneAndUpdate(ctx, query, &update).Err())
+}
+
+func (r *mongoUserRepository) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	query := bson.D{{Key: "_id", Value: id}}
+	result, err := r.collection.DeleteOne(ctx, &query)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount < 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+// MONGO EMAIL AUTH TOKEN REPOSITORY --------------------------------------------------------------------------
+
+type mongoEmailAuthTokenRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoEmailAuthTokenRepository) InsertEmailAuthToken(ctx context.Context, token EmailAuthToken) error {
+	_, err := r.collection.InsertOne(ctx, token)
+	return err
+}
+
+func (r *mongoEmailAuthTokenRepository) FindEmailAuthToken(ctx context.Context, code string) (*EmailAuthToken, error) {
+	var token EmailAuthToken
+	query := bson.M{"code": code}
+	err := r.collection.FindOne(ctx, &query).Decode(&token)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &token, nil
+}
+
+func (r *mongoEmailAuthTokenRepository) DeleteEmailAuthToken(ctx context.Context, email string, code string) error {
+	query := bson.D{
+		{Key: "email", Value: email},
+		{Key: "code", Value: code},
+	}
+	result, err := r.collection.DeleteOne(ctx, &query)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount < 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *mongoEmailAuthTokenRepository) DeleteEmailAuthTokensByMode(ctx context.Context, email string, mode string) (int64, error) {
+	query := bson.D{
+		{Key: "email", Value: email},
+		{Key: "mode", Value: mode},
+	}
+	result, err := r.collection.DeleteMany(ctx, &query)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (r *mongoEmailAuthTokenRepository) DeleteEmailAuthTokensByUser(ctx context.Context, userID string, mode string) (int64, error) {
+	query := bson.D{
+		{Key: "userID", Value: userID},
+		{Key: "mode", Value: mode},
+	}
+	result, err := r.collection.DeleteMany(ctx, &query)
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// MONGO POST REPOSITORY --------------------------------------------------------------------------
+
+type mongoPostRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoPostRepository) InsertPost(ctx context.Context, post DatabasePost) (primitive.ObjectID, error) {
+	result, err := r.collection.InsertOne(ctx, post)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	id, _ := result.InsertedID.(primitive.ObjectID)
+	return id, nil
+}
+
+func (r *mongoPostRepository) FindPostByID(ctx context.Context, id primitive.ObjectID) (*ReturnedPost, error) {
+	var post ReturnedPost
+	query := bson.M{"_id": id}
+	err := r.collection.FindOne(ctx, &query).Decode(&post)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &post, nil
+}
+
+func (r *mongoPostRepository) FindPosts(ctx context.Context, afterID primitive.ObjectID, limit int64) ([]ReturnedPost, error) {
+	var query = bson.M{}
+	if !afterID.IsZero() {
+		query = bson.M{"_id": bson.M{"$gt": afterID}}
+	}
+	opts := options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetLimit(limit)
+
+	cur, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var posts []ReturnedPost
+	if err = cur.All(ctx, &posts); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// MONGO OIDC CLIENT REPOSITORY --------------------------------------------------------------------------
+
+type mongoOIDCClientRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoOIDCClientRepository) InsertOIDCClient(ctx context.Context, client OIDCClient) (primitive.ObjectID, error) {
+	result, err := r.collection.InsertOne(ctx, client)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	id, _ := result.InsertedID.(primitive.ObjectID)
+	return id, nil
+}
+
+func (r *mongoOIDCClientRepository) FindOIDCClient(ctx context.Context, clientID string) (*OIDCClient, error) {
+	var client OIDCClient
+	query := bson.M{"clientID": clientID}
+	err := r.collection.FindOne(ctx, &query).Decode(&client)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return &client, nil
+}
+
+func (r *mongoOIDCClientRepository) FindOIDCClients(ctx context.Context) ([]OIDCClient, error) {
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+
+	cur, err := r.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []OIDCClient
+	if err = cur.All(ctx, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (r *mongoOIDCClientRepository) DeleteOIDCClient(ctx context.Context, clientID string) error {
+	query := bson.D{{Key: "clientID", Value: clientID}}
+	result, err := r.collection.DeleteOne(ctx, &query)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount < 1 {
+		return errNotFound
+	}
+	return nil
+}
+
+// mongoError converts the mongo no documents error into errNotFound and the duplicate key error into errDuplicate
+func mongoError(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return errNotFound
+	}
+
+	switch e := err.(type) {
+	case mongo.CommandError:
+		if e.Code == mongoDuplicateKeyCode {
+			return errDuplicate
+		}
+	case mongo.WriteException:
+		for _, writeError := range e.WriteErrors {
+			if writeError.Code == mongoDuplicateKeyCode {
+				return errDuplicate
+			}
+		}
+	}
+	return err
+}
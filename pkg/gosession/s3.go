@@ -40,14 +40,14 @@ type ReturnedS3File struct {
 
 // Configuration Section --------------------------------------------
 
-func configureS3Routes() {
+func (s *Server) configureS3Routes() {
 
-	e.POST("/user/upload-file", uploadFileToS3)
+	s.echo.POST("/user/upload-file", s.uploadFileToS3)
 
 }
 
 // endpoint for sending a file to s3-service and returning a url
-func uploadFileToS3(c echo.Context) error {
+func (s *Server) uploadFileToS3(c echo.Context) error {
 
 	// this is the name of the file
 	name := c.FormValue("name")
@@ -96,8 +96,7 @@ func uploadFileToS3(c echo.Context) error {
 		return c.String(http.StatusNotFound, err.Error())
 	}
 	// create request to the s3 service
-	// TODO update endpoint in production
-	resp, err := http.NewRequest("POST", "http://127.0.0.1:8082/send-s3-file", bytes.NewBuffer(byteInfo))
+	resp, err := http.NewRequest("POST", s.config.S3ServiceURL+"/send-s3-file", bytes.NewBuffer(byteInfo))
 	if err != nil {
 		fmt.Println("error creating the post request")
 		fmt.Println(err)
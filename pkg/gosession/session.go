@@ -0,0 +1,446 @@
+package gosession
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+	SESSION INDEX SYSTEM
+
+	Every session is stored by the session store, in redis under "session_<sessionID>".
+	Alongside these keys we keep an index per user, in redis a sorted set under
+	"user_sessions_<userID>", that holds the ids of all the sessions belonging to that user
+	ordered by the time they were created. This lets us count, evict and revoke the sessions of a user.
+
+	Details about each session (when it was created, last seen, ip and user agent) are kept
+	as well, in redis a hash under "session_info_<sessionID>", so users can see their signed in devices.
+	The session id is never sent back to the user, sessions are referred to by a handle
+	that is derived from the session id instead.
+
+	A signed in session ends when it has not been used for the idle timeout or when it reaches
+	its lifetime, whichever comes first. Both can be set per role. Every request through
+	SessionMiddleware extends the idle timeout, the lifetime is never extended so the user
+	has to sign in again once it is over.
+
+*/
+
+const (
+	sessionKeyPrefix      = "session_"
+	sessionInfoKeyPrefix  = "session_info_"
+	userSessionsKeyPrefix = "user_sessions_"
+	temporaryKeyPrefix    = "temporary_"
+
+	// MaxSessionsPolicyReject will refuse a sign in once the limit is reached
+	MaxSessionsPolicyReject = "REJECT"
+	// MaxSessionsPolicyEvictOldest will sign out the oldest session once the limit is reached
+	MaxSessionsPolicyEvictOldest = "EVICT_OLDEST"
+)
+
+var errMaxSessionsReached = errors.New("The maximum amount of sessions for this account has been reached")
+
+// SessionInfo is the information about a session that is shown to the user
+type SessionInfo struct {
+	Handle    string    `json:"handle"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Current   bool      `json:"current"`
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureSessionRoutes - Configure all the routes for managing sessions here
+func (s *Server) configureSessionRoutes() {
+
+	// lists the signed in devices of the current user
+	s.echo.GET("/auth/sessions", s.getSessions, s.SessionMiddleware("user"))
+
+	// signs out all the other devices of the current user
+	s.echo.DELETE("/auth/sessions", s.deleteOtherSessions, s.SessionMiddleware("user"))
+
+	// signs out one of the devices of the current user
+	s.echo.DELETE("/auth/sessions/:handle", s.deleteSession, s.SessionMiddleware("user"))
+
+	// signs out every device of any user
+	s.echo.DELETE("/users/:id/sessions", s.deleteAllSessionsOfUser, s.SessionMiddleware("admin"))
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// getSessions returns the information of all the sessions for the signed in user
+func (s *Server) getSessions(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+	userID, ok := session.Values["userID"].(string)
+	if !ok || userID == "" {
+		return c.String(http.StatusUnauthorized, "authentication required")
+	}
+
+	ids, err := s.getUserSessionIDs(ctx, userID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "failed getting sessions")
+	}
+
+	infos := []SessionInfo{}
+	for _, id := range ids {
+		info, err := s.getSessionInfo(ctx, id)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		info.Current = id == session.ID
+		infos = append(infos, info)
+	}
+
+	return c.JSON(http.StatusOK, infos)
+}
+
+// deleteSession signs out the session with this handle if it belongs to the signed in user
+func (s *Server) deleteSession(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+	userID, ok := session.Values["userID"].(string)
+	if !ok || userID == "" {
+		return c.String(http.StatusUnauthorized, "authentication required")
+	}
+
+	handle := c.Param("handle")
+	if handle == "" {
+		return c.String(http.StatusNotFound, "This session does not exist")
+	}
+
+	ids, err := s.getUserSessionIDs(ctx, userID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "failed getting sessions")
+	}
+
+	for _, id := range ids {
+		if sessionHandle(id) != handle {
+			continue
+		}
+		if err := s.deleteUserSession(ctx, userID, id); err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusNotFound, "failed deleting session")
+		}
+		return c.JSON(http.StatusOK, "session signed out")
+	}
+
+	return c.String(http.StatusNotFound, "This session does not exist")
+}
+
+// deleteOtherSessions signs out every session of the signed in user except the current one
+func (s *Server) deleteOtherSessions(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+	userID, ok := session.Values["userID"].(string)
+	if !ok || userID == "" {
+		return c.String(http.StatusUnauthorized, "authentication required")
+	}
+
+	count, err := s.deleteAllUserSessions(ctx, userID, session.ID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "failed deleting sessions")
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"signedOut": count})
+}
+
+// deleteAllSessionsOfUser signs out every session of the user with this id
+func (s *Server) deleteAllSessionsOfUser(c echo.Context) error {
+
+	id := c.Param("id")
+	if id == "" {
+		return c.String(http.StatusNotFound, "This user id does not exist")
+	}
+
+	count, err := s.deleteAllUserSessions(c.Request().Context(), id, "")
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "failed deleting sessions")
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"signedOut": count})
+}
+
+// END ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+func userSessionsKey(userID string) string {
+	return userSessionsKeyPrefix + userID
+}
+
+// sessionHandle is the public reference to a session, the session id itself must stay secret
+func sessionHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// getUserSessionIDs returns the ids of the sessions for this user that still exist, oldest first.
+// Sessions that have expired in the session store are removed from the index.
+func (s *Server) getUserSessionIDs(ctx context.Context, userID string) ([]string, error) {
+	ids, err := s.sessions.GetUserSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var active []string
+	for _, id := range ids {
+		exists, err := s.sessions.SessionExists(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			s.sessions.RemoveUserSession(ctx, userID, id)
+			continue
+		}
+		active = append(active, id)
+	}
+
+	return active, nil
+}
+
+// reserveUserSession makes room for the new session of this user based on the configured policy and adds it
+// to the index for this user. It returns errMaxSessionsReached if the policy is REJECT and the user has no
+// room left, the session with replacedID is about to be signed out so it does not take up room.
+func (s *Server) reserveUserSession(ctx context.Context, userID string, sessionID string, replacedID string, maxAge int) error {
+	evict := strings.ToUpper(s.config.MaxSessionsPolicy) != MaxSessionsPolicyReject
+
+	evicted, err := s.sessions.ReserveUserSession(ctx, userID, sessionID, replacedID, s.config.MaxSessionsPerUser, evict, time.Duration(maxAge)*time.Second)
+	if err != nil {
+		return err
+	}
+
+	for range evicted {
+		fmt.Println("evicted session for user: " + userID)
+	}
+	return nil
+}
+
+// deleteUserSession deletes the session and removes it from the index for this user
+func (s *Server) deleteUserSession(ctx context.Context, userID string, sessionID string) error {
+	err := s.sessions.DeleteSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return s.sessions.RemoveUserSession(ctx, userID, sessionID)
+}
+
+// deleteAllUserSessions deletes every session for this user except the one with exceptSessionID.
+// It returns the amount of sessions that were deleted.
+func (s *Server) deleteAllUserSessions(ctx context.Context, userID string, exceptSessionID string) (int, error) {
+	ids, err := s.getUserSessionIDs(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, id := range ids {
+		if id == exceptSessionID {
+			continue
+		}
+		if err := s.deleteUserSession(ctx, userID, id); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// setSessionInfo stores the information about a new session
+func (s *Server) setSessionInfo(ctx context.Context, sessionID string, ip string, userAgent string, maxAge int) error {
+	now := time.Now().UTC()
+
+	return s.sessions.SetSessionInfo(ctx, sessionID, SessionInfo{
+		CreatedAt: now,
+		LastSeen:  now,
+		IP:        ip,
+		UserAgent: userAgent,
+	}, time.Duration(maxAge)*time.Second)
+}
+
+// touchSessionInfo updates the last time this session was seen
+func (s *Server) touchSessionInfo(ctx context.Context, sessionID string) error {
+	return s.sessions.TouchSessionInfo(ctx, sessionID, time.Now().UTC())
+}
+
+// getSessionInfo returns the information about this session
+func (s *Server) getSessionInfo(ctx context.Context, sessionID string) (SessionInfo, error) {
+	info, err := s.sessions.GetSessionInfo(ctx, sessionID)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+
+	info.Handle = sessionHandle(sessionID)
+	return info, nil
+}
+
+// resetSession deletes the session from the store and signs it out of the user it belonged to,
+// it is emptied and the next save stores it under a new id
+func (s *Server) resetSession(ctx context.Context, session *sessions.Session) error {
+	if session.ID != "" {
+		userID, _ := session.Values["userID"].(string)
+		var err error
+		if userID != "" {
+			err = s.deleteUserSession(ctx, userID, session.ID)
+		} else {
+			err = s.sessions.DeleteSession(ctx, session.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	options := s.sessionOptions()
+	session.ID = ""
+	session.Values = map[interface{}]interface{}{}
+	session.Options = &options
+	session.IsNew = true
+	return nil
+}
+
+// rotateSession saves the signed in session under a new id and deletes the old one,
+// the session keeps its values, its place in the sessions of the user and its info
+func (s *Server) rotateSession(c echo.Context, session *sessions.Session, userID string, role string) error {
+	ctx := c.Request().Context()
+	oldID := session.ID
+	info, infoErr := s.sessions.GetSessionInfo(ctx, oldID)
+
+	session.ID = ""
+	if err := session.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+	if err := s.deleteUserSession(ctx, userID, oldID); err != nil {
+		return err
+	}
+
+	_, lifetime := s.sessionTimeouts(role)
+	if err := s.sessions.AddUserSession(ctx, userID, session.ID, lifetime); err != nil {
+		return err
+	}
+	if infoErr != nil {
+		return nil
+	}
+	return s.sessions.SetSessionInfo(ctx, session.ID, info, lifetime)
+}
+
+// sessionTimeouts returns how long a session of this role can go unused and how long it can last at most
+func (s *Server) sessionTimeouts(role string) (time.Duration, time.Duration) {
+	idle := s.config.SessionIdleTimeout
+	lifetime := s.config.SessionLifetime
+
+	// the lists were checked when the config was validated
+	idleTimeouts, _ := parseRoleSeconds(s.config.SessionIdleTimeouts)
+	if seconds, ok := idleTimeouts[role]; ok {
+		idle = seconds
+	}
+	lifetimes, _ := parseRoleSeconds(s.config.SessionLifetimes)
+	if seconds, ok := lifetimes[role]; ok {
+		lifetime = seconds
+	}
+
+	return time.Duration(idle) * time.Second, time.Duration(lifetime) * time.Second
+}
+
+// sessionExpiresAt returns when the signed in session ends for this role,
+// it is zero for sessions that are not signed in
+func (s *Server) sessionExpiresAt(session *sessions.Session, role string) time.Time {
+	signedInAt, ok := session.Values["signedInAt"].(int64)
+	if !ok {
+		return time.Time{}
+	}
+	lastActiveAt, ok := session.Values["lastActiveAt"].(int64)
+	if !ok {
+		return time.Time{}
+	}
+
+	idle, lifetime := s.sessionTimeouts(role)
+	idleEnd := time.Unix(0, lastActiveAt).Add(idle)
+	lifetimeEnd := time.Unix(0, signedInAt).Add(lifetime)
+	if lifetimeEnd.Before(idleEnd) {
+		return lifetimeEnd
+	}
+	return idleEnd
+}
+
+// setSessionExpiry makes the session live in the session store and in the browser until expiresAt
+func setSessionExpiry(session *sessions.Session, expiresAt time.Time) {
+	// the store only keeps whole seconds and deletes the session at 0
+	maxAge := int(math.Ceil(time.Until(expiresAt).Seconds()))
+	if maxAge < 1 {
+		maxAge = 1
+	}
+	session.Options.MaxAge = maxAge
+}
+
+// startSessionTimeouts starts the idle timeout and the lifetime of a session that was just signed in
+func startSessionTimeouts(session *sessions.Session, now time.Time) {
+	session.Values["signedInAt"] = now.UnixNano()
+	session.Values["lastActiveAt"] = now.UnixNano()
+}
+
+// expireSession deletes a signed in session that is over and removes its cookie
+func (s *Server) expireSession(c echo.Context, session *sessions.Session, userID string) error {
+	sessionID := session.ID
+
+	session.Options.MaxAge = -1
+	if err := session.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+	return s.deleteUserSession(c.Request().Context(), userID, sessionID)
+}
+
+// parseRoleSeconds reads the role=seconds entries of SESSION_IDLE_TIMEOUTS and SESSION_LIFETIMES
+func parseRoleSeconds(entries []string) (map[string]int, error) {
+	values := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return values, fmt.Errorf("the entry %q must be role=seconds", entry)
+		}
+
+		seconds, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || seconds <= 0 {
+			return values, fmt.Errorf("the entry %q must have more than 0 seconds", entry)
+		}
+		values[strings.TrimSpace(parts[0])] = seconds
+	}
+	return values, nil
+}
+
+// END INTERNAL FUNCTIONS --------------------------------------------------------------------------
@@ -0,0 +1,179 @@
+package gosession
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// shortTimeouts makes admin sessions end after a second unused and user sessions after two seconds
+func shortTimeouts(config *ConfigApplication) {
+	config.SessionIdleTimeouts = []string{"admin=1"}
+	config.SessionLifetimes = []string{"user=2"}
+}
+
+// getSessionsOn calls a route behind SessionMiddleware with the cookie
+func getSessionsOn(t *testing.T, server *Server, cookie *http.Cookie) int {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodGet, path: "/auth/sessions", server: server, cookies: []*http.Cookie{cookie}}.do(t)
+	return rec.Code
+}
+
+func TestSessionIdleTimeoutIsPerRole(t *testing.T) {
+	server := newTestServer(t, shortTimeouts)
+
+	adminEmail := uniqueEmail("idle-admin")
+	adminID := insertUser(t, server, adminEmail, "password123456", "admin")
+	userEmail := uniqueEmail("idle-user")
+	insertUser(t, server, userEmail, "password123456", "user")
+
+	adminCookie := signInOn(t, server, adminEmail, "password123456")
+	userCookie := signInOn(t, server, userEmail, "password123456")
+
+	time.Sleep(1200 * time.Millisecond)
+	if status := getSessionsOn(t, server, adminCookie); status != http.StatusUnauthorized {
+		t.Fatalf("expected the unused admin session to be signed out but got %d", status)
+	}
+	if status := getSessionsOn(t, server, userCookie); status != http.StatusOK {
+		t.Fatalf("expected the user session to still be signed in but got %d", status)
+	}
+	ids, err := server.getUserSessionIDs(context.Background(), adminID.Hex())
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("expected the admin to have no sessions left but got %v %v", ids, err)
+	}
+
+	// using the session extends the idle timeout
+	adminCookie = signInOn(t, server, adminEmail, "password123456")
+	for i := 0; i < 3; i++ {
+		time.Sleep(600 * time.Millisecond)
+		if status := getSessionsOn(t, server, adminCookie); status != http.StatusOK {
+			t.Fatalf("expected the used session to still be signed in but got %d", status)
+		}
+	}
+}
+
+func TestSessionLifetimeIsNotExtended(t *testing.T) {
+	server := newTestServer(t, shortTimeouts)
+
+	email := uniqueEmail("lifetime")
+	insertUser(t, server, email, "password123456", "user")
+	cookie := signInOn(t, server, email, "password123456")
+
+	for i := 0; i < 3; i++ {
+		if status := getSessionsOn(t, server, cookie); status != http.StatusOK {
+			t.Fatalf("expected the session to still be signed in but got %d", status)
+		}
+		time.Sleep(600 * time.Millisecond)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if status := getSessionsOn(t, server, cookie); status != http.StatusUnauthorized {
+		t.Fatalf("expected the session to be over its lifetime but got %d", status)
+	}
+
+	// signing in again starts a new lifetime
+	cookie = signInOn(t, server, email, "password123456")
+	if status := getSessionsOn(t, server, cookie); status != http.StatusOK {
+		t.Fatalf("expected the new session to be signed in but got %d", status)
+	}
+}
+
+// listSessions returns the sessions of the user of the cookie
+func listSessions(t *testing.T, cookie *http.Cookie) []SessionInfo {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodGet, path: "/auth/sessions", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var infos []SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func TestDeleteSessionByHandle(t *testing.T) {
+	email := uniqueEmail("session-handle")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	other := signInAs(t, email, password)
+	cookie := signInAs(t, email, password)
+
+	infos := listSessions(t, cookie)
+	if len(infos) != 2 {
+		t.Fatalf("expected two sessions but got %+v", infos)
+	}
+	handle := ""
+	for _, info := range infos {
+		if !info.Current {
+			handle = info.Handle
+		}
+	}
+	if handle == "" {
+		t.Fatalf("expected a session that is not the current one in %+v", infos)
+	}
+
+	rec := testRequest{method: http.MethodDelete, path: "/auth/sessions/" + handle, cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	if status, _ := getUserViaSessionCookie(t, other); status == http.StatusOK {
+		t.Fatal("expected the session of the handle to be signed out")
+	}
+	if status, _ := getUserViaSessionCookie(t, cookie); status != http.StatusOK {
+		t.Fatalf("expected the current session to be kept but got %d", status)
+	}
+
+	// the session of the handle is gone
+	rec = testRequest{method: http.MethodDelete, path: "/auth/sessions/" + handle, cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestAdminSignsOutEverySessionOfAUser(t *testing.T) {
+	password := "password1234"
+	adminEmail := uniqueEmail("sessions-admin")
+	email := uniqueEmail("sessions-managed")
+	insertUser(t, testServer, adminEmail, password, "admin")
+	registerAndConfirm(t, email, password)
+
+	cookies := []*http.Cookie{signInAs(t, email, password), signInAs(t, email, password)}
+	_, user := getUserViaSessionCookie(t, cookies[0])
+	adminCookie := signInAs(t, adminEmail, password)
+
+	rec := testRequest{method: http.MethodDelete, path: "/users/" + user.ID.Hex() + "/sessions", cookies: []*http.Cookie{adminCookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var result struct {
+		SignedOut int `json:"signedOut"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.SignedOut != 2 {
+		t.Fatalf("expected two sessions to be signed out but got %d", result.SignedOut)
+	}
+	for _, cookie := range cookies {
+		if status, _ := getUserViaSessionCookie(t, cookie); status == http.StatusOK {
+			t.Fatal("expected every session of the user to be signed out")
+		}
+	}
+	if status, _ := getUserViaSessionCookie(t, adminCookie); status != http.StatusOK {
+		t.Fatalf("expected the admin to still be signed in but got %d", status)
+	}
+}
+
+func TestParseRoleSeconds(t *testing.T) {
+	values, err := parseRoleSeconds([]string{"admin=1800", " user = 60 ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["admin"] != 1800 || values["user"] != 60 {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	for _, entry := range []string{"admin", "=10", "admin=0", "admin=ten"} {
+		if _, err := parseRoleSeconds([]string{entry}); err == nil {
+			t.Fatalf("expected %q to be invalid", entry)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package gosession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+	SESSION STORE SYSTEM
+
+	The session store is the backend where the sessions, the index of sessions per user
+	and the information about each session are kept. Redis is used in production and the
+	memory store can be used to run the service and its tests without a redis container.
+	The store is selected with the SESSION_STORE config value.
+
+*/
+
+const (
+	// sessionName is the name of the session cookie
+	sessionName = "session_"
+
+	// SessionStoreRedis keeps the sessions in redis
+	SessionStoreRedis = "REDIS"
+	// SessionStoreMemory keeps the sessions in the memory of this process
+	SessionStoreMemory = "MEMORY"
+)
+
+var errSessionInfoNotFound = errors.New("No info found for this session")
+var errTemporaryNotFound = errors.New("No value found for this key, it may have expired")
+
+// SessionStore is a gorilla sessions store that can also index the sessions of each user
+type SessionStore interface {
+	sessions.Store
+
+	// DeleteSession deletes the session and its info
+	DeleteSession(ctx context.Context, sessionID string) error
+	// SessionExists checks if the session has not expired or been deleted
+	SessionExists(ctx context.Context, sessionID string) (bool, error)
+
+	// AddUserSession adds the session to the index of the user, the index lives for at least ttl
+	AddUserSession(ctx context.Context, userID string, sessionID string, ttl time.Duration) error
+	// ReserveUserSession adds the session to the index of the user in the same step as the check of the limit,
+	// so concurrent sign ins can not go over it. The sessions in the index that no longer exist are removed
+	// and replacedID is not counted. When there is no room the oldest sessions are deleted and returned if
+	// evict is true, otherwise errMaxSessionsReached is returned and nothing is changed. The new session
+	// counts as existing until it is saved or ttl has passed, a limit <= 0 means there is no limit.
+	ReserveUserSession(ctx context.Context, userID string, sessionID string, replacedID string, limit int, evict bool, ttl time.Duration) ([]string, error)
+	// GetUserSessions returns the ids in the index of the user oldest first, they may have expired
+	GetUserSessions(ctx context.Context, userID string) ([]string, error)
+	// RemoveUserSession removes the session from the index of the user
+	RemoveUserSession(ctx context.Context, userID string, sessionID string) error
+
+	// SetSessionInfo stores the info of the session for ttl
+	SetSessionInfo(ctx context.Context, sessionID string, info SessionInfo, ttl time.Duration) error
+	// TouchSessionInfo updates the last seen time of the session if it has info
+	TouchSessionInfo(ctx context.Context, sessionID string, lastSeen time.Time) error
+	// GetSessionInfo returns the info of the session or errSessionInfoNotFound
+	GetSessionInfo(ctx context.Context, sessionID string) (SessionInfo, error)
+
+	// SetTemporary stores the value for ttl, it is used for the short lived values of the sign in flows
+	SetTemporary(ctx context.Context, key string, value string, ttl time.Duration) error
+	// TakeTemporary returns the value and deletes it so it can only be used once,
+	// errTemporaryNotFound is returned when it expired or was already taken
+	TakeTemporary(ctx context.Context, key string) (string, error)
+}
+
+// getSession returns the session of the current request, a signed in session that is over
+// is deleted and replaced with a new one that is not signed in
+func (s *Server) getSession(c echo.Context) (*sessions.Session, error) {
+	session, err := s.sessions.Get(c.Request(), sessionName)
+	if err != nil {
+		return session, err
+	}
+
+	role, _ := session.Values["role"].(string)
+	expiresAt := s.sessionExpiresAt(session, role)
+	if expiresAt.IsZero() {
+		return session, nil
+	}
+
+	if time.Now().Before(expiresAt) {
+		// saving the session must not extend it past its end
+		setSessionExpiry(session, expiresAt)
+		return session, nil
+	}
+
+	if err := s.resetSession(c.Request().Context(), session); err != nil {
+		fmt.Println("failed deleting the expired session: ", err)
+	}
+	return session, nil
+}
+
+// REDIS SESSION STORE --------------------------------------------------------------------------
+
+// Get returns the session for the given name after adding it to the registry
+func (r *RedisSessionInstance) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return r.Store.Get(req, name)
+}
+
+// New returns the session for the given name without adding it to the registry
+func (r *RedisSessionInstance) New(req *http.Request, name string) (*sessions.Session, error) {
+	return r.Store.New(req, name)
+}
+
+// Save saves the session to redis and sets the session cookie
+func (r *RedisSessionInstance) Save(req *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	return r.Store.Save(req, w, session)
+}
+
+// DeleteSession deletes the session and its info from redis
+func (r *RedisSessionInstance) DeleteSession(ctx context.Context, sessionID string) error {
+	return r.Client.Del(ctx, sessionKeyPrefix+sessionID, sessionInfoKeyPrefix+sessionID).Err()
+}
+
+// SessionExists checks if the session key still exists in redis
+func (r *RedisSessionInstance) SessionExists(ctx context.Context, sessionID string) (bool, error) {
+	exists, err := r.Client.Exists(ctx, sessionKeyPrefix+sessionID).Result()
+	if err != nil {
+		return false, err
+	}
+	return exists > 0, nil
+}
+
+// addUserSessionScript adds the session to the sorted set and only ever makes the set live longer,
+// so a short lived session can not expire the longer lived sessions that are in it.
+// KEYS[1] is the sorted set, ARGV is the score, the session id and the ttl in seconds.
+var addUserSessionScript = redis.NewScript(`
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+if redis.call('TTL', KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// AddUserSession adds the session to the sorted set of sessions for this user
+func (r *RedisSessionInstance) AddUserSession(ctx context.Context, userID string, sessionID string, ttl time.Duration) error {
+	// the index needs to live as long as the longest lived session in it
+	return addUserSessionScript.Run(ctx, r.Client, []string{userSessionsKey(userID)},
+		time.Now().Unix(), sessionID, int64(ttl.Seconds()),
+	).Err()
+}
+
+// reserveUserSessionScript checks the limit and adds the session to the sorted set in one step.
+// KEYS[1] is the sorted set, ARGV is the session id, the replaced id, the limit, 1 to evict,
+// the ttl in seconds, the score, the session key prefix and the session info key prefix.
+// It returns the evicted ids, or nil when there is no room and nothing may be evicted.
+var reserveUserSessionScript = redis.NewScript(`
+local ids = redis.call('ZRANGE', KEYS[1], 0, -1)
+local counted = {}
+for _, id in ipairs(ids) do
+	if redis.call('EXISTS', ARGV[7] .. id) == 0 then
+		redis.call('ZREM', KEYS[1], id)
+	elseif id ~= ARGV[2] then
+		table.insert(counted, id)
+	end
+end
+
+local evicted = {}
+local limit = tonumber(ARGV[3])
+local excess = #counted - limit + 1
+if limit > 0 and excess > 0 then
+	if ARGV[4] ~= '1' then
+		return false
+	end
+	for i = 1, excess do
+		redis.call('ZREM', KEYS[1], counted[i])
+		redis.call('DEL', ARGV[7] .. counted[i], ARGV[8] .. counted[i])
+		table.insert(evicted, counted[i])
+	end
+end
+
+redis.call('ZADD', KEYS[1], ARGV[6], ARGV[1])
+if redis.call('TTL', KEYS[1]) < tonumber(ARGV[5]) then
+	redis.call('EXPIRE', KEYS[1], ARGV[5])
+end
+redis.call('SET', ARGV[7] .. ARGV[1], '', 'EX', ARGV[5], 'NX')
+return evicted
+`)
+
+// ReserveUserSession checks the limit and adds the session to the sorted set of sessions for this user in a script,
+// the session key is created empty so the session is counted until it is saved over it. Like AddUserSession
+// the set is only ever made to live longer.
+func (r *RedisSessionInstance) ReserveUserSession(ctx context.Context, userID string, sessionID string, replacedID string, limit int, evict bool, ttl time.Duration) ([]string, error) {
+	evictArg := "0"
+	if evict {
+		evictArg = "1"
+	}
+
+	result, err := reserveUserSessionScript.Run(ctx, r.Client, []string{userSessionsKey(userID)},
+		sessionID, replacedID, limit, evictArg, int64(ttl.Seconds()), time.Now().Unix(), sessionKeyPrefix, sessionInfoKeyPrefix,
+	).Result()
+	if err == redis.Nil {
+		return nil, errMaxSessionsReached
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values, _ := result.([]interface{})
+	evicted := make([]string, 0, len(values))
+	for _, value := range values {
+		if id, ok := value.(string); ok {
+			evicted = append(evicted, id)
+		}
+	}
+	return evicted, nil
+}
+
+// GetUserSessions returns the sorted set of sessions for this user
+func (r *RedisSessionInstance) GetUserSessions(ctx context.Context, userID string) ([]string, error) {
+	return r.Client.ZRange(ctx, userSessionsKey(userID), 0, -1).Result()
+}
+
+// RemoveUserSession removes the session from the sorted set of sessions for this user
+func (r *RedisSessionInstance) RemoveUserSession(ctx context.Context, userID string, sessionID string) error {
+	return r.Client.ZRem(ctx, userSessionsKey(userID), sessionID).Err()
+}
+
+// SetSessionInfo stores the info of the session in a hash
+func (r *RedisSessionInstance) SetSessionInfo(ctx context.Context, sessionID string, info SessionInfo, ttl time.Duration) error {
+	key := sessionInfoKeyPrefix + sessionID
+
+	err := r.Client.HSet(ctx, key,
+		"createdAt", strconv.FormatInt(info.CreatedAt.Unix(), 10),
+		"lastSeen", strconv.FormatInt(info.LastSeen.Unix(), 10),
+		"ip", info.IP,
+		"userAgent", info.UserAgent,
+	).Err()
+	if err != nil {
+		return err
+	}
+
+	return r.Client.Expire(ctx, key, ttl).Err()
+}
+
+// TouchSessionInfo updates the last seen field of the session info hash
+func (r *RedisSessionInstance) TouchSessionInfo(ctx context.Context, sessionID string, lastSeen time.Time) error {
+	key := sessionInfoKeyPrefix + sessionID
+
+	// only update sessions that have info, otherwise we would create a hash that never expires
+	exists, err := r.Client.Exists(ctx, key).Result()
+	if err != nil || exists == 0 {
+		return err
+	}
+
+	return r.Client.HSet(ctx, key, "lastSeen", strconv.FormatInt(lastSeen.Unix(), 10)).Err()
+}
+
+// GetSessionInfo reads the session info hash
+func (r *RedisSessionInstance) GetSessionInfo(ctx context.Context, sessionID string) (SessionInfo, error) {
+	values, err := r.Client.HGetAll(ctx, sessionInfoKeyPrefix+sessionID).Result()
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	if len(values) == 0 {
+		return SessionInfo{}, errSessionInfoNotFound
+	}
+
+	createdAt, _ := strconv.ParseInt(values["createdAt"], 10, 64)
+	lastSeen, _ := strconv.ParseInt(values["lastSeen"], 10, 64)
+
+	return SessionInfo{
+		CreatedAt: time.Unix(createdAt, 0).UTC(),
+		LastSeen:  time.Unix(lastSeen, 0).UTC(),
+		IP:        values["ip"],
+		UserAgent: values["userAgent"],
+	}, nil
+}
+
+// SetTemporary stores the value in a key that expires after ttl
+func (r *RedisSessionInstance) SetTemporary(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return r.Client.Set(ctx, temporaryKeyPrefix+key, value, ttl).Err()
+}
+
+// TakeTemporary gets and deletes the key in one transaction so two requests can not both take it
+func (r *RedisSessionInstance) TakeTemporary(ctx context.Context, key string) (string, error) {
+	var get *redis.StringCmd
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, temporaryKeyPrefix+key)
+		pipe.Del(ctx, temporaryKeyPrefix+key)
+		return nil
+	})
+	if err == redis.Nil {
+		return "", errTemporaryNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return get.Val(), nil
+}
@@ -0,0 +1,288 @@
+package gosession
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+/*
+	ACCESS TOKEN SYSTEM
+
+	Other services can check who the user is on their own with a short lived access token, a JWT
+	signed with the key served at /.well-known/jwks.json. A sign in with the X-Session-Mode: jwt
+	header is answered with an access token and a refresh token instead of the user.
+
+	Behind the tokens is an ordinary session that is never sent to the client. It is counted by the
+	max sessions policy, listed with the other devices, has the same timeouts and is signed out the
+	same way, so signing it out stops the refresh token straight away. The access tokens it already
+	gave out stay valid until they expire, which is why they only live for ACCESS_TOKEN_TTL seconds.
+
+	Each refresh token can only be used once, using it gets a new access token and a new refresh
+	token (rotation). The refresh tokens that were used are remembered, when one is used again it
+	was stolen or replayed so the whole session is signed out and every refresh token of it stops
+	working (reuse detection). The refresh tokens are stored by their sha256 hash only.
+
+*/
+
+const (
+	refreshTokenPrefix     = "refresh_token_"
+	refreshTokenUsedPrefix = "refresh_token_used_"
+)
+
+var errRefreshTokenInvalid = errors.New("The refresh token is invalid or has expired, please sign in again")
+
+// RefreshToken is the body of the refresh and revoke routes
+type RefreshToken struct {
+	RefreshToken string `json:"refreshToken" validate:"required,max=256"`
+}
+
+// AccessTokenResponse is the answer to a jwt sign in and to a refresh
+type AccessTokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// refreshTokenState is what is kept about a refresh token until it is used
+type refreshTokenState struct {
+	UserID    string `json:"userID"`
+	SessionID string `json:"sessionID"`
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureAccessTokenRoutes - Configure all the routes for the refresh tokens here
+func (s *Server) configureAccessTokenRoutes() {
+	if s.config.AccessTokenIssuer == "" {
+		return
+	}
+
+	// gets a new access token and refresh token for a refresh token
+	s.echo.POST("/auth/token/refresh", s.refreshAccessToken, middleware.BodyLimit("1K"), s.RateLimit("token_refresh", RateLimitByIP))
+
+	// signs out the session of a refresh token
+	s.echo.POST("/auth/token/revoke", s.revokeRefreshToken, middleware.BodyLimit("1K"), s.RateLimit("token_revoke", RateLimitByIP))
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// refreshAccessToken uses up the refresh token and returns new tokens for its session
+func (s *Server) refreshAccessToken(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var refreshToken RefreshToken
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&refreshToken); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(refreshToken); err != nil {
+		log.Printf("Unable to validate the refresh token %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	hash := hashRefreshToken(refreshToken.RefreshToken)
+	storedState, err := s.sessions.TakeTemporary(ctx, refreshTokenPrefix+hash)
+	if err == errTemporaryNotFound {
+		// a refresh token that was already used was stolen or replayed
+		if usedState, err := s.sessions.TakeTemporary(ctx, refreshTokenUsedPrefix+hash); err == nil {
+			log.Printf("Refresh token used again from %s, signing out its session", c.RealIP())
+			if err := s.revokeTokenSession(ctx, usedState); err != nil {
+				fmt.Println("failed signing out the session of a reused refresh token: ", err)
+			}
+		}
+		return c.JSON(http.StatusUnauthorized, errRefreshTokenInvalid.Error())
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusInternalServerError, "failed checking the refresh token")
+	}
+
+	var state refreshTokenState
+	if err := json.Unmarshal([]byte(storedState), &state); err != nil {
+		return c.JSON(http.StatusUnauthorized, errRefreshTokenInvalid.Error())
+	}
+
+	// the session is gone when it was signed out or timed out
+	session, err := s.loadSession(c, state.SessionID)
+	if err != nil || session.IsNew || session.Values["userID"] != state.UserID || session.Values["refreshTokenHash"] != hash {
+		return c.JSON(http.StatusUnauthorized, errRefreshTokenInvalid.Error())
+	}
+
+	acc, err := s.lookupAccount(ctx, state.UserID)
+	if err == errNotFound {
+		s.revokeTokenSession(ctx, storedState)
+		return c.JSON(http.StatusUnauthorized, errRefreshTokenInvalid.Error())
+	}
+	if err != nil {
+		fmt.Println("failed looking up the account: ", err)
+		return c.String(http.StatusInternalServerError, "failed checking the account")
+	}
+	if !acc.active() {
+		return c.JSON(http.StatusForbidden, errAccountSuspended.Error())
+	}
+
+	now := time.Now()
+	if !now.Before(s.sessionExpiresAt(session, acc.Role)) {
+		s.revokeTokenSession(ctx, storedState)
+		return c.JSON(http.StatusUnauthorized, "the session has expired, please sign in again")
+	}
+
+	// the used token is remembered for as long as the session can last so using it again is noticed
+	_, lifetime := s.sessionTimeouts(acc.Role)
+	if err := s.sessions.SetTemporary(ctx, refreshTokenUsedPrefix+hash, storedState, lifetime); err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusInternalServerError, "failed saving the refresh token")
+	}
+
+	// a refresh is a use of the session, the tokens get the current role
+	session.Values["lastActiveAt"] = now.UnixNano()
+	session.Values["role"] = acc.Role
+	tokens, err := s.issueAccessTokens(c, session, state.UserID, acc.Role)
+	if err != nil {
+		fmt.Println("failed issuing the tokens: ", err)
+		return c.String(http.StatusInternalServerError, "failed issuing the tokens")
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// revokeRefreshToken signs out the session of the refresh token, it always answers 200 so it
+// can not be used to find out which tokens are valid
+func (s *Server) revokeRefreshToken(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var refreshToken RefreshToken
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&refreshToken); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(refreshToken); err != nil {
+		log.Printf("Unable to validate the refresh token %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	storedState, err := s.sessions.TakeTemporary(ctx, refreshTokenPrefix+hashRefreshToken(refreshToken.RefreshToken))
+	if err == nil {
+		err = s.revokeTokenSession(ctx, storedState)
+	}
+	if err != nil && err != errTemporaryNotFound {
+		fmt.Println("failed revoking the refresh token: ", err)
+		return c.String(http.StatusInternalServerError, "failed revoking the refresh token")
+	}
+
+	return c.JSON(http.StatusOK, "signed out")
+}
+
+// END ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// respondWithAccessTokens answers a jwt sign in with the tokens of the session that was just signed in,
+// the session itself is not sent to the client
+func (s *Server) respondWithAccessTokens(c echo.Context, session *sessions.Session, databaseUser *DatabaseUser) error {
+	tokens, err := s.issueAccessTokens(c, session, databaseUser.ID.Hex(), databaseUser.Role)
+	if err != nil {
+		fmt.Println("failed issuing the tokens: ", err)
+		return c.String(http.StatusInternalServerError, "failed issuing the tokens")
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// issueAccessTokens gives the session a new refresh token and returns it with a new access token
+func (s *Server) issueAccessTokens(c echo.Context, session *sessions.Session, userID string, role string) (AccessTokenResponse, error) {
+	ctx := c.Request().Context()
+
+	refreshToken, err := generateRandomAuthString()
+	if err != nil {
+		return AccessTokenResponse{}, err
+	}
+	hash := hashRefreshToken(refreshToken)
+
+	state, err := json.Marshal(refreshTokenState{UserID: userID, SessionID: session.ID})
+	if err != nil {
+		return AccessTokenResponse{}, err
+	}
+	_, lifetime := s.sessionTimeouts(role)
+	if err := s.sessions.SetTemporary(ctx, refreshTokenPrefix+hash, string(state), lifetime); err != nil {
+		return AccessTokenResponse{}, err
+	}
+
+	// only the newest refresh token of the session can be used
+	session.Values["refreshTokenHash"] = hash
+	setSessionExpiry(session, s.sessionExpiresAt(session, role))
+	if err := session.Save(c.Request(), c.Response()); err != nil {
+		return AccessTokenResponse{}, err
+	}
+	// the id of the session must not reach the client
+	c.Response().Header().Del(echo.HeaderSetCookie)
+
+	now := time.Now()
+	expiresIn := int64(s.config.AccessTokenTTL)
+	accessToken, err := s.signingKey.sign(accessTokenClaims{
+		Issuer:    s.config.AccessTokenIssuer,
+		Subject:   userID,
+		Audience:  jwtAudience(s.config.AccessTokenAudience),
+		ExpiresAt: now.Unix() + expiresIn,
+		IssuedAt:  now.Unix(),
+		SessionID: sessionHandle(session.ID),
+		Role:      role,
+		TokenUse:  tokenUseAccess,
+	})
+	if err != nil {
+		return AccessTokenResponse{}, err
+	}
+
+	return AccessTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    expiresIn,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// revokeTokenSession signs out the session of the stored refresh token state
+func (s *Server) revokeTokenSession(ctx context.Context, storedState string) error {
+	var state refreshTokenState
+	if err := json.Unmarshal([]byte(storedState), &state); err != nil {
+		return err
+	}
+	return s.deleteUserSession(ctx, state.UserID, state.SessionID)
+}
+
+// loadSession returns the session with this id without it being the session of the request
+func (s *Server) loadSession(c echo.Context, sessionID string) (*sessions.Session, error) {
+	req := c.Request().Clone(c.Request().Context())
+	req.Header.Del(echo.HeaderCookie)
+	req.AddCookie(&http.Cookie{Name: sessionName, Value: sessionID})
+
+	return s.sessions.New(req, sessionName)
+}
+
+// hashRefreshToken returns the hash the refresh token is stored by
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// END INTERNAL FUNCTIONS --------------------------------------------------------------------------
@@ -0,0 +1,166 @@
+package gosession
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// accessTokens turns on the access tokens for the api audience
+func accessTokens(config *ConfigApplication) {
+	config.AccessTokenIssuer = "http://localhost:8080"
+	config.AccessTokenAudience = []string{"api"}
+}
+
+// signInForAccessTokens signs in with the jwt session mode and returns the tokens
+func signInForAccessTokens(t *testing.T, server *Server, email string, password string) AccessTokenResponse {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", server: server, headers: map[string]string{sessionModeHeader: sessionModeJWT}, body: SignInUser{
+		Email:    email,
+		Password: password,
+	}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("expected no cookie for a jwt sign in but got %v", cookies)
+	}
+	if token := rec.Header().Get(sessionTokenHeader); token != "" {
+		t.Fatal("expected the session to not be sent to the client")
+	}
+	return decodeAccessTokens(t, rec.Body.Bytes())
+}
+
+// refreshWith calls the refresh route with the refresh token
+func refreshWith(t *testing.T, server *Server, refreshToken string) (int, AccessTokenResponse) {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/token/refresh", server: server, body: RefreshToken{RefreshToken: refreshToken}}.do(t)
+	if rec.Code != http.StatusOK {
+		return rec.Code, AccessTokenResponse{}
+	}
+	return rec.Code, decodeAccessTokens(t, rec.Body.Bytes())
+}
+
+func decodeAccessTokens(t *testing.T, body []byte) AccessTokenResponse {
+	t.Helper()
+
+	var tokens AccessTokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.TokenType != "Bearer" {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+	return tokens
+}
+
+func TestJWTSignInIssuesAccessTokens(t *testing.T) {
+	server := newTestServer(t, accessTokens)
+
+	email := uniqueEmail("jwt")
+	userID := insertUser(t, server, email, "password123456", "user")
+	tokens := signInForAccessTokens(t, server, email, "password123456")
+
+	// the access token can be checked with the published key
+	rec := testRequest{method: http.MethodGet, path: "/.well-known/jwks.json", server: server}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var keySet JWKSet
+	if err := json.Unmarshal(rec.Body.Bytes(), &keySet); err != nil {
+		t.Fatal(err)
+	}
+	var claims accessTokenClaims
+	err := verifyRS256(tokens.AccessToken, func(keyID string) (*rsa.PublicKey, error) {
+		return keySet.Keys[0].rsaPublicKey()
+	}, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != userID.Hex() || claims.Role != "user" || !claims.Audience.contains("api") || claims.Issuer != "http://localhost:8080" {
+		t.Fatalf("unexpected access token claims %+v", claims)
+	}
+	if claims.ExpiresAt-claims.IssuedAt != int64(server.config.AccessTokenTTL) || tokens.ExpiresIn != int64(server.config.AccessTokenTTL) {
+		t.Fatalf("expected the access token to last %d seconds but got %+v", server.config.AccessTokenTTL, claims)
+	}
+
+	// the access token is for other services, the api itself only takes the session
+	expectStatus(t, testRequest{method: http.MethodGet, path: "/auth/sessions", server: server, headers: map[string]string{"Authorization": "Bearer " + tokens.AccessToken}}.do(t), http.StatusUnauthorized)
+
+	// the session behind the tokens is listed with the other devices
+	cookie := signInOn(t, server, email, "password123456")
+	rec = testRequest{method: http.MethodGet, path: "/auth/sessions", server: server, cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var infos []SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected the jwt and the cookie session but got %+v", infos)
+	}
+}
+
+func TestRefreshTokenRotationAndReuse(t *testing.T) {
+	server := newTestServer(t, accessTokens)
+
+	email := uniqueEmail("jwt-refresh")
+	insertUser(t, server, email, "password123456", "user")
+	first := signInForAccessTokens(t, server, email, "password123456")
+
+	status, second := refreshWith(t, server, first.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("expected the refresh to work but got %d", status)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("expected a new refresh token at the refresh")
+	}
+	status, third := refreshWith(t, server, second.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("expected the new refresh token to work but got %d", status)
+	}
+
+	// using an old refresh token again signs out the session, so the newest token stops working too
+	if status, _ := refreshWith(t, server, first.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("expected the used refresh token to be refused but got %d", status)
+	}
+	if status, _ := refreshWith(t, server, third.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("expected the session of the reused token to be signed out but got %d", status)
+	}
+	if status, _ := refreshWith(t, server, "not a token"); status != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown refresh token to be refused but got %d", status)
+	}
+}
+
+func TestRefreshTokenStopsWhenTheSessionIsSignedOut(t *testing.T) {
+	server := newTestServer(t, accessTokens)
+
+	email := uniqueEmail("jwt-revoke")
+	insertUser(t, server, email, "password123456", "user")
+
+	// the revoke route signs out the session of the token
+	tokens := signInForAccessTokens(t, server, email, "password123456")
+	rec := testRequest{method: http.MethodPost, path: "/auth/token/revoke", server: server, body: RefreshToken{RefreshToken: tokens.RefreshToken}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	if status, _ := refreshWith(t, server, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked refresh token to be refused but got %d", status)
+	}
+	rec = testRequest{method: http.MethodPost, path: "/auth/token/revoke", server: server, body: RefreshToken{RefreshToken: tokens.RefreshToken}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// signing out the other devices signs out the session of the token
+	tokens = signInForAccessTokens(t, server, email, "password123456")
+	cookie := signInOn(t, server, email, "password123456")
+	rec = testRequest{method: http.MethodDelete, path: "/auth/sessions", server: server, cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	if status, _ := refreshWith(t, server, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("expected the signed out session to be refused but got %d", status)
+	}
+}
+
+func TestJWTSignInNeedsAnIssuer(t *testing.T) {
+	rec := testRequest{method: http.MethodPost, path: "/auth/sign-in", headers: map[string]string{sessionModeHeader: sessionModeJWT}, body: SignInUser{
+		Email:    uniqueEmail("jwt-off"),
+		Password: "password123456",
+	}}.do(t)
+	expectStatus(t, rec, http.StatusBadRequest)
+}
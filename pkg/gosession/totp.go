@@ -0,0 +1,557 @@
+package gosession
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+	TWO FACTOR SYSTEM
+
+	Users can turn on time based one time passwords (RFC 6238) for their account. Enrolling returns a secret
+	and an otpauth uri for the authenticator app, the secret is only used for sign ins once a code from the app
+	was verified. Activating it returns recovery codes that can each be used once instead of a code, only their
+	bcrypt hashes are stored.
+
+	Signing in to an account with two factor turned on is done in two steps. The correct password gives a pending
+	session that only holds the pendingUserID for TOTP_PENDING_TTL seconds, SessionMiddleware does not accept it.
+	Sending a valid code to /auth/sign-in/totp turns it into a normal session. Wrong codes count as failed sign
+	ins so they have the same backoff and lockout as wrong passwords.
+
+*/
+
+const (
+	// totpDigits is the length of the codes
+	totpDigits = 6
+	// totpPeriod is how long each code is valid for
+	totpPeriod = 30 * time.Second
+	// totpSkew is how many periods before and after the current one are accepted for clock drift
+	totpSkew = 1
+	// totpSecretSize is the size of the secret in bytes, 160 bits as RFC 4226 recommends
+	totpSecretSize = 20
+
+	// recoveryCodeCount is how many recovery codes are given when two factor is activated
+	recoveryCodeCount = 10
+	// recoveryCodeLength is the length of a recovery code without the dash
+	recoveryCodeLength = 10
+)
+
+var errTOTPRequired = errors.New("two factor authentication required")
+var errTOTPInvalid = errors.New("Incorrect code")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPCode is a code from the authenticator app or a recovery code
+type TOTPCode struct {
+	Code string `json:"code" bson:"code" validate:"required,min=6,max=32"`
+}
+
+// EnrollTOTP is used when a signed in user adds an authenticator app
+type EnrollTOTP struct {
+	CurrentPassword string `json:"currentPassword" bson:"currentPassword" validate:"required,min=10,max=128"`
+}
+
+// TOTPEnrollment is the secret that is added to the authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPRecoveryCodes are shown to the user once when two factor is activated
+type TOTPRecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configureTOTPRoutes - Configure all the routes for two factor authentication here
+func (s *Server) configureTOTPRoutes() {
+
+	// upgrades the pending session from the password step with a code
+	s.echo.POST("/auth/sign-in/totp", s.signInTOTP, middleware.BodyLimit("1K"))
+
+	// generates a new secret, two factor is not used until it is activated
+	s.echo.POST("/users/:id/totp", s.enrollTOTP, s.SessionMiddleware("user"), middleware.BodyLimit("1K"))
+
+	// turns two factor on with a code from the new secret and returns the recovery codes
+	s.echo.POST("/users/:id/totp/activate", s.activateTOTP, s.SessionMiddleware("user"), middleware.BodyLimit("1K"))
+
+	// turns two factor off with a code or a recovery code
+	s.echo.DELETE("/users/:id/totp", s.disableTOTP, s.RateLimit("totp_disable", s.RateLimitByUser), s.SessionMiddleware("user"), middleware.BodyLimit("1K"))
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// signInTOTP checks the code for the pending session and signs the user in
+func (s *Server) signInTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	pendingUserID, _ := session.Values["pendingUserID"].(string)
+	if pendingUserID == "" {
+		return c.JSON(http.StatusUnauthorized, "no sign in is waiting for a code")
+	}
+
+	expiresAt, _ := session.Values["pendingExpiresAt"].(int64)
+	if time.Now().Unix() > expiresAt {
+		clearPendingSignIn(session)
+		if err := session.Save(c.Request(), c.Response()); err != nil {
+			fmt.Println("failed saving session: ", err)
+		}
+		return c.JSON(http.StatusUnauthorized, "the sign in has expired, please sign in again")
+	}
+
+	var totpCode TOTPCode
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&totpCode); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(totpCode); err != nil {
+		log.Printf("Unable to validate the totpCode %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	userID, err := primitive.ObjectIDFromHex(pendingUserID)
+	if err != nil {
+		return c.String(http.StatusNotFound, "This user id is invalid")
+	}
+
+	databaseUser, err := s.users.FindUserByID(ctx, userID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "This user account does not exist")
+	}
+
+	ip := c.RealIP()
+
+	if err := s.checkSignInAllowed(ctx, databaseUser.Email, ip); err != nil {
+		return s.signInFailed(c, err)
+	}
+	if err := checkAccountLocked(databaseUser); err != nil {
+		return s.signInFailed(c, err)
+	}
+
+	err = s.verifySecondFactor(ctx, databaseUser, totpCode.Code)
+	if err == errTOTPInvalid {
+		if err := s.recordSignInFailure(ctx, databaseUser.Email, ip, databaseUser); err != nil {
+			return s.signInFailed(c, err)
+		}
+		return c.String(http.StatusNotAcceptable, err.Error())
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotAcceptable, "failed checking the code")
+	}
+
+	s.resetSignInFailures(ctx, databaseUser.Email)
+
+	if !(account{Status: databaseUser.Status}).active() {
+		return c.String(http.StatusForbidden, errAccountSuspended.Error())
+	}
+
+	err = s.startUserSession(c, session, databaseUser)
+	if err == errMaxSessionsReached {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		fmt.Println("failed starting the session: ", err)
+		return c.String(http.StatusNotAcceptable, "failed saving session")
+	}
+
+	if sessionMode(c) == sessionModeJWT {
+		return s.respondWithAccessTokens(c, session, databaseUser)
+	}
+
+	return c.JSON(http.StatusOK, databaseUser.existingUser())
+}
+
+// enrollTOTP generates a new secret for the signed in user, the current password is needed so a stolen
+// session can not add its own authenticator app
+func (s *Server) enrollTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	databaseUser, status, err := s.sessionUserForID(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	if databaseUser.TOTPEnabled {
+		return c.String(http.StatusConflict, "Two factor authentication is already turned on")
+	}
+
+	var enrollTOTP EnrollTOTP
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&enrollTOTP); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(enrollTOTP); err != nil {
+		log.Printf("Unable to validate the enrollTOTP %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(databaseUser.HashedPassword), []byte(enrollTOTP.CurrentPassword))
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "Incorrect password")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotAcceptable, "failed generating the secret")
+	}
+
+	// a new enrollment replaces a secret that was never activated
+	err = s.users.UpdateUser(ctx, databaseUser.ID, bson.D{
+		{Key: "totpSecret", Value: secret},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The secret could not be saved")
+	}
+
+	return c.JSON(http.StatusOK, TOTPEnrollment{
+		Secret: secret,
+		URI:    totpURI(s.config.TOTPIssuer, databaseUser.Email, secret),
+	})
+}
+
+// activateTOTP turns two factor on once a code from the new secret is verified
+func (s *Server) activateTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	databaseUser, status, err := s.sessionUserForID(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	if databaseUser.TOTPEnabled {
+		return c.String(http.StatusConflict, "Two factor authentication is already turned on")
+	}
+	if databaseUser.TOTPSecret == "" {
+		return c.String(http.StatusNotFound, "Two factor authentication has not been enrolled")
+	}
+
+	var totpCode TOTPCode
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&totpCode); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(totpCode); err != nil {
+		log.Printf("Unable to validate the totpCode %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	step, ok := validateTOTP(databaseUser.TOTPSecret, totpCode.Code, time.Now(), 0)
+	if !ok {
+		return c.String(http.StatusNotAcceptable, errTOTPInvalid.Error())
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotAcceptable, "failed generating the recovery codes")
+	}
+
+	err = s.users.UpdateUser(ctx, databaseUser.ID, bson.D{
+		{Key: "totpEnabled", Value: true},
+		{Key: "totpLastStep", Value: step},
+		{Key: "recoveryCodes", Value: hashes},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "Two factor authentication could not be turned on")
+	}
+
+	return c.JSON(http.StatusOK, TOTPRecoveryCodes{RecoveryCodes: codes})
+}
+
+// disableTOTP turns two factor off, a code or a recovery code is needed so a stolen session can not do it
+func (s *Server) disableTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	databaseUser, status, err := s.sessionUserForID(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	if !databaseUser.TOTPEnabled {
+		return c.String(http.StatusNotFound, "Two factor authentication is not turned on")
+	}
+
+	var totpCode TOTPCode
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&totpCode); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(totpCode); err != nil {
+		log.Printf("Unable to validate the totpCode %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	ip := c.RealIP()
+
+	// wrong codes count as failed sign ins, so the codes can not be guessed here either
+	if err := s.checkSignInAllowed(ctx, databaseUser.Email, ip); err != nil {
+		return s.signInFailed(c, err)
+	}
+	if err := checkAccountLocked(databaseUser); err != nil {
+		return s.signInFailed(c, err)
+	}
+
+	err = s.verifySecondFactor(ctx, databaseUser, totpCode.Code)
+	if err == errTOTPInvalid {
+		if err := s.recordSignInFailure(ctx, databaseUser.Email, ip, databaseUser); err != nil {
+			return s.signInFailed(c, err)
+		}
+		return c.String(http.StatusNotAcceptable, err.Error())
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotAcceptable, "failed checking the code")
+	}
+
+	err = s.users.UpdateUser(ctx, databaseUser.ID, bson.D{
+		{Key: "totpEnabled", Value: false},
+		{Key: "totpSecret", Value: ""},
+		{Key: "totpLastStep", Value: int64(0)},
+		{Key: "recoveryCodes", Value: []string{}},
+		{Key: "updatedAt", Value: time.Now().UTC()},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "Two factor authentication could not be turned off")
+	}
+
+	return c.JSON(http.StatusOK, "Two factor authentication has been turned off")
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// sessionUserForID returns the signed in user if it is the user of the :id param, with the status to answer
+// with when it is not. Not even an admin can change the two factor or the passkeys of another user.
+func (s *Server) sessionUserForID(c echo.Context) (*DatabaseUser, int, error) {
+	session, err := s.getSession(c)
+	if err != nil {
+		return nil, http.StatusNotAcceptable, errors.New("failed getting session")
+	}
+
+	sessionUserID, _ := session.Values["userID"].(string)
+	if sessionUserID != c.Param("id") {
+		return nil, http.StatusForbidden, errors.New("access denied")
+	}
+
+	userID, err := primitive.ObjectIDFromHex(sessionUserID)
+	if err != nil {
+		return nil, http.StatusNotFound, errors.New("This user id is invalid")
+	}
+
+	databaseUser, err := s.users.FindUserByID(c.Request().Context(), userID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, http.StatusNotFound, errors.New("This user account does not exist")
+	}
+	return databaseUser, http.StatusOK, nil
+}
+
+// startPendingSignIn keeps the user in the session until the code is sent, the session is not signed in yet
+func (s *Server) startPendingSignIn(c echo.Context, session *sessions.Session, databaseUser *DatabaseUser) error {
+	// the session that waits for the code gets a new id as well, whoever was signed in with it is signed out
+	if err := s.resetSession(c.Request().Context(), session); err != nil {
+		return err
+	}
+	if _, err := setCSRFToken(c, session); err != nil {
+		return err
+	}
+
+	session.Values["pendingUserID"] = databaseUser.ID.Hex()
+	session.Values["pendingExpiresAt"] = time.Now().Add(time.Duration(s.config.TOTPPendingTTL) * time.Second).Unix()
+
+	session.IsNew = false
+	return session.Save(c.Request(), c.Response())
+}
+
+// clearPendingSignIn removes the user waiting for a code from the session
+func clearPendingSignIn(session *sessions.Session) {
+	delete(session.Values, "pendingUserID")
+	delete(session.Values, "pendingExpiresAt")
+}
+
+// verifySecondFactor checks the code against the secret of the user, and against the recovery codes
+// when it is not a valid code. A used code or recovery code can not be used again.
+func (s *Server) verifySecondFactor(ctx context.Context, databaseUser *DatabaseUser, code string) error {
+	if step, ok := validateTOTP(databaseUser.TOTPSecret, code, time.Now(), databaseUser.TOTPLastStep); ok {
+		// the step is only saved when it is still newer than the last one, another request with the
+		// same code may have used it since the user was read
+		err := s.users.UpdateTOTPLastStep(ctx, databaseUser.ID, step)
+		if err == errNotFound {
+			return errTOTPInvalid
+		}
+		return err
+	}
+
+	// the recovery codes are only compared when the code looks like one as bcrypt is slow on purpose
+	recoveryCode := normalizeRecoveryCode(code)
+	if len(recoveryCode) != recoveryCodeLength {
+		return errTOTPInvalid
+	}
+
+	for _, hash := range databaseUser.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(recoveryCode)) != nil {
+			continue
+		}
+
+		// only the request that removes the recovery code gets to use it
+		err := s.users.RemoveRecoveryCode(ctx, databaseUser.ID, hash)
+		if err == errNotFound {
+			return errTOTPInvalid
+		}
+		return err
+	}
+
+	return errTOTPInvalid
+}
+
+// totpLastStepBefore is the condition for a user whose last used step is before this one,
+// the step is not stored until the first code is used
+func totpLastStepBefore(step int64) []bson.M {
+	return []bson.M{
+		{"totpLastStep": bson.M{"$lt": step}},
+		{"totpLastStep": bson.M{"$exists": false}},
+	}
+}
+
+// generateTOTPSecret returns a random secret encoded in base32 as the authenticator apps expect
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURI returns the otpauth uri that is shown as a qr code for the authenticator app
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(issuer string, email string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", totpDigits))
+	query.Set("period", fmt.Sprintf("%d", int(totpPeriod/time.Second)))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(email)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// totpCode returns the code of the secret for the time step, RFC 4226 section 5.3
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// validateTOTP checks the code against the steps around now and returns the step it matched,
+// steps up to lastStep were already used and are refused
+func validateTOTP(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if secret == "" || len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns the recovery codes and their bcrypt hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLength/2)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = string(hash)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode lets the recovery code be typed without the dash or in upper case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
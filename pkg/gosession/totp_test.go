@@ -0,0 +1,255 @@
+package gosession
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238 appendix B, cut to 6 digits
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, vector := range vectors {
+		if code := totpCode(key, vector.unix/30); code != vector.code {
+			t.Fatalf("expected %s at %d but got %s", vector.code, vector.unix, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1600000000, 0)
+	step := now.Unix() / 30
+
+	if got, ok := validateTOTP(secret, totpCode(key, step-1), now, 0); !ok || got != step-1 {
+		t.Fatal("expected the code of the last period to be accepted")
+	}
+	if _, ok := validateTOTP(secret, totpCode(key, step+2), now, 0); ok {
+		t.Fatal("expected a code outside of the skew to be refused")
+	}
+	if _, ok := validateTOTP(secret, totpCode(key, step), now, step); ok {
+		t.Fatal("expected a code that was already used to be refused")
+	}
+}
+
+// currentTOTPCode returns the code of the secret offset periods from now
+func currentTOTPCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/30+offset)
+}
+
+func TestTOTPSignIn(t *testing.T) {
+	email := uniqueEmail("totp")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	cookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, cookie)
+	cookies := []*http.Cookie{cookie}
+	path := "/users/" + user.ID.Hex() + "/totp"
+
+	// adding an authenticator app needs the password
+	rec := testRequest{method: http.MethodPost, path: path, body: EnrollTOTP{CurrentPassword: "wrongpassword"}, cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	rec = testRequest{method: http.MethodPost, path: path, body: EnrollTOTP{CurrentPassword: password}, cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var enrollment TOTPEnrollment
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(enrollment.URI)
+	if err != nil || uri.Scheme != "otpauth" || uri.Query().Get("secret") != enrollment.Secret {
+		t.Fatalf("expected an otpauth uri with the secret but got %s", enrollment.URI)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: path + "/activate", body: TOTPCode{Code: "000000"}, cookies: cookies}.do(t)
+	if rec.Code == http.StatusOK {
+		t.Fatal("expected a wrong code to be refused")
+	}
+
+	rec = testRequest{method: http.MethodPost, path: path + "/activate", body: TOTPCode{Code: currentTOTPCode(t, enrollment.Secret, 0)}, cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var recovery TOTPRecoveryCodes
+	if err := json.Unmarshal(rec.Body.Bytes(), &recovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes but got %d", recoveryCodeCount, len(recovery.RecoveryCodes))
+	}
+
+	// the password only gives a pending session
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}}.do(t)
+	expectStatus(t, rec, http.StatusAccepted)
+	pending := []*http.Cookie{sessionCookie(t, rec)}
+
+	rec = testRequest{method: http.MethodGet, path: "/", cookies: pending}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+	if status, _ := getUserViaSessionCookie(t, pending[0]); status == http.StatusOK {
+		t.Fatal("expected the pending session to not be signed in")
+	}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in/totp", body: TOTPCode{Code: "000000"}, cookies: pending}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	// the code used to activate can not be used again, the one of the next period can
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in/totp", body: TOTPCode{Code: currentTOTPCode(t, enrollment.Secret, 1)}, cookies: pending}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// the session gets a new id once the code is checked, the pending one is of no use
+	signedIn := sessionCookie(t, rec)
+	if signedIn.Value == pending[0].Value {
+		t.Fatal("expected the session to get a new id")
+	}
+	rec = testRequest{method: http.MethodGet, path: "/", cookies: []*http.Cookie{signedIn}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	if status, _ := getUserViaSessionCookie(t, pending[0]); status == http.StatusOK {
+		t.Fatal("expected the pending session id to be signed out")
+	}
+
+	// a recovery code works once in place of a code
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}}.do(t)
+	expectStatus(t, rec, http.StatusAccepted)
+	pending = []*http.Cookie{sessionCookie(t, rec)}
+
+	recoveryCode := strings.ToUpper(recovery.RecoveryCodes[0])
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in/totp", body: TOTPCode{Code: recoveryCode}, cookies: pending}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in", body: SignInUser{Email: email, Password: password}}.do(t)
+	expectStatus(t, rec, http.StatusAccepted)
+	pending = []*http.Cookie{sessionCookie(t, rec)}
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in/totp", body: TOTPCode{Code: recoveryCode}, cookies: pending}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	// turning it off needs a code as well
+	rec = testRequest{method: http.MethodDelete, path: path, body: TOTPCode{Code: recovery.RecoveryCodes[0]}, cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	rec = testRequest{method: http.MethodDelete, path: path, body: TOTPCode{Code: recovery.RecoveryCodes[1]}, cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	signInAs(t, email, password)
+}
+
+func TestTOTPEnrollmentIsOnlyForTheUser(t *testing.T) {
+	password := "password1234"
+	adminEmail := uniqueEmail("totp-admin")
+	email := uniqueEmail("totp-other")
+
+	insertUser(t, testServer, adminEmail, password, "admin")
+	registerAndConfirm(t, email, password)
+	_, user := getUserViaSessionCookie(t, signInAs(t, email, password))
+
+	rec := testRequest{method: http.MethodPost, path: "/users/" + user.ID.Hex() + "/totp", body: EnrollTOTP{CurrentPassword: password}, cookies: []*http.Cookie{signInAs(t, adminEmail, password)}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+}
+
+func TestSecondFactorCanOnlyBeUsedOnce(t *testing.T) {
+	ctx := context.Background()
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := uniqueEmail("totp-once")
+	insertUser(t, testServer, email, "password123456", "user")
+	_, err = testServer.users.UpdateUserByEmail(ctx, email, bson.D{
+		{Key: "totpEnabled", Value: true},
+		{Key: "totpSecret", Value: secret},
+		{Key: "recoveryCodes", Value: hashes},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both requests read the user before either used the code, only the first one may use it
+	databaseUser, err := testServer.users.FindUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := currentTOTPCode(t, secret, 0)
+	if err := testServer.verifySecondFactor(ctx, databaseUser, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.verifySecondFactor(ctx, databaseUser, code); err != errTOTPInvalid {
+		t.Fatalf("expected the code to be used up but got %v", err)
+	}
+
+	if err := testServer.verifySecondFactor(ctx, databaseUser, codes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.verifySecondFactor(ctx, databaseUser, codes[0]); err != errTOTPInvalid {
+		t.Fatalf("expected the recovery code to be used up but got %v", err)
+	}
+
+	// the other recovery codes are kept
+	databaseUser, err = testServer.users.FindUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(databaseUser.RecoveryCodes) != len(hashes)-1 {
+		t.Fatalf("expected %d recovery codes left but got %d", len(hashes)-1, len(databaseUser.RecoveryCodes))
+	}
+}
+
+func TestDisableTOTPCountsWrongCodes(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := uniqueEmail("totp-disable")
+	password := "password123456"
+	userID := insertUser(t, testServer, email, password, "user")
+	cookie := signInAs(t, email, password)
+	_, err = testServer.users.UpdateUserByEmail(context.Background(), email, bson.D{
+		{Key: "totpEnabled", Value: true},
+		{Key: "totpSecret", Value: secret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/users/" + userID.Hex() + "/totp"
+	for i := 1; i < testServer.config.SignInMaxFailures; i++ {
+		rec := testRequest{method: http.MethodDelete, path: path, body: TOTPCode{Code: "000000"}, cookies: []*http.Cookie{cookie}}.do(t)
+		expectStatus(t, rec, http.StatusNotAcceptable)
+	}
+
+	// the last wrong code locks the account, so even the right code has to wait
+	rec := testRequest{method: http.MethodDelete, path: path, body: TOTPCode{Code: "000000"}, cookies: []*http.Cookie{cookie}}.do(t)
+	expectRetryAfter(t, rec)
+	rec = testRequest{method: http.MethodDelete, path: path, body: TOTPCode{Code: currentTOTPCode(t, secret, 0)}, cookies: []*http.Cookie{cookie}}.do(t)
+	expectRetryAfter(t, rec)
+}
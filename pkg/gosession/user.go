@@ -13,7 +13,6 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"gopkg.in/go-playground/validator.v9"
 )
 
@@ -37,6 +36,14 @@ type DatabaseUser struct {
 	CoverImage     string              `json:"coverImage,omitempty" bson:"coverImage,omitempty"`
 	AboutMe        string              `json:"aboutMe,omitempty" bson:"aboutMe,omitempty" validate:"min=1,max=4096"`
 	Role           string              `json:"role,omitempty" bson:"role,omitempty"`
+	Status         string              `json:"status,omitempty" bson:"status,omitempty"`
+	LockedUntil    time.Time           `json:"lockedUntil,omitempty" bson:"lockedUntil,omitempty"`
+	TOTPEnabled    bool                `json:"totpEnabled" bson:"totpEnabled,omitempty"`
+	TOTPSecret     string              `json:"-" bson:"totpSecret,omitempty"`
+	TOTPLastStep   int64               `json:"-" bson:"totpLastStep,omitempty"`
+	RecoveryCodes  []string            `json:"-" bson:"recoveryCodes,omitempty"`
+	Passkeys       []Passkey           `json:"-" bson:"passkeys,omitempty"`
+	Identities     []Identity          `json:"-" bson:"identities,omitempty"`
 }
 
 // ExistingUser is a struct for an sending back the user with password field removed
@@ -54,6 +61,29 @@ type ExistingUser struct {
 	CoverImage    string              `json:"coverImage,omitempty" bson:"coverImage,omitempty"`
 	AboutMe       string              `json:"aboutMe,omitempty" bson:"aboutMe,omitempty" validate:"min=1,max=4096"`
 	Role          string              `json:"role,omitempty" bson:"role,omitempty"`
+	Status        string              `json:"status,omitempty" bson:"status,omitempty"`
+	TOTPEnabled   bool                `json:"totpEnabled" bson:"totpEnabled,omitempty"`
+}
+
+// existingUser returns the user without the fields that must never leave the server
+func (u *DatabaseUser) existingUser() *ExistingUser {
+	return &ExistingUser{
+		ID:            u.ID,
+		Email:         u.Email,
+		CreatedAt:     u.CreatedAt,
+		UpdatedAt:     u.UpdatedAt,
+		LastSignedIn:  u.LastSignedIn,
+		FirstName:     u.FirstName,
+		LastName:      u.LastName,
+		Verified:      u.Verified,
+		Confirmations: u.Confirmations,
+		ProfileImage:  u.ProfileImage,
+		CoverImage:    u.CoverImage,
+		AboutMe:       u.AboutMe,
+		Role:          u.Role,
+		Status:        u.Status,
+		TOTPEnabled:   u.TOTPEnabled,
+	}
 }
 
 // Validation Section --------------------------------------------
@@ -70,78 +100,66 @@ func (u *UserValidator) Validate(i interface{}) error {
 
 // Configuration Section --------------------------------------------
 
-func configureUserRoutes() {
+func (s *Server) configureUserRoutes() {
 
-	e.GET("/user/:email", getUserByEmail, IPRateLimit(1, 2*time.Second))
+	// the user routes can only be used by the user themselves or an admin,
+	// the signed in routes are rate limited per user so users behind the same ip do not share a limit
+	s.echo.GET("/user/:email", s.getUserByEmail, s.RateLimit("user_by_email", s.RateLimitByUser), s.SessionMiddleware("user"), s.OwnerByEmailMiddleware())
 	// Get a specific user from MongoDB
 	// Docs: https://docs.mongodb.com/manual/reference/command/find/
-	e.GET("/users/:id", getUser, IPRateLimit(1, 2*time.Second))
+	s.echo.GET("/users/:id", s.getUser, s.RateLimit("user_get", s.RateLimitByUser), s.SessionMiddleware("user"), s.OwnerMiddleware())
 
-	// Get users from MongoDB
+	// Get users from MongoDB, listing every account is only for the roles with the users:list permission
 	// Docs: https://docs.mongodb.com/manual/reference/command/find/
-	e.GET("/users", getUsers, IPRateLimit(1, 2*time.Second))
+	s.echo.GET("/users", s.getUsers, s.RateLimit("users_list", RateLimitByIP), s.SessionMiddleware("user"), s.PermissionMiddleware("users:list"))
 
 	// Update an user record in MongoDB
 	// Docs: https://docs.mongodb.com/manual/reference/command/findAndModify/
-	e.PUT("/users/:id", putUser, middleware.BodyLimit("1M"), IPRateLimit(1, 2*time.Second))
+	s.echo.PUT("/users/:id", s.putUser, middleware.BodyLimit("1M"), s.RateLimit("user_update", s.RateLimitByUser), s.SessionMiddleware("user"), s.OwnerMiddleware())
 
 	// Delete a user from MongoDB with IDs
 	// Docs: https://docs.mongodb.com/manual/reference/command/delete/
-	e.DELETE("/users/:id", deleteUser, IPRateLimit(1, 2*time.Second))
+	s.echo.DELETE("/users/:id", s.deleteUser, s.RateLimit("user_delete", s.RateLimitByUser), s.SessionMiddleware("user"), s.OwnerMiddleware())
 }
 
-func getUserByEmail(c echo.Context) error {
-	collection := mg.Db.Collection("users")
+func (s *Server) getUserByEmail(c echo.Context) error {
 
 	email := c.Param("email")
 	if email == "" {
 		return c.String(http.StatusNotFound, "This user email does not exist")
 	}
 
-	query := bson.M{"email": &email}
-
-	var user ExistingUser
-
-	err := collection.FindOne(c.Request().Context(), &query).Decode(&user)
-
+	user, err := s.users.FindUserByEmail(c.Request().Context(), email)
 	if err != nil {
 		fmt.Println(err.Error())
 		return c.String(http.StatusNotFound, err.Error())
 	}
 
 	// return user in JSON format
-	return c.JSON(http.StatusOK, user)
+	return c.JSON(http.StatusOK, user.existingUser())
 }
 
 // getUserByID
-func getUserByID(id string) (*ExistingUser, error) {
-
-	collection := mg.Db.Collection("users")
+func (s *Server) getUserByID(id string) (*ExistingUser, error) {
 
 	// Get the id from the paramaters
 	userID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		return nil, errors.New("This user id is invalid")
 	}
-	query := bson.M{"_id": &userID}
-
-	var user ExistingUser
-
-	err = collection.FindOne(context.Background(), &query).Decode(&user)
 
+	user, err := s.users.FindUserByID(context.Background(), userID)
 	if err != nil {
 		fmt.Println(err.Error())
 		return nil, errors.New(err.Error())
 	}
 
 	// return user in JSON format
-	return &user, nil
+	return user.existingUser(), nil
 }
 
 // getUser
-func getUser(c echo.Context) error {
-
-	collection := mg.Db.Collection("users")
+func (s *Server) getUser(c echo.Context) error {
 
 	id := c.Param("id")
 	if id == "" {
@@ -153,34 +171,28 @@ func getUser(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusNotFound, "This user id is invalid")
 	}
-	query := bson.M{"_id": &userID}
-
-	var user ExistingUser
-
-	err = collection.FindOne(c.Request().Context(), &query).Decode(&user)
 
+	user, err := s.users.FindUserByID(c.Request().Context(), userID)
 	if err != nil {
 		fmt.Println(err.Error())
 		return c.String(http.StatusNotFound, err.Error())
 	}
 
 	// return user in JSON format
-	return c.JSON(http.StatusOK, user)
+	return c.JSON(http.StatusOK, user.existingUser())
 }
 
 // getUsers - This will get all users defined by supplied filter params
-func getUsers(c echo.Context) error {
+func (s *Server) getUsers(c echo.Context) error {
 
 	ctx := c.Request().Context()
 
-	collection := mg.Db.Collection("users")
-
 	// create the pipleine for the different filters
 	// "admin" = the role
 	// "users" = the type of pipeline for the filters
 
-	userRole := getUserRole(c)
-	pipeline := addFiltersToPipeline(c, userRole, "users")
+	userRole := s.getUserRole(c)
+	pipeline := s.addFiltersToPipeline(c, userRole, "users")
 
 	// TODO ensure once they match an email the rest of the filters won't be on everything else
 	// ensure that it matches just one via the email
@@ -192,22 +204,12 @@ func getUsers(c echo.Context) error {
 
 	// func addFilters(pipeline, context, role middleware)
 
-	var users []*ExistingUser
-
-	cur, err := collection.Aggregate(ctx, pipeline)
+	users, err := s.users.FindUsers(ctx, pipeline)
 	if err != nil {
+		fmt.Println(err)
 		return c.String(http.StatusNotFound, "No users found")
 	}
 
-	defer cur.Close(ctx)
-	for cur.Next(ctx) {
-		var user *ExistingUser
-		if err = cur.Decode(&user); err != nil {
-			fmt.Println(err)
-		}
-		users = append(users, user)
-	}
-
 	if len(users) == 0 {
 		return c.String(http.StatusNotFound, "No users found")
 	}
@@ -217,9 +219,7 @@ func getUsers(c echo.Context) error {
 }
 
 // This is the route where a user can change their own settings
-func putUser(c echo.Context) error {
-
-	collection := mg.Db.Collection("users")
+func (s *Server) putUser(c echo.Context) error {
 
 	id := c.Param("id")
 	if id == "" {
@@ -247,24 +247,18 @@ func putUser(c echo.Context) error {
 	}
 
 	// Find the user and update its data
-	query := bson.D{{Key: "_id", Value: &userID}}
-	update := bson.D{
-		{Key: "$set",
-			Value: bson.D{
-				{Key: "aboutMe", Value: &user.AboutMe},
-				{Key: "updatedAt", Value: primitive.NewDateTimeFromTime(time.Now().UTC())},
-				{Key: "firstName", Value: &user.FirstName},
-				{Key: "lastName", Value: &user.LastName},
-				{Key: "profileImage", Value: &user.ProfileImage},
-				{Key: "coverImage", Value: &user.CoverImage},
-			},
-		},
-	}
-	err = collection.FindOneAndUpdate(c.Request().Context(), &query, &update).Err()
+	err = s.users.UpdateUser(c.Request().Context(), userID, bson.D{
+		{Key: "aboutMe", Value: &user.AboutMe},
+		{Key: "updatedAt", Value: primitive.NewDateTimeFromTime(time.Now().UTC())},
+		{Key: "firstName", Value: &user.FirstName},
+		{Key: "lastName", Value: &user.LastName},
+		{Key: "profileImage", Value: &user.ProfileImage},
+		{Key: "coverImage", Value: &user.CoverImage},
+	})
 
 	if err != nil {
-		// ErrNoDocuments means that the filter did not match any documents in the collection
-		if err == mongo.ErrNoDocuments {
+		// errNotFound means that the filter did not match any documents in the collection
+		if err == errNotFound {
 			return c.String(http.StatusNotFound, "No users found")
 		}
 		return c.String(http.StatusUnauthorized, err.Error())
@@ -273,15 +267,13 @@ func putUser(c echo.Context) error {
 	return c.JSON(http.StatusOK, &user)
 }
 
-func deleteUser(c echo.Context) error {
+func (s *Server) deleteUser(c echo.Context) error {
 
 	// TODO
 	// get the user
 	// 30 days before full deletion.
 	// ensure the user has no active subscriptions
 
-	collection := mg.Db.Collection("users")
-
 	id := c.Param("id")
 	if id == "" {
 		return c.String(http.StatusNotFound, "This user id does not exist")
@@ -294,16 +286,34 @@ func deleteUser(c echo.Context) error {
 	}
 
 	// find and delete the user with the given ID
-	query := bson.D{{Key: "_id", Value: &userID}}
-	result, err := collection.DeleteOne(c.Request().Context(), &query)
+	err = s.users.DeleteUser(c.Request().Context(), userID)
+
+	// the users might not exist
+	if err == errNotFound {
+		return c.String(http.StatusNotFound, "No user found")
+	}
 
 	if err != nil {
 		return c.String(http.StatusUnauthorized, err.Error())
 	}
+	s.accounts.forget(id)
 
-	// the users might not exist
-	if result.DeletedCount < 1 {
-		return c.String(http.StatusNotFound, "No user found")
+	// the sessions of the user and the refresh tokens that go with them stop working with the user
+	count, err := s.deleteAllUserSessions(c.Request().Context(), id, "")
+	if err != nil {
+		fmt.Println("failed signing out the deleted user: ", err)
+	}
+	fmt.Printf("%d sessions were signed out after the user was deleted\n", count)
+
+	// the user may have deleted their own account, the cookie of that session is of no use anymore
+	session, err := s.getSession(c)
+	if err == nil {
+		if sessionUserID, _ := session.Values["userID"].(string); sessionUserID == id {
+			session.Options.MaxAge = -1
+			if err := session.Save(c.Request(), c.Response()); err != nil {
+				fmt.Println("failed deleting session: ", err)
+			}
+		}
 	}
 
 	// the record was deleted
@@ -0,0 +1,115 @@
+package gosession
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUserRoutesRequireAuthentication(t *testing.T) {
+	paths := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/users/000000000000000000000000"},
+		{http.MethodPut, "/users/000000000000000000000000"},
+		{http.MethodDelete, "/users/000000000000000000000000"},
+		{http.MethodGet, "/user/" + uniqueEmail("anyone")},
+		{http.MethodGet, "/users"},
+	}
+	for _, p := range paths {
+		rec := testRequest{method: p.method, path: p.path, ip: unique("10.1.1.")}.do(t)
+		expectStatus(t, rec, http.StatusUnauthorized)
+	}
+}
+
+func TestUserRoutesAreOwnerOnly(t *testing.T) {
+	password := "password1234"
+	email := uniqueEmail("owner")
+	otherEmail := uniqueEmail("notowner")
+
+	registerAndConfirm(t, email, password)
+	registerAndConfirm(t, otherEmail, password)
+	cookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, cookie)
+	_, other := getUserViaSessionCookie(t, signInAs(t, otherEmail, password))
+	cookies := []*http.Cookie{cookie}
+
+	rec := testRequest{method: http.MethodGet, path: "/users/" + user.ID.Hex(), ip: unique("10.1.2."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	rec = testRequest{method: http.MethodGet, path: "/user/" + email, ip: unique("10.1.2."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodGet, path: "/users/" + other.ID.Hex(), ip: unique("10.1.2."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+	rec = testRequest{method: http.MethodGet, path: "/user/" + otherEmail, ip: unique("10.1.2."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+	rec = testRequest{method: http.MethodPut, path: "/users/" + other.ID.Hex(), ip: unique("10.1.2."), cookies: cookies, body: ExistingUser{
+		Email:     otherEmail,
+		FirstName: "Changed",
+	}}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+	rec = testRequest{method: http.MethodDelete, path: "/users/" + other.ID.Hex(), ip: unique("10.1.2."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	// only admins can list every account
+	rec = testRequest{method: http.MethodGet, path: "/users", ip: unique("10.1.2."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	// users that do not exist look the same as users that belong to someone else
+	rec = testRequest{method: http.MethodGet, path: "/user/" + uniqueEmail("missing"), ip: unique("10.1.2."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusForbidden)
+}
+
+func TestAdminCanAccessEveryUser(t *testing.T) {
+	password := "password1234"
+	adminEmail := uniqueEmail("users-admin")
+	email := uniqueEmail("managed")
+
+	insertUser(t, testServer, adminEmail, password, "admin")
+	registerAndConfirm(t, email, password)
+	userCookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, userCookie)
+	cookies := []*http.Cookie{signInAs(t, adminEmail, password)}
+
+	rec := testRequest{method: http.MethodGet, path: "/users/" + user.ID.Hex(), ip: unique("10.1.3."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	rec = testRequest{method: http.MethodGet, path: "/user/" + email, ip: unique("10.1.3."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	rec = testRequest{method: http.MethodGet, path: "/user/" + uniqueEmail("missing"), ip: unique("10.1.3."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusNotFound)
+	rec = testRequest{method: http.MethodDelete, path: "/users/" + user.ID.Hex(), ip: unique("10.1.3."), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// the deleted user is signed out, the admin is not
+	if status, _ := getUserViaSessionCookie(t, userCookie); status == http.StatusOK {
+		t.Fatal("expected the deleted user to be signed out")
+	}
+	rec = testRequest{method: http.MethodGet, path: "/auth/sessions", cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestDeletingTheAccountSignsOutEverySession(t *testing.T) {
+	server := newTestServer(t, accessTokens)
+
+	email := uniqueEmail("delete-self")
+	password := "password123456"
+	userID := insertUser(t, server, email, password, "user")
+	cookie := signInOn(t, server, email, password)
+	otherCookie := signInOn(t, server, email, password)
+	tokens := signInForAccessTokens(t, server, email, password)
+
+	rec := testRequest{method: http.MethodDelete, path: "/users/" + userID.Hex(), server: server, cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	if cleared := sessionCookie(t, rec); cleared.Value != "" || cleared.MaxAge >= 0 {
+		t.Fatalf("expected the cookie of the session to be removed but got %+v", cleared)
+	}
+
+	for _, c := range []*http.Cookie{cookie, otherCookie} {
+		if status := getSessionsOn(t, server, c); status != http.StatusUnauthorized {
+			t.Fatalf("expected the sessions of the deleted user to be signed out but got %d", status)
+		}
+	}
+	if status, _ := refreshWith(t, server, tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("expected the refresh token of the deleted user to be refused but got %d", status)
+	}
+}
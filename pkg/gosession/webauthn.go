@@ -0,0 +1,781 @@
+package gosession
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+	PASSKEY SYSTEM
+
+	Users can register WebAuthn credentials (passkeys) and sign in with them instead of a password.
+	https://www.w3.org/TR/webauthn-2/
+
+	Each ceremony is started with a begin route that returns the options for navigator.credentials and
+	keeps the challenge in the session for WEBAUTHN_TIMEOUT seconds, the finish route checks the response
+	of the authenticator against it. Only ES256 public keys are accepted and the attestation statement is
+	not checked as the options ask for none.
+
+	The passkeys are stored on the user with their public key in COSE format. Signing in with a passkey
+	gives the same session as signIn and is refused the same way while the account is locked. When the
+	authenticator verified the user with a pin or biometrics the passkey is two factors on its own, when
+	it did not and two factor is turned on the session waits for the code like after the password.
+
+*/
+
+const (
+	webauthnCeremonyRegister = "register"
+	webauthnCeremonySignIn   = "sign-in"
+
+	// webauthnChallengeSize is the size of the challenges in bytes
+	webauthnChallengeSize = 32
+	// coseAlgES256 is ECDSA with P-256 and SHA-256
+	coseAlgES256 = -7
+
+	authenticatorFlagUserPresent  = 0x01
+	authenticatorFlagUserVerified = 0x04
+	authenticatorFlagAttestedData = 0x40
+)
+
+var errPasskeyInvalid = errors.New("The passkey could not be verified")
+
+// Passkey is a WebAuthn credential of a user
+type Passkey struct {
+	ID         string    `json:"id" bson:"id"`
+	Name       string    `json:"name" bson:"name"`
+	PublicKey  []byte    `json:"-" bson:"publicKey"`
+	SignCount  int64     `json:"-" bson:"signCount"`
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+}
+
+// PasskeyCreationOptions is passed to navigator.credentials.create
+type PasskeyCreationOptions struct {
+	PublicKey PublicKeyCredentialCreationOptions `json:"publicKey"`
+}
+
+// PublicKeyCredentialCreationOptions are the options for registering a passkey, the binary values are base64url
+type PublicKeyCredentialCreationOptions struct {
+	Challenge              string                          `json:"challenge"`
+	RP                     PublicKeyCredentialEntity       `json:"rp"`
+	User                   PublicKeyCredentialEntity       `json:"user"`
+	PubKeyCredParams       []PublicKeyCredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int                             `json:"timeout"`
+	ExcludeCredentials     []PublicKeyCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection          `json:"authenticatorSelection"`
+	Attestation            string                          `json:"attestation"`
+}
+
+// PasskeyRequestOptions is passed to navigator.credentials.get
+type PasskeyRequestOptions struct {
+	PublicKey PublicKeyCredentialRequestOptions `json:"publicKey"`
+}
+
+// PublicKeyCredentialRequestOptions are the options for signing in with a passkey, the binary values are base64url
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string                          `json:"challenge"`
+	RPID             string                          `json:"rpId"`
+	Timeout          int                             `json:"timeout"`
+	AllowCredentials []PublicKeyCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                          `json:"userVerification"`
+}
+
+// PublicKeyCredentialEntity is the relying party or the user
+type PublicKeyCredentialEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// PublicKeyCredentialParameters is an algorithm the server accepts
+type PublicKeyCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// PublicKeyCredentialDescriptor points to a credential
+type PublicKeyCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// AuthenticatorSelection asks for a discoverable credential so the email is not needed to sign in
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PasskeyRegistration is the credential returned by navigator.credentials.create
+type PasskeyRegistration struct {
+	ID       string `json:"id" validate:"required"`
+	Type     string `json:"type" validate:"required,eq=public-key"`
+	Name     string `json:"name" validate:"omitempty,max=64"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" validate:"required"`
+		AttestationObject string `json:"attestationObject" validate:"required"`
+	} `json:"response"`
+}
+
+// PasskeyAssertion is the credential returned by navigator.credentials.get
+type PasskeyAssertion struct {
+	ID       string `json:"id" validate:"required"`
+	Type     string `json:"type" validate:"required,eq=public-key"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" validate:"required"`
+		AuthenticatorData string `json:"authenticatorData" validate:"required"`
+		Signature         string `json:"signature" validate:"required"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// PasskeySignIn optionally names the account so only its passkeys are offered
+type PasskeySignIn struct {
+	Email string `json:"email" validate:"omitempty,email"`
+}
+
+// clientData is the clientDataJSON the browser signs over
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the parsed authenticator data, the credential is only there when registering
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// ROUTES --------------------------------------------------------------------------
+
+// configurePasskeyRoutes - Configure all the routes for passkeys here
+func (s *Server) configurePasskeyRoutes() {
+
+	// returns the options to register a passkey for the signed in user
+	s.echo.POST("/users/:id/passkeys/register/begin", s.beginPasskeyRegistration, s.SessionMiddleware("user"))
+
+	// stores the passkey once the response of the authenticator is verified
+	s.echo.POST("/users/:id/passkeys/register/finish", s.finishPasskeyRegistration, s.SessionMiddleware("user"), middleware.BodyLimit("16K"))
+
+	// lists the passkeys of the user
+	s.echo.GET("/users/:id/passkeys", s.getPasskeys, s.SessionMiddleware("user"))
+
+	// removes a passkey of the user
+	s.echo.DELETE("/users/:id/passkeys/:credentialID", s.deletePasskey, s.SessionMiddleware("user"))
+
+	// returns the options to sign in with a passkey
+	s.echo.POST("/auth/passkey/begin", s.beginPasskeySignIn, middleware.BodyLimit("1K"))
+
+	// signs in once the assertion of the authenticator is verified
+	s.echo.POST("/auth/passkey/finish", s.finishPasskeySignIn, middleware.BodyLimit("16K"), s.RateLimit("passkey_finish", RateLimitByIP))
+
+}
+
+// ROUTE FUNCTIONS --------------------------------------------------------------------------
+
+// beginPasskeyRegistration returns the options to create a passkey and keeps the challenge in the session
+func (s *Server) beginPasskeyRegistration(c echo.Context) error {
+	databaseUser, status, err := s.sessionUserForID(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	challenge, err := s.startWebAuthnCeremony(c, session, webauthnCeremonyRegister, databaseUser.ID.Hex())
+	if err != nil {
+		fmt.Println("failed saving session: ", err)
+		return c.String(http.StatusNotAcceptable, "failed saving session")
+	}
+
+	// the same authenticator can not be registered twice
+	exclude := []PublicKeyCredentialDescriptor{}
+	for _, passkey := range databaseUser.Passkeys {
+		exclude = append(exclude, PublicKeyCredentialDescriptor{Type: "public-key", ID: passkey.ID})
+	}
+
+	return c.JSON(http.StatusOK, PasskeyCreationOptions{
+		PublicKey: PublicKeyCredentialCreationOptions{
+			Challenge: challenge,
+			RP:        PublicKeyCredentialEntity{ID: s.config.WebAuthnRPID, Name: s.config.WebAuthnRPName},
+			User: PublicKeyCredentialEntity{
+				ID:          base64.RawURLEncoding.EncodeToString(databaseUser.ID[:]),
+				Name:        databaseUser.Email,
+				DisplayName: strings.TrimSpace(databaseUser.FirstName + " " + databaseUser.LastName),
+			},
+			PubKeyCredParams:   []PublicKeyCredentialParameters{{Type: "public-key", Alg: coseAlgES256}},
+			Timeout:            s.config.WebAuthnTimeout * 1000,
+			ExcludeCredentials: exclude,
+			AuthenticatorSelection: AuthenticatorSelection{
+				ResidentKey:      "preferred",
+				UserVerification: "preferred",
+			},
+			Attestation: "none",
+		},
+	})
+}
+
+// finishPasskeyRegistration verifies the new credential and adds it to the passkeys of the user
+func (s *Server) finishPasskeyRegistration(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	databaseUser, status, err := s.sessionUserForID(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	var registration PasskeyRegistration
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&registration); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(registration); err != nil {
+		log.Printf("Unable to validate the registration %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	challenge, _, err := s.endWebAuthnCeremony(c, session, webauthnCeremonyRegister)
+	if err != nil {
+		return c.String(http.StatusUnauthorized, err.Error())
+	}
+
+	clientDataJSON, err := decodeBase64URL(registration.Response.ClientDataJSON)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+	if err := s.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		log.Printf("Unable to verify the client data %v", err)
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+
+	attestationObject, err := decodeBase64URL(registration.Response.AttestationObject)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+	authData, err := s.verifyAttestationObject(attestationObject)
+	if err != nil {
+		log.Printf("Unable to verify the attestation object %v", err)
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(authData.CredentialID)
+	for _, passkey := range databaseUser.Passkeys {
+		if passkey.ID == credentialID {
+			return c.String(http.StatusConflict, "This passkey is already registered")
+		}
+	}
+
+	name := strings.TrimSpace(registration.Name)
+	if name == "" {
+		name = fmt.Sprintf("Passkey %d", len(databaseUser.Passkeys)+1)
+	}
+
+	passkey := Passkey{
+		ID:        credentialID,
+		Name:      name,
+		PublicKey: authData.PublicKey,
+		SignCount: int64(authData.SignCount),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// the passkey is added on its own so a passkey that was added or removed since the user was read is kept,
+	// a credential id can only be registered once across all the users
+	err = s.users.AddPasskey(ctx, databaseUser.ID, passkey)
+	if err == errNotFound || err == errDuplicate {
+		return c.String(http.StatusConflict, "This passkey is already registered")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The passkey could not be saved")
+	}
+
+	return c.JSON(http.StatusOK, passkey)
+}
+
+// getPasskeys lists the passkeys of the user without their public keys
+func (s *Server) getPasskeys(c echo.Context) error {
+	databaseUser, status, err := s.sessionUserForID(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	passkeys := databaseUser.Passkeys
+	if passkeys == nil {
+		passkeys = []Passkey{}
+	}
+	return c.JSON(http.StatusOK, passkeys)
+}
+
+// deletePasskey removes the passkey from the user
+func (s *Server) deletePasskey(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	databaseUser, status, err := s.sessionUserForID(c)
+	if err != nil {
+		return c.String(status, err.Error())
+	}
+
+	err = s.users.RemovePasskey(ctx, databaseUser.ID, c.Param("credentialID"))
+	if err == errNotFound {
+		return c.String(http.StatusNotFound, "No passkey found")
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotFound, "The passkey could not be removed")
+	}
+
+	return c.JSON(http.StatusOK, "Passkey has been removed")
+}
+
+// beginPasskeySignIn returns the options to sign in with a passkey and keeps the challenge in the session,
+// without an email any passkey of the relying party can be used
+func (s *Server) beginPasskeySignIn(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var passkeySignIn PasskeySignIn
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&passkeySignIn); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(passkeySignIn); err != nil {
+		log.Printf("Unable to validate the passkeySignIn %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	userID := ""
+	allow := []PublicKeyCredentialDescriptor{}
+	if passkeySignIn.Email != "" {
+		databaseUser, err := s.users.FindUserByEmail(ctx, passkeySignIn.Email)
+		if err != nil || len(databaseUser.Passkeys) == 0 {
+			return c.String(http.StatusNotAcceptable, "This user account has no passkeys")
+		}
+
+		userID = databaseUser.ID.Hex()
+		for _, passkey := range databaseUser.Passkeys {
+			allow = append(allow, PublicKeyCredentialDescriptor{Type: "public-key", ID: passkey.ID})
+		}
+	}
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	challenge, err := s.startWebAuthnCeremony(c, session, webauthnCeremonySignIn, userID)
+	if err != nil {
+		fmt.Println("failed saving session: ", err)
+		return c.String(http.StatusNotAcceptable, "failed saving session")
+	}
+
+	return c.JSON(http.StatusOK, PasskeyRequestOptions{
+		PublicKey: PublicKeyCredentialRequestOptions{
+			Challenge:        challenge,
+			RPID:             s.config.WebAuthnRPID,
+			Timeout:          s.config.WebAuthnTimeout * 1000,
+			AllowCredentials: allow,
+			UserVerification: "preferred",
+		},
+	})
+}
+
+// finishPasskeySignIn verifies the assertion and signs the user in with the session
+func (s *Server) finishPasskeySignIn(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	session, err := s.getSession(c)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, "failed getting session")
+	}
+
+	var assertion PasskeyAssertion
+
+	c.Echo().Validator = &UserValidator{validator: v}
+
+	if err := c.Bind(&assertion); err != nil {
+		log.Printf("Unable to bind :%v", err)
+		return err
+	}
+
+	if err := c.Validate(assertion); err != nil {
+		log.Printf("Unable to validate the assertion %v", err)
+		return c.JSON(http.StatusPartialContent, err.Error())
+	}
+
+	challenge, expectedUserID, err := s.endWebAuthnCeremony(c, session, webauthnCeremonySignIn)
+	if err != nil {
+		return c.String(http.StatusUnauthorized, err.Error())
+	}
+
+	// the user handle is the id of the user, it is only left out when the email was given at the start
+	userID := expectedUserID
+	if assertion.Response.UserHandle != "" {
+		userHandle, err := decodeBase64URL(assertion.Response.UserHandle)
+		if err != nil || len(userHandle) != len(primitive.ObjectID{}) {
+			return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+		}
+		var id primitive.ObjectID
+		copy(id[:], userHandle)
+		if expectedUserID != "" && id.Hex() != expectedUserID {
+			return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+		}
+		userID = id.Hex()
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+
+	databaseUser, err := s.users.FindUserByID(ctx, objectID)
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+
+	index := -1
+	for i, passkey := range databaseUser.Passkeys {
+		if passkey.ID == assertion.ID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+	passkey := databaseUser.Passkeys[index]
+
+	// a locked account can not be signed in to with a passkey either
+	if err := checkAccountLocked(databaseUser); err != nil {
+		return s.signInFailed(c, err)
+	}
+
+	authData, err := s.verifyAssertion(assertion, passkey, challenge)
+	if err != nil {
+		log.Printf("Unable to verify the assertion %v", err)
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+
+	if !(account{Status: databaseUser.Status}).active() {
+		return c.String(http.StatusForbidden, errAccountSuspended.Error())
+	}
+
+	// only the passkey that was used is updated, and only if no other request used the same sign count first
+	err = s.users.UpdatePasskeySignCount(ctx, databaseUser.ID, passkey.ID, int64(authData.SignCount), time.Now().UTC())
+	if err == errNotFound {
+		return c.String(http.StatusNotAcceptable, errPasskeyInvalid.Error())
+	}
+	if err != nil {
+		fmt.Println(err)
+		return c.String(http.StatusNotAcceptable, "failed saving the passkey")
+	}
+
+	// a passkey the user was not verified on only proves the user has it, so it is one factor
+	// like the password and the session waits for the code when two factor is turned on
+	if databaseUser.TOTPEnabled && authData.Flags&authenticatorFlagUserVerified == 0 {
+		if err = s.startPendingSignIn(c, session, databaseUser); err != nil {
+			fmt.Println("failed saving session: ", err)
+			return c.String(http.StatusNotAcceptable, "failed saving session")
+		}
+		return c.JSON(http.StatusAccepted, echo.Map{
+			"totpRequired": true,
+			"message":      errTOTPRequired.Error(),
+		})
+	}
+
+	err = s.startUserSession(c, session, databaseUser)
+	if err == errMaxSessionsReached {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		fmt.Println("failed starting the session: ", err)
+		return c.String(http.StatusNotAcceptable, "failed saving session")
+	}
+
+	if sessionMode(c) == sessionModeJWT {
+		return s.respondWithAccessTokens(c, session, databaseUser)
+	}
+
+	return c.JSON(http.StatusOK, databaseUser.existingUser())
+}
+
+// INTERNAL FUNCTIONS --------------------------------------------------------------------------
+
+// startWebAuthnCeremony generates a challenge and keeps it in the session with the ceremony and user it is for
+func (s *Server) startWebAuthnCeremony(c echo.Context, session *sessions.Session, ceremony string, userID string) (string, error) {
+	b := make([]byte, webauthnChallengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(b)
+
+	session.Values["webauthnChallenge"] = challenge
+	session.Values["webauthnCeremony"] = ceremony
+	session.Values["webauthnUserID"] = userID
+	session.Values["webauthnExpiresAt"] = time.Now().Add(time.Duration(s.config.WebAuthnTimeout) * time.Second).Unix()
+
+	session.IsNew = false
+	return challenge, session.Save(c.Request(), c.Response())
+}
+
+// endWebAuthnCeremony returns the challenge and user of the ceremony and removes them from the session,
+// each challenge can only be answered once
+func (s *Server) endWebAuthnCeremony(c echo.Context, session *sessions.Session, ceremony string) (string, string, error) {
+	challenge, _ := session.Values["webauthnChallenge"].(string)
+	storedCeremony, _ := session.Values["webauthnCeremony"].(string)
+	userID, _ := session.Values["webauthnUserID"].(string)
+	expiresAt, _ := session.Values["webauthnExpiresAt"].(int64)
+
+	if challenge == "" || storedCeremony != ceremony {
+		return "", "", errors.New("No passkey ceremony was started")
+	}
+
+	delete(session.Values, "webauthnChallenge")
+	delete(session.Values, "webauthnCeremony")
+	delete(session.Values, "webauthnUserID")
+	delete(session.Values, "webauthnExpiresAt")
+	if err := session.Save(c.Request(), c.Response()); err != nil {
+		return "", "", err
+	}
+	if time.Now().Unix() > expiresAt {
+		return "", "", errors.New("The passkey ceremony has expired, please start again")
+	}
+	return challenge, userID, nil
+}
+
+// verifyClientData checks the client data is for this ceremony, challenge and one of our origins
+func (s *Server) verifyClientData(clientDataJSON []byte, ceremonyType string, challenge string) error {
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return err
+	}
+
+	if data.Type != ceremonyType {
+		return fmt.Errorf("the client data is for %q", data.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimRight(data.Challenge, "=")), []byte(challenge)) != 1 {
+		return errors.New("the challenge does not match")
+	}
+	for _, origin := range s.config.WebAuthnOrigins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("the origin %q is not allowed", data.Origin)
+}
+
+// verifyAttestationObject checks the authenticator data of a new credential and returns it
+func (s *Server) verifyAttestationObject(attestationObject []byte) (authenticatorData, error) {
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return authenticatorData{}, errors.New("the attestation object is not a map")
+	}
+	rawAuthData, ok := object["authData"].([]byte)
+	if !ok {
+		return authenticatorData{}, errors.New("the attestation object has no authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return authData, err
+	}
+	if err := s.verifyAuthenticatorData(authData); err != nil {
+		return authData, err
+	}
+	if authData.Flags&authenticatorFlagAttestedData == 0 || len(authData.CredentialID) == 0 {
+		return authData, errors.New("the authenticator data has no credential")
+	}
+
+	// only ES256 is offered in the options so the key has to be one
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return authData, err
+	}
+	return authData, nil
+}
+
+// verifyAssertion checks the signature of the passkey and returns the authenticator data with the new sign count
+func (s *Server) verifyAssertion(assertion PasskeyAssertion, passkey Passkey, challenge string) (authenticatorData, error) {
+	clientDataJSON, err := decodeBase64URL(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+	if err := s.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return authenticatorData{}, err
+	}
+
+	rawAuthData, err := decodeBase64URL(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+	if err := s.verifyAuthenticatorData(authData); err != nil {
+		return authenticatorData{}, err
+	}
+
+	signature, err := decodeBase64URL(assertion.Response.Signature)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+	publicKey, err := parseCOSEKey(passkey.PublicKey)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+
+	// the signature is over the authenticator data followed by the hash of the client data
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, rawAuthData...), clientDataHash[:]...))
+	if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+		return authenticatorData{}, errors.New("the signature is invalid")
+	}
+
+	// a counter that did not go up means the authenticator may have been cloned,
+	// authenticators that do not count always send 0
+	if (authData.SignCount != 0 || passkey.SignCount != 0) && int64(authData.SignCount) <= passkey.SignCount {
+		return authenticatorData{}, errors.New("the sign count did not increase")
+	}
+	return authData, nil
+}
+
+// verifyAuthenticatorData checks the data is for our relying party and the user was present
+func (s *Server) verifyAuthenticatorData(authData authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(s.config.WebAuthnRPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return errors.New("the relying party id does not match")
+	}
+	if authData.Flags&authenticatorFlagUserPresent == 0 {
+		return errors.New("the user was not present")
+	}
+	if s.config.WebAuthnUserVerification && authData.Flags&authenticatorFlagUserVerified == 0 {
+		return errors.New("the user was not verified")
+	}
+	return nil
+}
+
+// parseAuthenticatorData reads the authenticator data, the credential is only read when the flag is set
+// https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	var authData authenticatorData
+	if len(data) < 37 {
+		return authData, errors.New("the authenticator data is too short")
+	}
+
+	authData.RPIDHash = data[:32]
+	authData.Flags = data[32]
+	authData.SignCount = binary.BigEndian.Uint32(data[33:37])
+
+	if authData.Flags&authenticatorFlagAttestedData == 0 {
+		return authData, nil
+	}
+
+	// the aaguid of 16 bytes and the length of the credential id come first
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authData, errors.New("the attested credential data is too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return authData, errors.New("the credential id is too short")
+	}
+	authData.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	// the public key is the cbor item after the id, extensions may follow it
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return authData, err
+	}
+	authData.PublicKey = rest[:len(rest)-len(after)]
+	return authData, nil
+}
+
+// parseCOSEKey reads an ES256 public key in COSE format
+// https://www.rfc-editor.org/rfc/rfc8152#section-13.1.1
+func parseCOSEKey(data []byte) (*ecdsa.PublicKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("the public key is not a map")
+	}
+
+	// kty 2 is EC2, alg -7 is ES256 and crv 1 is P-256
+	if key[int64(1)] != int64(2) || key[int64(3)] != int64(coseAlgES256) || key[int64(-1)] != int64(1) {
+		return nil, errors.New("the public key is not an ES256 key")
+	}
+	x, okX := key[int64(-2)].([]byte)
+	y, okY := key[int64(-3)].([]byte)
+	if !okX || !okY || len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("the public key has invalid coordinates")
+	}
+
+	publicKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, errors.New("the public key is not on the curve")
+	}
+	return publicKey, nil
+}
+
+// passkeySignCountBefore is the condition for the passkeys array when the passkey has a lower sign count,
+// authenticators that do not count always send 0 so any count is accepted for them
+func passkeySignCountBefore(credentialID string, signCount int64) bson.M {
+	if signCount == 0 {
+		return bson.M{"$elemMatch": bson.M{"id": credentialID}}
+	}
+	return bson.M{"$elemMatch": bson.M{"id": credentialID, "signCount": bson.M{"$lt": signCount}}}
+}
+
+// decodeBase64URL decodes the base64url values of WebAuthn with or without the padding
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
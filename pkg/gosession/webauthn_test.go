@@ -0,0 +1,391 @@
+package gosession
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// encodeCBOR encodes the values the software authenticator needs
+func encodeCBOR(value interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		}
+	}
+
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		keys := make([][]byte, 0, len(v))
+		encoded := map[string][]byte{}
+		for key, item := range v {
+			k := encodeCBOR(key)
+			keys = append(keys, k)
+			encoded[string(k)] = encodeCBOR(item)
+		}
+		sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+		out := head(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(append(out, k...), encoded[string(k)]...)
+		}
+		return out
+	}
+	panic("unsupported cbor value")
+}
+
+// softAuthenticator is a software passkey for the tests
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	rpID         string
+	origin       string
+	// unverified leaves out the user verified flag, as an authenticator without a pin does
+	unverified bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credentialID: credentialID, rpID: "localhost", origin: "http://localhost:4200"}
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge string) []byte {
+	data, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+
+	flags := byte(authenticatorFlagUserPresent | authenticatorFlagUserVerified)
+	if a.unverified {
+		flags = authenticatorFlagUserPresent
+	}
+	if attested {
+		flags |= authenticatorFlagAttestedData
+	}
+	data = append(data, flags)
+
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, a.signCount)
+	data = append(data, count...)
+
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		idLength := make([]byte, 2)
+		binary.BigEndian.PutUint16(idLength, uint16(len(a.credentialID)))
+		data = append(data, idLength...)
+		data = append(data, a.credentialID...)
+
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		a.key.X.FillBytes(x)
+		a.key.Y.FillBytes(y)
+		data = append(data, encodeCBOR(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: y})...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) register(challenge string) PasskeyRegistration {
+	var registration PasskeyRegistration
+	registration.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	registration.Type = "public-key"
+	registration.Name = "Test Key"
+	registration.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge))
+	registration.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(true),
+	}))
+	return registration
+}
+
+func (a *softAuthenticator) assert(t *testing.T, challenge string, userHandle []byte) PasskeyAssertion {
+	t.Helper()
+
+	a.signCount++
+	authData := a.authData(false)
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var assertion PasskeyAssertion
+	assertion.ID = base64.RawURLEncoding.EncodeToString(a.credentialID)
+	assertion.Type = "public-key"
+	assertion.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	assertion.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	assertion.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	assertion.Response.UserHandle = base64.RawURLEncoding.EncodeToString(userHandle)
+	return assertion
+}
+
+// beginPasskeySignInWith starts a passkey sign in and returns the challenge and the session cookie
+func beginPasskeySignInWith(t *testing.T, email string) (string, *http.Cookie) {
+	t.Helper()
+
+	rec := testRequest{method: http.MethodPost, path: "/auth/passkey/begin", body: PasskeySignIn{Email: email}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var options PasskeyRequestOptions
+	if err := json.Unmarshal(rec.Body.Bytes(), &options); err != nil {
+		t.Fatal(err)
+	}
+	return options.PublicKey.Challenge, sessionCookie(t, rec)
+}
+
+func TestPasskeyRegistrationAndSignIn(t *testing.T) {
+	email := uniqueEmail("passkey")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	cookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, cookie)
+	cookies := []*http.Cookie{cookie}
+	path := "/users/" + user.ID.Hex() + "/passkeys"
+	authenticator := newSoftAuthenticator(t)
+
+	// finishing without a challenge is refused
+	rec := testRequest{method: http.MethodPost, path: path + "/register/finish", body: authenticator.register("nochallenge"), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	rec = testRequest{method: http.MethodPost, path: path + "/register/begin", cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var creation PasskeyCreationOptions
+	if err := json.Unmarshal(rec.Body.Bytes(), &creation); err != nil {
+		t.Fatal(err)
+	}
+	if creation.PublicKey.RP.ID != "localhost" || creation.PublicKey.User.Name != email {
+		t.Fatalf("unexpected creation options %+v", creation.PublicKey)
+	}
+
+	rec = testRequest{method: http.MethodPost, path: path + "/register/finish", body: authenticator.register(creation.PublicKey.Challenge), cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodGet, path: path, cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var passkeys []Passkey
+	if err := json.Unmarshal(rec.Body.Bytes(), &passkeys); err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) != 1 || passkeys[0].Name != "Test Key" {
+		t.Fatalf("expected the registered passkey but got %+v", passkeys)
+	}
+
+	// passwordless sign in without the email, the user handle says who it is
+	challenge, passkeyCookie := beginPasskeySignInWith(t, "")
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/finish", body: authenticator.assert(t, challenge, user.ID[:]), cookies: []*http.Cookie{passkeyCookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	status, sessionUser := getUserViaSessionCookie(t, sessionCookie(t, rec))
+	if status != http.StatusOK || sessionUser.Email != email {
+		t.Fatalf("expected the passkey session to be signed in but got %d", status)
+	}
+
+	// the challenge can only be answered once
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/finish", body: authenticator.assert(t, challenge, user.ID[:]), cookies: []*http.Cookie{passkeyCookie}}.do(t)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	// a cloned authenticator has a sign count that does not go up
+	challenge, passkeyCookie = beginPasskeySignInWith(t, email)
+	authenticator.signCount = 0
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/finish", body: authenticator.assert(t, challenge, user.ID[:]), cookies: []*http.Cookie{passkeyCookie}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	// another origin is refused
+	authenticator.signCount = 10
+	authenticator.origin = "http://evil.example"
+	challenge, passkeyCookie = beginPasskeySignInWith(t, email)
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/finish", body: authenticator.assert(t, challenge, user.ID[:]), cookies: []*http.Cookie{passkeyCookie}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+
+	rec = testRequest{method: http.MethodDelete, path: path + "/" + passkeys[0].ID, cookies: cookies}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/begin", body: PasskeySignIn{Email: email}}.do(t)
+	expectStatus(t, rec, http.StatusNotAcceptable)
+}
+
+func TestPasskeySignInKeepsTheSecondFactorAndLockout(t *testing.T) {
+	ctx := context.Background()
+	email := uniqueEmail("passkey-totp")
+	password := "password1234"
+	registerAndConfirm(t, email, password)
+
+	cookie := signInAs(t, email, password)
+	_, user := getUserViaSessionCookie(t, cookie)
+	path := "/users/" + user.ID.Hex() + "/passkeys"
+	authenticator := newSoftAuthenticator(t)
+
+	rec := testRequest{method: http.MethodPost, path: path + "/register/begin", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var creation PasskeyCreationOptions
+	if err := json.Unmarshal(rec.Body.Bytes(), &creation); err != nil {
+		t.Fatal(err)
+	}
+	rec = testRequest{method: http.MethodPost, path: path + "/register/finish", body: authenticator.register(creation.PublicKey.Challenge), cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = testServer.users.UpdateUserByEmail(ctx, email, bson.D{
+		{Key: "totpEnabled", Value: true},
+		{Key: "totpSecret", Value: secret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without user verification the passkey is one factor and the code is still needed
+	authenticator.unverified = true
+	challenge, passkeyCookie := beginPasskeySignInWith(t, email)
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/finish", body: authenticator.assert(t, challenge, user.ID[:]), cookies: []*http.Cookie{passkeyCookie}}.do(t)
+	expectStatus(t, rec, http.StatusAccepted)
+	pendingCookie := sessionCookie(t, rec)
+	if status, _ := getUserViaSessionCookie(t, pendingCookie); status == http.StatusOK {
+		t.Fatal("expected the session to wait for the code")
+	}
+	rec = testRequest{method: http.MethodPost, path: "/auth/sign-in/totp", body: TOTPCode{Code: currentTOTPCode(t, secret, 0)}, cookies: []*http.Cookie{pendingCookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// a verified passkey is both factors
+	authenticator.unverified = false
+	challenge, passkeyCookie = beginPasskeySignInWith(t, email)
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/finish", body: authenticator.assert(t, challenge, user.ID[:]), cookies: []*http.Cookie{passkeyCookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+
+	// a locked account is refused
+	_, err = testServer.users.UpdateUserByEmail(ctx, email, bson.D{{Key: "lockedUntil", Value: time.Now().Add(time.Hour).UTC()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, passkeyCookie = beginPasskeySignInWith(t, email)
+	rec = testRequest{method: http.MethodPost, path: "/auth/passkey/finish", body: authenticator.assert(t, challenge, user.ID[:]), cookies: []*http.Cookie{passkeyCookie}}.do(t)
+	expectStatus(t, rec, http.StatusTooManyRequests)
+}
+
+// registerPasskeyWith registers the authenticator on the user of the session
+func registerPasskeyWith(t *testing.T, cookie *http.Cookie, userID primitive.ObjectID, authenticator *softAuthenticator) *httptest.ResponseRecorder {
+	t.Helper()
+
+	path := "/users/" + userID.Hex() + "/passkeys"
+	rec := testRequest{method: http.MethodPost, path: path + "/register/begin", cookies: []*http.Cookie{cookie}}.do(t)
+	expectStatus(t, rec, http.StatusOK)
+	var creation PasskeyCreationOptions
+	if err := json.Unmarshal(rec.Body.Bytes(), &creation); err != nil {
+		t.Fatal(err)
+	}
+	return testRequest{method: http.MethodPost, path: path + "/register/finish", body: authenticator.register(creation.PublicKey.Challenge), cookies: []*http.Cookie{cookie}}.do(t)
+}
+
+func TestPasskeyCanOnlyBeRegisteredOnce(t *testing.T) {
+	password := "password123456"
+	email := uniqueEmail("passkey-once")
+	otherEmail := uniqueEmail("passkey-other")
+	userID := insertUser(t, testServer, email, password, "user")
+	otherID := insertUser(t, testServer, otherEmail, password, "user")
+	cookie := signInAs(t, email, password)
+	authenticator := newSoftAuthenticator(t)
+
+	expectStatus(t, registerPasskeyWith(t, cookie, userID, authenticator), http.StatusOK)
+	expectStatus(t, registerPasskeyWith(t, cookie, userID, authenticator), http.StatusConflict)
+
+	// the credential id points to one user, so it can not be added to another
+	expectStatus(t, registerPasskeyWith(t, signInAs(t, otherEmail, password), otherID, authenticator), http.StatusConflict)
+}
+
+func TestPasskeyUpdatesOnlyChangeThatPasskey(t *testing.T) {
+	ctx := context.Background()
+	email := uniqueEmail("passkey-update")
+	userID := insertUser(t, testServer, email, "password123456", "user")
+
+	// both passkeys are added from a copy of the user without passkeys
+	first := Passkey{ID: unique("credential"), Name: "First", SignCount: 1}
+	second := Passkey{ID: unique("credential"), Name: "Second", SignCount: 1}
+	for _, passkey := range []Passkey{first, second} {
+		if err := testServer.users.AddPasskey(ctx, userID, passkey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testServer.users.AddPasskey(ctx, userID, first); err != errNotFound {
+		t.Fatalf("expected the passkey to be added once but got %v", err)
+	}
+
+	// an assertion with a sign count can only be used once
+	if err := testServer.users.UpdatePasskeySignCount(ctx, userID, second.ID, 5, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.users.UpdatePasskeySignCount(ctx, userID, second.ID, 5, time.Now()); err != errNotFound {
+		t.Fatalf("expected the same sign count to be refused but got %v", err)
+	}
+
+	user, err := testServer.users.FindUserByID(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Passkeys) != 2 || user.Passkeys[0].SignCount != 1 || user.Passkeys[1].SignCount != 5 || user.Passkeys[1].LastUsedAt.IsZero() {
+		t.Fatalf("expected both passkeys with only the second one used but got %+v", user.Passkeys)
+	}
+
+	if err := testServer.users.RemovePasskey(ctx, userID, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := testServer.users.RemovePasskey(ctx, userID, first.ID); err != errNotFound {
+		t.Fatalf("expected the removed passkey to not be found but got %v", err)
+	}
+}
+
+func TestParseCOSEKeyRefusesOtherKeys(t *testing.T) {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	// RS256 keys are not offered in the options
+	if _, err := parseCOSEKey(encodeCBOR(map[interface{}]interface{}{1: 3, 3: -257})); err == nil {
+		t.Fatal("expected an RS256 key to be refused")
+	}
+	if _, err := parseCOSEKey(encodeCBOR(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: y})); err == nil {
+		t.Fatal("expected a point that is not on the curve to be refused")
+	}
+}